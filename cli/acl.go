@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/xorgal/xtund/server"
+)
+
+var aclCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "Print the active access control rules and their hit counters",
+	Long: `Print the active access control rules and their hit counters.
+
+Rules are configured in the "acl" and "peers" sections of the configuration
+file and are applied by "systemctl reload" without dropping sessions. Counters
+start from zero whenever the rules are reloaded.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var response server.ACLResponse
+		err := apiRequest(http.MethodGet, "/acl", nil, &response)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, r := range response.Rules {
+			log.Printf("%d. %s %s (%d hits)", i+1, r.Action, fmtACLRule(r), r.Hits)
+		}
+		log.Printf("default %s (%d hits)", response.Default, response.DefaultHits)
+
+		log.Printf("\nPeers:")
+		for i, r := range response.Peers.Rules {
+			log.Printf("%d. %s from %s to %s (%d hits)", i+1, r.Action, fmtGroups(r.From), fmtGroups(r.To), r.Hits)
+		}
+		log.Printf("default %s (%d hits)", response.Peers.Default, response.Peers.DefaultHits)
+	},
+}
+
+func fmtGroups(groups []string) string {
+	if len(groups) == 0 {
+		return "all devices"
+	}
+	return "groups " + strings.Join(groups, ",")
+}
+
+func fmtACLRule(r server.ACLRuleResponse) string {
+	var parts []string
+	if len(r.Devices)+len(r.Groups) == 0 {
+		parts = append(parts, "all devices")
+	}
+	if len(r.Devices) > 0 {
+		parts = append(parts, "devices "+strings.Join(r.Devices, ","))
+	}
+	if len(r.Groups) > 0 {
+		parts = append(parts, "groups "+strings.Join(r.Groups, ","))
+	}
+	dst := "any"
+	if len(r.Destinations) > 0 {
+		dst = strings.Join(r.Destinations, ",")
+	}
+	parts = append(parts, "to "+dst)
+	if r.Protocol != "" {
+		parts = append(parts, "proto "+r.Protocol)
+	}
+	if len(r.Ports) > 0 {
+		parts = append(parts, "ports "+strings.Join(r.Ports, ","))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+var apiClient = &http.Client{Timeout: 10 * time.Second}
+
+// apiRequest calls the admin API of the running daemon. The address and the
+// admin key are taken from the configuration file, request is sent as JSON if
+// not nil and the JSON response is decoded into response if not nil.
+func apiRequest(method string, path string, request any, response any) error {
+	err := internal.LoadConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	host, port, err := net.SplitHostPort(config.AppConfig.ServerAddr)
+	if err != nil {
+		return fmt.Errorf("invalid server address %s: %v", config.AppConfig.ServerAddr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	var body io.Reader
+	if request != nil {
+		b, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Xtun-Admin-Key", internal.DaemonConfig.AdminKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon is not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
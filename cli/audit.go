@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xorgal/xtund/internal"
+)
+
+var verifyOnly bool
+var auditTail int
+var auditHead string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Print the audit log and verify its integrity",
+	Run: func(cmd *cobra.Command, args []string) {
+		var entries []internal.AuditEntry
+		found := false
+		head, err := internal.VerifyAuditLog(internal.FilePath.AuditPath, func(e internal.AuditEntry) {
+			found = found || e.Hash == auditHead
+			if !verifyOnly {
+				entries = append(entries, e)
+			}
+		})
+		if os.IsNotExist(err) {
+			log.Fatalf("%s: %s", internal.FilePath.AuditPath, statusNotFound)
+		}
+
+		if auditTail > 0 && len(entries) > auditTail {
+			entries = entries[len(entries)-auditTail:]
+		}
+		for _, e := range entries {
+			log.Println(fmtAuditEntry(e))
+		}
+
+		if err != nil {
+			log.Fatalf("audit log verification failed: %v", err)
+		}
+		// The chain cannot tell its own end, entries removed from the end
+		// are found by comparing with a head recorded before
+		if auditHead != "" && !found {
+			log.Fatalf("audit log verification failed: entry %s is missing, the log was truncated", auditHead)
+		}
+		if verifyOnly {
+			log.Printf("%s: %s", internal.FilePath.AuditPath, fmtStatus(statusOK))
+		}
+		log.Printf("head: %d %s", head.Seq, head.Hash)
+	},
+}
+
+func init() {
+	auditCmd.Flags().BoolVar(&verifyOnly, "verify", false, "Only verify the hash chain without printing entries")
+	auditCmd.Flags().IntVarP(&auditTail, "tail", "n", 0, "Print only the last N entries")
+	auditCmd.Flags().StringVar(&auditHead, "head", "", "Fail unless the log contains the entry of this hash, as printed as head before")
+}
+
+func fmtAuditEntry(e internal.AuditEntry) string {
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%q", k, e.Fields[k]))
+	}
+	actor := e.Actor
+	if actor == "" {
+		actor = "-"
+	}
+	return fmt.Sprintf("%6d %s %-20s %-22s %s", e.Seq, e.Time.Format(time.RFC3339), e.Event, actor, strings.Join(fields, " "))
+}
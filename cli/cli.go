@@ -1,7 +1,9 @@
 package cli
 
 import (
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/xorgal/xtun-core/pkg/config"
@@ -9,6 +11,9 @@ import (
 	"github.com/xorgal/xtund/server"
 )
 
+var instance string
+var configPath string
+
 var rootCmd = &cobra.Command{
 	Use:     internal.BinaryMetadata.BinaryFile,
 	Long:    internal.BinaryMetadata.Description,
@@ -18,16 +23,26 @@ var rootCmd = &cobra.Command{
 		DisableDescriptions: true,
 		DisableNoDescFlag:   true,
 	},
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		err := internal.SetupPaths(instance, configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		err := internal.LoadConfigFile()
 		if err != nil {
 			log.Fatalf("failed to load configuration: %v", err)
 		}
+		err = internal.ConfigureLogger(internal.DaemonConfig.Log, os.Stderr)
+		if err != nil {
+			log.Fatalf("failed to configure logger: %v", err)
+		}
 
-		iptablesServiceRunning := internal.IsIptablesServiceExists(true)
-		if !iptablesServiceRunning {
+		firewallServiceRunning := internal.IsFirewallServiceExists(true)
+		if !firewallServiceRunning {
 			f := internal.BinaryMetadata.BinaryFile
-			s := internal.Service.IPTABLES
+			s := internal.FirewallService()
 			log.Fatalf("%s did not setup system routes. Did you run \"%s start\"?", s, f)
 		}
 
@@ -36,11 +51,21 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVarP(&instance, "instance", "i", "", fmt.Sprintf("Name of the xtun instance to manage (env %s)", internal.EnvInstance))
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", fmt.Sprintf("Path to the configuration file (env %s)", internal.EnvConfig))
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(stopCmd)
 	rootCmd.AddCommand(restartCmd)
 	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(uninstallCmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(sessionsCmd)
+	rootCmd.AddCommand(deviceCmd)
+	rootCmd.AddCommand(usageCmd)
+	rootCmd.AddCommand(aclCmd)
+	rootCmd.AddCommand(routesCmd)
 }
 
 func Execute() {
@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/xorgal/xtund/server"
+)
+
+var rateLimitRequest server.RateLimitRequest
+var quotaRequest server.QuotaRequest
+var quotaLimit int64
+
+var deviceCmd = &cobra.Command{
+	Use:   "device",
+	Short: "Manage settings of registered devices",
+}
+
+var deviceRateLimitCmd = &cobra.Command{
+	Use:   "ratelimit <device-id>",
+	Short: "Override the rate limit of a device in bytes per second, 0 means unlimited",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rateLimitRequest.DeviceId = args[0]
+		if !rateLimitRequest.Reset && !cmd.Flags().Changed("upload") && !cmd.Flags().Changed("download") {
+			log.Fatal("nothing to change, use --upload, --download or --reset")
+		}
+		var response server.DeviceResponse
+		err := apiRequest(http.MethodPost, "/devices/ratelimit", rateLimitRequest, &response)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if response.RateLimit == nil {
+			log.Printf("%s: default rate limit", response.DeviceId)
+		} else {
+			log.Printf("%s: upload %s, download %s", response.DeviceId, fmtRate(response.RateLimit.Upload), fmtRate(response.RateLimit.Download))
+		}
+	},
+}
+
+var deviceQuotaCmd = &cobra.Command{
+	Use:   "quota <device-id>",
+	Short: "Override the traffic quota of a device in bytes per period, 0 means unlimited",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		quotaRequest.DeviceId = args[0]
+		if cmd.Flags().Changed("limit") {
+			quotaRequest.Quota = &quotaLimit
+		}
+		if !quotaRequest.Reset && !quotaRequest.ResetUsage && quotaRequest.Quota == nil {
+			log.Fatal("nothing to change, use --limit, --reset or --reset-usage")
+		}
+		var response server.DeviceUsageResponse
+		err := apiRequest(http.MethodPost, "/devices/quota", quotaRequest, &response)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printUsage(response)
+	},
+}
+
+func init() {
+	deviceRateLimitCmd.Flags().Int64Var(&rateLimitRequest.Upload, "upload", 0, "Upload rate limit in bytes per second")
+	deviceRateLimitCmd.Flags().Int64Var(&rateLimitRequest.Download, "download", 0, "Download rate limit in bytes per second")
+	deviceRateLimitCmd.Flags().BoolVar(&rateLimitRequest.Reset, "reset", false, "Remove the override and use the default rate limit")
+	deviceQuotaCmd.Flags().Int64Var(&quotaLimit, "limit", 0, "Quota in bytes per period")
+	deviceQuotaCmd.Flags().BoolVar(&quotaRequest.Reset, "reset", false, "Remove the override and use the default quota")
+	deviceQuotaCmd.Flags().BoolVar(&quotaRequest.ResetUsage, "reset-usage", false, "Discard the usage of the current period")
+	deviceCmd.AddCommand(deviceRateLimitCmd)
+	deviceCmd.AddCommand(deviceQuotaCmd)
+}
@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+// defaultDaemon holds the defaults of daemon settings before any flag is bound
+var defaultDaemon = internal.DaemonConfig
+
+// configFlag is a setting `init` and `run` take on the command line. field
+// returns a pointer to the setting in the given configuration.
+type configFlag struct {
+	name      string
+	shorthand string
+	value     any
+	usage     string
+	field     func(app *config.Config, daemon *internal.IDaemonConfig) any
+}
+
+// configFlags lists the settings of the configuration file which are flags of
+// both `init` and `run`
+var configFlags = []configFlag{
+	{"server-address", "s", "", "Specify the server's IP address and port (Format: \"IP:port\")",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.ServerAddr }},
+	{"cidr", "c", "10.0.10.1/24", "Specify the CIDR block for the TUN device",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.CIDR }},
+	{"protocol", "p", "wss", "Set the WebSocket protocol. Allowed values: \"ws\" or \"wss\"",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.Protocol }},
+	{"device-name", "n", "xtun", "Assign a custom name to the TUN device",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.DeviceName }},
+	{"key", "k", "xtun@2023", "Set the authentication key",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.Key }},
+	{"admin-key", "", "", "Set the key of the admin API used by the CLI, init generates a random one if empty",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.AdminKey }},
+	{"mtu", "m", 0, "Specify the Maximum Transmission Unit (MTU) for the TUN device, 0 computes it from the link MTU",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.MTU }},
+	{"codecs", "", []string(nil), "Offer compression codecs to clients in order of preference (zstd, lz4, snappy)",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Codecs }},
+	{"batch", "", false, "Coalesce packets into one WebSocket message for clients which support it",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Batch.Enabled }},
+	{"batch-size", "", defaultDaemon.Batch.MaxSize, "Set the size in bytes which triggers sending a batch",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Batch.MaxSize }},
+	{"batch-delay", "", defaultDaemon.Batch.Delay, "Set the time in microseconds a packet may wait for a batch",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Batch.Delay }},
+	{"tun-queues", "", defaultDaemon.TunQueues, "Set the number of queues of the TUN device, each is read on a core of its own",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.TunQueues }},
+	{"tun-offload", "", false, "Pass TCP segments of up to 64 KiB between the kernel and xtund instead of single packets",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.TunOffload }},
+	{"queue-size", "", defaultDaemon.Queue.Size, "Set the number of MTU sized packets queued per client before packets are dropped",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Queue.Size }},
+	{"queue-bytes", "", defaultDaemon.Queue.Bytes, "Set the number of bytes queued per client before packets are dropped, 0 derives it from --queue-size and the MTU",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Queue.Bytes }},
+	{"queue-policy", "", defaultDaemon.Queue.Policy, "Set the policy of client queues (tail, priority), priority sends small packets first",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Queue.Policy }},
+	{"write-timeout", "", defaultDaemon.Queue.WriteTimeout, "Set the time in milliseconds a write to a client may take before it is disconnected, 0 means no timeout",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Queue.WriteTimeout }},
+	{"ping-interval", "", defaultDaemon.Keepalive.Interval, "Set the time in seconds between pings to clients, 0 disables pings",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Keepalive.Interval }},
+	{"idle-timeout", "", defaultDaemon.Keepalive.Timeout, "Set the time in seconds after which silent clients are disconnected, 0 means no timeout",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Keepalive.Timeout }},
+	{"resume-grace", "", defaultDaemon.Resume.Grace, "Set the time in seconds a session is kept for a client to resume it, 0 disables resumption",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Resume.Grace }},
+	{"max-links", "", defaultDaemon.Links.Max, "Set the number of connections a client may join to one session, 1 disables joining",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Links.Max }},
+	{"link-mtu", "", defaultDaemon.LinkMTU, "Specify the MTU of the network clients connect over",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.LinkMTU }},
+	{"buffer-size", "b", 64 * 1024, "Set the size of the buffer for packet handling",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.BufferSize }},
+	{"compress", "z", false, "Enable compression",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &a.Compress }},
+	{"firewall", "f", internal.FirewallAuto, "Set the firewall backend for NAT and forwarding rules. Allowed values: \"auto\", \"iptables\" or \"nftables\"",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Firewall }},
+	{"log-level", "", "info", "Set the log level. Allowed values: \"debug\", \"info\", \"warn\" or \"error\"",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Log.Level }},
+	{"log-format", "", internal.LogFormatText, "Set the log format. Allowed values: \"text\" or \"json\"",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Log.Format }},
+	{"log-file", "", false, "Also write logs to a rotating file in the log directory",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Log.File }},
+	{"upload-rate", "", int64(0), "Set the default upload rate limit per device in bytes per second, 0 means unlimited",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.RateLimit.Upload }},
+	{"download-rate", "", int64(0), "Set the default download rate limit per device in bytes per second, 0 means unlimited",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.RateLimit.Download }},
+	{"quota", "", int64(0), "Set the default traffic quota per device in bytes per period, 0 means unlimited",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Quota.Limit }},
+	{"quota-action", "", internal.QuotaActionBlock, "Set the action for devices over quota (block, throttle)",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Quota.Action }},
+	{"quota-throttle-rate", "", defaultDaemon.Quota.ThrottleRate, "Set the rate limit of throttled devices in bytes per second",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Quota.ThrottleRate }},
+	{"quota-reset-day", "", 1, "Set the day of month on which quota usage is reset (1-28)",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Quota.ResetDay }},
+	{"acl-default", "", internal.ACLAllow, "Set the policy for destinations no ACL rule matches (allow, deny)",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.ACL.Default }},
+	{"route", "", []string(nil), "Push a network to route through the tunnel to clients, may be repeated",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Routes.Routes }},
+	{"exclude-route", "", []string(nil), "Push a network to keep out of the tunnel to clients, may be repeated",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Routes.Exclude }},
+	{"full-tunnel", "", false, "Tell clients to route all traffic through the tunnel",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Routes.FullTunnel }},
+	{"dns", "", []string(nil), "Push a DNS server to clients, may be repeated",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.DNS.Servers }},
+	{"dns-search", "", []string(nil), "Push a DNS search domain to clients, may be repeated",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.DNS.Search }},
+	{"dns-forwarder", "", false, "Serve DNS on the tunnel IP, resolving registered devices in the zone",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.DNS.Forwarder }},
+	{"dns-zone", "", defaultDaemon.DNS.Zone, "Set the zone devices are resolvable in as <device>.<zone>",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.DNS.Zone }},
+	{"dns-upstream", "", []string(nil), "Set an upstream server of the DNS forwarder, may be repeated (default from /etc/resolv.conf)",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.DNS.Upstream }},
+	{"peers", "", internal.ACLAllow, "Set whether clients may reach each other (allow, deny)",
+		func(a *config.Config, d *internal.IDaemonConfig) any { return &d.Peers.Default }},
+}
+
+// listenFlags are the listeners given on the command line, they become part
+// of the configuration once parsed, see `parseListeners`
+type listenFlags struct {
+	specs    []string
+	certFile string
+	keyFile  string
+}
+
+// addConfigFlags defines the flags of `configFlags` on fs, bound to the
+// settings of app and daemon
+func addConfigFlags(fs *pflag.FlagSet, app *config.Config, daemon *internal.IDaemonConfig, listen *listenFlags) {
+	for _, f := range configFlags {
+		switch p := f.field(app, daemon).(type) {
+		case *string:
+			fs.StringVarP(p, f.name, f.shorthand, f.value.(string), f.usage)
+		case *int:
+			fs.IntVarP(p, f.name, f.shorthand, f.value.(int), f.usage)
+		case *int64:
+			fs.Int64VarP(p, f.name, f.shorthand, f.value.(int64), f.usage)
+		case *bool:
+			fs.BoolVarP(p, f.name, f.shorthand, f.value.(bool), f.usage)
+		case *[]string:
+			fs.StringSliceVarP(p, f.name, f.shorthand, f.value.([]string), f.usage)
+		default:
+			panic(fmt.Sprintf("flag %s: unsupported type %T", f.name, p))
+		}
+	}
+	fs.StringSliceVar(&listen.specs, "listen", nil, "Accept tunnels without WebSocket on a listener given as tcp://addr or tls://addr, may be repeated")
+	fs.StringVar(&listen.certFile, "tls-cert", "", "Set the PEM certificate file of TLS listeners given with --listen")
+	fs.StringVar(&listen.keyFile, "tls-key", "", "Set the PEM key file of TLS listeners given with --listen")
+}
+
+// copyConfigFlags copies the settings of flags set on fs from the source to
+// the destination configuration
+func copyConfigFlags(fs *pflag.FlagSet, dstApp *config.Config, dstDaemon *internal.IDaemonConfig, srcApp *config.Config, srcDaemon *internal.IDaemonConfig) {
+	for _, f := range configFlags {
+		if !fs.Changed(f.name) {
+			continue
+		}
+		switch dst := f.field(dstApp, dstDaemon).(type) {
+		case *string:
+			*dst = *f.field(srcApp, srcDaemon).(*string)
+		case *int:
+			*dst = *f.field(srcApp, srcDaemon).(*int)
+		case *int64:
+			*dst = *f.field(srcApp, srcDaemon).(*int64)
+		case *bool:
+			*dst = *f.field(srcApp, srcDaemon).(*bool)
+		case *[]string:
+			*dst = *f.field(srcApp, srcDaemon).(*[]string)
+		}
+	}
+}
+
+// validateConfig checks the active configuration, it is run by `init` and by
+// `run` once flags are applied
+func validateConfig() error {
+	if config.AppConfig.Protocol != "ws" && config.AppConfig.Protocol != "wss" {
+		return fmt.Errorf("unknown protocol: %s", config.AppConfig.Protocol)
+	}
+	d := internal.DaemonConfig
+	for _, validate := range []func() error{
+		d.Log.Validate,
+		d.RateLimit.Validate,
+		d.Quota.Validate,
+		d.ACL.Validate,
+		func() error { return d.Peers.Validate(d.ACL.Groups) },
+		d.Routes.Validate,
+		d.DNS.Validate,
+		func() error { return internal.ValidateCodecs(d.Codecs) },
+		d.Batch.Validate,
+		d.Queue.Validate,
+		d.Keepalive.Validate,
+		d.Resume.Validate,
+		d.Links.Validate,
+		func() error { return internal.ValidateTunQueues(d.TunQueues) },
+		func() error { return internal.ValidateListeners(d.Listeners) },
+		func() error { return internal.ValidateAdminKey(d.AdminKey, config.AppConfig.Key) },
+	} {
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
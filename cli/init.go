@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/spf13/cobra"
@@ -10,12 +11,36 @@ import (
 	"github.com/xorgal/xtund/server"
 )
 
+var initListen listenFlags
+
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Initialize the xtun daemon and create required systemd services",
 	Run: func(cmd *cobra.Command, args []string) {
-		if config.AppConfig.Protocol != "ws" && config.AppConfig.Protocol != "wss" {
-			log.Fatalln("unknown protocol:", config.AppConfig.Protocol)
+		firewall, err := internal.ResolveFirewall(internal.DaemonConfig.Firewall)
+		if err != nil {
+			log.Fatal(err)
+		}
+		internal.DaemonConfig.Firewall = firewall
+		if internal.DaemonConfig.AdminKey == "" {
+			internal.DaemonConfig.AdminKey = internal.NewAdminKey()
+		}
+		internal.DaemonConfig.Listeners, err = parseListeners(initListen.specs, initListen.certFile, initListen.keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = validateConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Instances must not share a port or tunnel addresses
+		err = checkInstances(config.AppConfig.ServerAddr, config.AppConfig.CIDR, internal.DaemonConfig.Listeners)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Instances must not share the TUN device
+		if internal.Instance != "" && !cmd.Flags().Changed("device-name") {
+			config.AppConfig.DeviceName = fmt.Sprintf("xtun-%s", internal.Instance)
 		}
 		gateway, err := netutil.DiscoverGateway(true)
 		if err != nil {
@@ -41,9 +66,9 @@ var initCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		serviceExists := internal.IsIptablesServiceExists(false)
+		serviceExists := internal.IsFirewallServiceExists(false)
 		if !serviceExists {
-			internal.CreateIptablesService(config.AppConfig)
+			internal.CreateFirewallService(config.AppConfig)
 		}
 
 		serviceExists = internal.IsXtundServiceExists(false)
@@ -55,14 +80,34 @@ var initCmd = &cobra.Command{
 	},
 }
 
+// checkInstances returns an error if the server address or a listener uses
+// a port another instance listens on, or if the tunnel network overlaps
+// with that of another instance
+func checkInstances(serverAddr string, cidr string, listeners []internal.IListenerConfig) error {
+	others, err := internal.InstanceNetworks()
+	if err != nil {
+		return fmt.Errorf("failed to read the configs of other instances: %v", err)
+	}
+	addrs := []string{serverAddr}
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr)
+	}
+	for name, other := range others {
+		for _, otherAddr := range other.Addrs {
+			for _, addr := range addrs {
+				if internal.AddrsConflict(addr, otherAddr) {
+					return fmt.Errorf("%s conflicts with %s of instance %q, choose another port", addr, otherAddr, name)
+				}
+			}
+		}
+		if internal.CIDRsOverlap(cidr, other.CIDR) {
+			return fmt.Errorf("network %s overlaps with %s of instance %q, choose another network", cidr, other.CIDR, name)
+		}
+	}
+	return nil
+}
+
 func init() {
-	initCmd.Flags().StringVarP(&config.AppConfig.ServerAddr, "server-address", "s", "", "Specify the server's IP address and port (Format: \"IP:port\")")
+	addConfigFlags(initCmd.Flags(), &config.AppConfig, &internal.DaemonConfig, &initListen)
 	initCmd.MarkFlagRequired("server-address")
-	initCmd.Flags().StringVarP(&config.AppConfig.CIDR, "cidr", "c", "10.0.10.1/24", "Specify the CIDR block for the TUN device")
-	initCmd.Flags().StringVarP(&config.AppConfig.Protocol, "protocol", "p", "wss", "Set the WebSocket protocol. Allowed values: \"ws\" or \"wss\"")
-	initCmd.Flags().StringVarP(&config.AppConfig.DeviceName, "device-name", "n", "xtun", "Assign a custom name to the TUN device")
-	initCmd.Flags().StringVarP(&config.AppConfig.Key, "key", "k", "xtun@2023", "Set the authentication key")
-	initCmd.Flags().IntVarP(&config.AppConfig.MTU, "mtu", "m", 1500, "Specify the Maximum Transmission Unit (MTU) for the TUN device")
-	initCmd.Flags().IntVarP(&config.AppConfig.BufferSize, "buffer-size", "b", 64*1024, "Set the size of the buffer for packet handling")
-	initCmd.Flags().BoolVarP(&config.AppConfig.Compress, "compress", "z", false, "Enable compression")
 }
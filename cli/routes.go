@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+var routesDevice string
+var routesExclude bool
+
+var routesCmd = &cobra.Command{
+	Use:   "routes",
+	Short: "Print the routes pushed to clients",
+	Long: `Print the routes pushed to clients.
+
+Clients receive the routes of the pool unless their device has its own
+routes, which replace those of the pool. Changes are saved to the
+configuration file and the running daemon is reloaded.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		loadRoutesConfig()
+		routes := internal.DaemonConfig.Routes
+		if routesDevice != "" {
+			if _, ok := routes.Devices[routesDevice]; !ok {
+				log.Printf("%s has no own routes, the pool routes apply", routesDevice)
+			}
+			printRouteSet(routesDevice, routes.RoutesFor(routesDevice))
+			return
+		}
+		printRouteSet("pool", routes.RoutesFor(""))
+		devices := make([]string, 0, len(routes.Devices))
+		for id := range routes.Devices {
+			devices = append(devices, id)
+		}
+		slices.Sort(devices)
+		for _, id := range devices {
+			printRouteSet(id, routes.RoutesFor(id))
+		}
+	},
+}
+
+var routesAddCmd = &cobra.Command{
+	Use:   "add <network>...",
+	Short: "Route networks through the tunnel, or bypass it with --exclude",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateRoutes(func(set *internal.IRouteSet) {
+			list := &set.Routes
+			if routesExclude {
+				list = &set.Exclude
+			}
+			for _, network := range args {
+				if !slices.Contains(*list, network) {
+					*list = append(*list, network)
+				}
+			}
+		})
+	},
+}
+
+var routesRemoveCmd = &cobra.Command{
+	Use:   "remove <network>...",
+	Short: "Remove routes, or excluded routes with --exclude",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateRoutes(func(set *internal.IRouteSet) {
+			list := &set.Routes
+			if routesExclude {
+				list = &set.Exclude
+			}
+			*list = slices.DeleteFunc(*list, func(network string) bool {
+				return slices.Contains(args, network)
+			})
+		})
+	},
+}
+
+var routesFullTunnelCmd = &cobra.Command{
+	Use:       "full-tunnel <on|off>",
+	Short:     "Route all traffic of clients through the tunnel",
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"on", "off"},
+	Run: func(cmd *cobra.Command, args []string) {
+		if args[0] != "on" && args[0] != "off" {
+			log.Fatalf("expected on or off: %s", args[0])
+		}
+		updateRoutes(func(set *internal.IRouteSet) {
+			set.FullTunnel = args[0] == "on"
+		})
+	},
+}
+
+var routesResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Remove the routes of a device, it falls back to the pool routes",
+	Run: func(cmd *cobra.Command, args []string) {
+		if routesDevice == "" {
+			log.Fatal("--device is required")
+		}
+		loadRoutesConfig()
+		delete(internal.DaemonConfig.Routes.Devices, routesDevice)
+		saveRoutesConfig()
+	},
+}
+
+// updateRoutes changes the routes of the pool, or of the device given by
+// --device, saves the configuration and reloads the daemon
+func updateRoutes(fn func(set *internal.IRouteSet)) {
+	loadRoutesConfig()
+	routes := &internal.DaemonConfig.Routes
+	if routesDevice == "" {
+		fn(&routes.IRouteSet)
+	} else {
+		if routes.Devices == nil {
+			routes.Devices = make(map[string]internal.IRouteSet)
+		}
+		// A new device override starts from the pool routes
+		set, ok := routes.Devices[routesDevice]
+		if !ok {
+			set = routes.IRouteSet
+			set.Routes = slices.Clone(set.Routes)
+			set.Exclude = slices.Clone(set.Exclude)
+		}
+		fn(&set)
+		routes.Devices[routesDevice] = set
+	}
+	err := routes.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	saveRoutesConfig()
+	name := "pool"
+	if routesDevice != "" {
+		name = routesDevice
+	}
+	printRouteSet(name, routes.RoutesFor(routesDevice))
+}
+
+func loadRoutesConfig() {
+	err := internal.LoadConfigFile()
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+}
+
+func saveRoutesConfig() {
+	err := internal.SaveConfigFile(config.AppConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	internal.ReloadService(internal.Service.XTUND)
+}
+
+func printRouteSet(name string, set internal.IRouteSet) {
+	mode := "split tunnel"
+	if set.FullTunnel {
+		mode = "full tunnel"
+	}
+	log.Printf("%s: %s", name, mode)
+	if len(set.Routes) > 0 {
+		log.Printf("  routes: %s", strings.Join(set.Routes, ", "))
+	}
+	if len(set.Exclude) > 0 {
+		log.Printf("  excluded: %s", strings.Join(set.Exclude, ", "))
+	}
+}
+
+func init() {
+	routesCmd.PersistentFlags().StringVarP(&routesDevice, "device", "d", "", "Apply to the routes of a single device instead of the pool")
+	routesAddCmd.Flags().BoolVar(&routesExclude, "exclude", false, "Change excluded routes")
+	routesRemoveCmd.Flags().BoolVar(&routesExclude, "exclude", false, "Change excluded routes")
+	routesCmd.AddCommand(routesAddCmd)
+	routesCmd.AddCommand(routesRemoveCmd)
+	routesCmd.AddCommand(routesFullTunnelCmd)
+	routesCmd.AddCommand(routesResetCmd)
+}
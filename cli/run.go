@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+	"github.com/xorgal/xtund/server"
+)
+
+var foreground bool
+var skipFirewall bool
+
+// runConfig and runDaemon hold `run` flag values, they are applied on top of
+// the configuration file only when set explicitly or through the environment
+var runConfig config.Config
+var runDaemon = internal.DaemonConfig
+var runListen listenFlags
+
+var runCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run xtun daemon",
+	Long: `Run xtun daemon.
+
+With --foreground the daemon runs in the current process without systemd,
+e.g. in a container. Settings are read from the configuration file if it
+exists and may be overridden by flags or XTUN_* environment variables named
+after them (--server-address becomes XTUN_SERVER_ADDRESS). Forwarding and
+NAT are set up on start and removed on exit unless --skip-firewall is given.
+Without --foreground the systemd service is started instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := applyRunEnv(cmd.LocalFlags())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !foreground {
+			startCmd.Run(cmd, args)
+			return
+		}
+
+		listeners, err := parseListeners(runListen.specs, runListen.certFile, runListen.keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = loadRunConfig(cmd.LocalFlags(), listeners)
+		if err != nil {
+			log.Fatalf("failed to load configuration: %v", err)
+		}
+		if config.AppConfig.ServerAddr == "" {
+			log.Fatal("server address is not configured, use --server-address or XTUN_SERVER_ADDRESS")
+		}
+		err = internal.ConfigureLogger(internal.DaemonConfig.Log, os.Stdout)
+		if err != nil {
+			log.Fatalf("failed to configure logger: %v", err)
+		}
+		errs := internal.MakeAllDirs()
+		if len(errs) != 0 {
+			for _, err := range errs {
+				log.Fatal(err)
+			}
+		}
+
+		if !skipFirewall {
+			firewall, err := internal.ResolveFirewall(internal.DaemonConfig.Firewall)
+			if err != nil {
+				log.Fatal(err)
+			}
+			internal.DaemonConfig.Firewall = firewall
+			err = internal.SetupFirewall(config.AppConfig)
+			if err != nil {
+				log.Fatalf("failed to set up firewall: %v", err)
+			}
+			// The rules are removed as installed, whatever is reloaded meanwhile
+			installed := config.AppConfig
+			defer func() {
+				internal.DaemonConfig.Firewall = firewall
+				err := internal.TeardownFirewall(installed)
+				if err != nil {
+					log.Printf("failed to remove firewall rules: %v", err)
+				}
+			}()
+		}
+
+		// SIGHUP reloads the configuration file with the same overrides
+		server.LoadConfig = func() error {
+			return loadRunConfig(cmd.LocalFlags(), listeners)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = server.Run(ctx, config.AppConfig)
+		if err != nil {
+			log.Println(err)
+		}
+	},
+}
+
+func init() {
+	runCmd.Flags().BoolVarP(&foreground, "foreground", "F", false, "Run in the foreground without systemd, logging to stdout")
+	runCmd.Flags().BoolVar(&skipFirewall, "skip-firewall", false, "Do not set up forwarding and NAT rules")
+	addConfigFlags(runCmd.Flags(), &runConfig, &runDaemon, &runListen)
+}
+
+// loadRunConfig loads the configuration file, or the flag defaults if there is
+// none, applies flags set on the command line or through the environment and
+// validates the result
+func loadRunConfig(flags *pflag.FlagSet, listeners []internal.IListenerConfig) error {
+	// An invalid configuration leaves the active one in place
+	app, daemon := config.AppConfig, internal.DaemonConfig
+	if internal.IsConfigFileExists() {
+		err := internal.LoadConfigFile()
+		if err != nil {
+			return err
+		}
+	} else {
+		config.AppConfig = runConfig
+		internal.DaemonConfig = runDaemon
+		internal.DaemonConfig.Listeners = listeners
+	}
+	copyConfigFlags(flags, &config.AppConfig, &internal.DaemonConfig, &runConfig, &runDaemon)
+	if flags.Changed("listen") {
+		internal.DaemonConfig.Listeners = listeners
+	}
+	config.AppConfig.ServerMode = true
+	config.AppConfig.GlobalMode = false
+	config.AppConfig.GUIMode = false
+	err := validateConfig()
+	if err != nil {
+		config.AppConfig, internal.DaemonConfig = app, daemon
+		return err
+	}
+	return nil
+}
+
+// applyRunEnv sets flags which were not given on the command line from their
+// environment variable, e.g. XTUN_SERVER_ADDRESS for --server-address
+func applyRunEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		env := "XTUN_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok && !f.Changed && err == nil {
+			if e := flags.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("invalid %s: %v", env, e)
+			}
+		}
+	})
+	return err
+}
+
+// parseListeners returns the listeners given as transport://addr, TLS
+// listeners use the certificate and key files
+func parseListeners(specs []string, certFile string, keyFile string) ([]internal.IListenerConfig, error) {
+	var listeners []internal.IListenerConfig
+	for _, spec := range specs {
+		l, err := internal.ParseListener(spec)
+		if err != nil {
+			return nil, err
+		}
+		if l.Transport == internal.TransportTLS {
+			l.CertFile = certFile
+			l.KeyFile = keyFile
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, internal.ValidateListeners(listeners)
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xorgal/xtund/server"
+)
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Print connected clients and their traffic counters",
+	Run: func(cmd *cobra.Command, args []string) {
+		var response server.SessionsResponse
+		err := apiRequest(http.MethodGet, "/sessions", nil, &response)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range response.Sessions {
+			device := s.Device
+			if device == "" {
+				device = "-"
+			}
+			log.Printf("%s %s (%s) since %s", device, s.IP, s.Remote, time.Unix(s.Since, 0).Format(time.RFC3339))
+			if s.Parked {
+				log.Printf("  parked, waiting for the client to resume")
+			}
+			log.Printf("  read %d bytes, written %d bytes", s.ReadBytes, s.WrittenBytes)
+			log.Printf("  rate limit: upload %s, download %s", fmtRate(s.UploadRate), fmtRate(s.DownloadRate))
+			log.Printf("  upload delayed %d, upload dropped %d, download dropped %d, denied by ACL %d", s.UploadDelayed, s.UploadDropped, s.DownloadDropped, s.ACLDenied)
+			log.Printf("  to peers forwarded %d, denied %d", s.PeerForwarded, s.PeerDenied)
+			log.Printf("  mtu %d, too big %d", s.MTU, s.TooBig)
+			log.Printf("  codec %s, decode failed %d, batched %t", s.Codec, s.DecodeFailed, s.Batched)
+			log.Printf("  spoofed source dropped %d", s.Spoofed)
+			log.Printf("  queue depth %d, max depth %d, %d of %d bytes, dropped %d", s.QueueDepth, s.QueueMaxDepth, s.QueueBytes, s.QueueMaxBytes, s.QueueDropped)
+			log.Printf("  rtt %.1f ms, last seen %s", s.RTT, time.Unix(s.LastSeen, 0).Format(time.RFC3339))
+			for _, l := range s.Links {
+				log.Printf("  link %s over %s since %s: written %d bytes, queue depth %d (%d bytes), rtt %.1f ms", l.Remote, l.Transport, time.Unix(l.Since, 0).Format(time.RFC3339), l.WrittenBytes, l.QueueDepth, l.QueueBytes, l.RTT)
+			}
+		}
+		t := response.Totals
+		log.Printf("\nTotal: read %d bytes, written %d bytes", t.ReadBytes, t.WrittenBytes)
+		log.Printf("  upload delayed %d, upload dropped %d, download dropped %d, denied by ACL %d", t.UploadDelayed, t.UploadDropped, t.DownloadDropped, t.ACLDenied)
+		log.Printf("  to peers forwarded %d, denied %d", t.PeerForwarded, t.PeerDenied)
+		log.Printf("  too big %d, decode failed %d, queue dropped %d, timed out %d", t.TooBig, t.DecodeFailed, t.QueueDropped, t.TimedOut)
+		log.Printf("  spoofed source dropped %d", t.Spoofed)
+	},
+}
+
+func fmtRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d B/s", rate)
+}
@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/xorgal/xtund/internal"
@@ -31,6 +32,10 @@ var statusCmd = &cobra.Command{
 				log.Printf("  %s: %s", internal.FilePath.ConfigPath, fmtStatus(statusNotFound))
 			} else {
 				log.Printf("  %s: %s", internal.FilePath.ConfigPath, fmtStatus(statusOK))
+				err := internal.LoadConfigFile()
+				if err != nil {
+					log.Printf("failed to load configuration: %v", err)
+				}
 			}
 
 			allocatorFileExists := internal.IsAllocatorFileExists()
@@ -41,10 +46,12 @@ var statusCmd = &cobra.Command{
 			}
 
 			log.Println("\nsystemd services:")
-			iptablesServiceExists := internal.IsIptablesServiceExists(false)
-			iptablesServiceRunning := internal.IsIptablesServiceExists(true)
-			printServiceStatusFmt(internal.Service.IPTABLES, iptablesServiceExists, iptablesServiceRunning, " ")
-			printServiceStatusFmt(internal.Service.XTUND, xtundServiceExists, xtundServiceRunning, "         ")
+			firewallServiceExists := internal.IsFirewallServiceExists(false)
+			firewallServiceRunning := internal.IsFirewallServiceExists(true)
+			firewallService := internal.FirewallService()
+			pad := strings.Repeat(" ", 1+len(firewallService)-len(internal.Service.XTUND))
+			printServiceStatusFmt(firewallService, firewallServiceExists, firewallServiceRunning, " ")
+			printServiceStatusFmt(internal.Service.XTUND, xtundServiceExists, xtundServiceRunning, pad)
 			log.Println()
 		} else {
 			printServiceStatus(internal.Service.XTUND, xtundServiceExists, xtundServiceRunning)
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/xorgal/xtund/internal"
+)
+
+var purge bool
+var assumeYes bool
+
+var uninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stop xtun daemon, remove systemd services and firewall rules",
+	Run: func(cmd *cobra.Command, args []string) {
+		services := []string{
+			internal.Service.XTUND,
+			internal.Service.IPTABLES,
+			internal.Service.NFTABLES,
+		}
+
+		if !assumeYes {
+			question := "This will stop and remove xtun services along with their firewall rules."
+			if purge {
+				question += fmt.Sprintf(" %s and %s will be deleted.", internal.DirPath.ConfigDir, internal.DirPath.Data)
+			}
+			if !confirm(question + " Continue?") {
+				log.Println("Aborted")
+				return
+			}
+		}
+
+		// Stopping the routing service removes its firewall rules
+		for _, s := range services {
+			internal.StopService(s)
+			internal.RemoveService(s)
+		}
+		internal.ReloadSystemd()
+
+		err := os.Remove(internal.FilePath.NftablesPath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove %s: %v", internal.FilePath.NftablesPath, err)
+		}
+
+		if purge {
+			errs := internal.RemoveDataDirs()
+			if len(errs) != 0 {
+				for _, err := range errs {
+					log.Fatal(err)
+				}
+			}
+		}
+
+		log.Println("xtun successfully uninstalled")
+	},
+}
+
+func init() {
+	uninstallCmd.Flags().BoolVar(&purge, "purge", false, "Delete configuration and data directories")
+	uninstallCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Do not prompt for confirmation")
+}
+
+// confirm asks a yes/no question on stdin, anything but "y" or "yes" is a no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
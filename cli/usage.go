@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/cobra"
+	"github.com/xorgal/xtund/server"
+)
+
+var usageCmd = &cobra.Command{
+	Use:   "usage [device-id]",
+	Short: "Print traffic usage and quota of registered devices in the current period",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := "/devices/usage"
+		if len(args) == 1 {
+			path += "?id=" + url.QueryEscape(args[0])
+		}
+		var response []server.DeviceUsageResponse
+		err := apiRequest(http.MethodGet, path, nil, &response)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range response {
+			printUsage(u)
+		}
+	},
+}
+
+func printUsage(u server.DeviceUsageResponse) {
+	quota := "unlimited"
+	if u.Quota > 0 {
+		quota = fmt.Sprintf("%d bytes", u.Quota)
+	}
+	state := ""
+	if u.Exceeded {
+		state = ", exceeded"
+	}
+	log.Printf("%s: upload %d, download %d, total %d bytes since %s, quota %s%s",
+		u.DeviceId, u.Upload, u.Download, u.Upload+u.Download, u.Period.Format("2006-01-02"), quota, state)
+}
@@ -1,11 +1,15 @@
 module github.com/xorgal/xtund
 
-go 1.20
+go 1.21
 
 require (
+	github.com/klauspost/compress v1.17.8
 	github.com/net-byte/water v0.0.9
+	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/spf13/pflag v1.0.5
 	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.23.0
+	golang.org/x/net v0.25.0
 )
 
 require (
@@ -15,8 +19,6 @@ require (
 	github.com/inhies/go-bytesize v0.0.0-20220417184213-4913239db9cf // indirect
 	github.com/net-byte/go-gateway v0.0.2 // indirect
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/net v0.25.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20211104114900-415007cec224 // indirect
 	golang.zx2c4.com/wireguard v0.0.0-20220703234212-c31a7b1ab478 // indirect
 	golang.zx2c4.com/wireguard/windows v0.5.3 // indirect
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// IACLConfig restricts the destinations clients may reach through the tunnel
+type IACLConfig struct {
+	// Default is the policy for packets no rule matches, `ACLAllow` or `ACLDeny`
+	Default string `json:"default"`
+	// Groups maps group names to the IDs of their member devices
+	Groups map[string][]string `json:"groups,omitempty"`
+	// Rules are evaluated in order, the first matching rule decides
+	Rules []IACLRule `json:"rules,omitempty"`
+}
+
+// IPeerConfig controls traffic between clients of the tunnel network. Groups
+// are those of `IACLConfig`.
+type IPeerConfig struct {
+	// Default is the policy for peers no rule matches, `ACLAllow` or `ACLDeny`
+	Default string `json:"default"`
+	// Rules are evaluated in order, the first matching rule decides
+	Rules []IPeerRule `json:"rules,omitempty"`
+}
+
+// IPeerRule matches traffic from members of the From groups to members of
+// the To groups, an empty list matches every client
+type IPeerRule struct {
+	Action string   `json:"action"`
+	From   []string `json:"from,omitempty"`
+	To     []string `json:"to,omitempty"`
+}
+
+// Validate checks the policy and every rule against the groups
+func (c IPeerConfig) Validate(groups map[string][]string) error {
+	if c.Default != "" && c.Default != ACLAllow && c.Default != ACLDeny {
+		return fmt.Errorf("unknown default peer policy: %s", c.Default)
+	}
+	for i, rule := range c.Rules {
+		if rule.Action != ACLAllow && rule.Action != ACLDeny {
+			return fmt.Errorf("peer rule %d: unknown action: %s", i+1, rule.Action)
+		}
+		for _, g := range append(append([]string(nil), rule.From...), rule.To...) {
+			if _, ok := groups[g]; !ok {
+				return fmt.Errorf("peer rule %d: unknown group: %s", i+1, g)
+			}
+		}
+	}
+	return nil
+}
+
+// IACLRule matches packets of the listed devices and groups by destination.
+// A rule without devices and groups applies to every client, empty
+// destinations, protocol or ports match anything.
+type IACLRule struct {
+	Action  string   `json:"action"`
+	Devices []string `json:"devices,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	// Destinations are networks in CIDR notation or single addresses
+	Destinations []string `json:"destinations,omitempty"`
+	// Protocol is "tcp", "udp", "icmp", "icmpv6" or an IP protocol number
+	Protocol string `json:"protocol,omitempty"`
+	// Ports are destination ports or ranges like "8000-8080", TCP and UDP only
+	Ports []string `json:"ports,omitempty"`
+}
+
+// Validate checks the policy and every rule
+func (c IACLConfig) Validate() error {
+	if c.Default != "" && c.Default != ACLAllow && c.Default != ACLDeny {
+		return fmt.Errorf("unknown default ACL policy: %s", c.Default)
+	}
+	for i, rule := range c.Rules {
+		err := rule.validate(c.Groups)
+		if err != nil {
+			return fmt.Errorf("ACL rule %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r IACLRule) validate(groups map[string][]string) error {
+	if r.Action != ACLAllow && r.Action != ACLDeny {
+		return fmt.Errorf("unknown action: %s", r.Action)
+	}
+	for _, g := range r.Groups {
+		if _, ok := groups[g]; !ok {
+			return fmt.Errorf("unknown group: %s", g)
+		}
+	}
+	for _, d := range r.Destinations {
+		if _, err := ParseNetwork(d); err != nil {
+			return err
+		}
+	}
+	proto, err := ParseProtocol(r.Protocol)
+	if err != nil {
+		return err
+	}
+	if len(r.Ports) > 0 && proto != ProtocolTCP && proto != ProtocolUDP {
+		return fmt.Errorf("ports require protocol tcp or udp")
+	}
+	for _, p := range r.Ports {
+		if _, _, err := ParsePortRange(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GroupDevices returns the devices of the rule including members of its groups
+func (r IACLRule) GroupDevices(groups map[string][]string) []string {
+	devices := append([]string(nil), r.Devices...)
+	for _, g := range r.Groups {
+		devices = append(devices, groups[g]...)
+	}
+	return devices
+}
+
+// IP protocol numbers
+const (
+	ProtocolICMP   = 1
+	ProtocolTCP    = 6
+	ProtocolUDP    = 17
+	ProtocolICMPv6 = 58
+)
+
+// ParseProtocol returns the IP protocol number of a name or number, zero
+// for an empty string
+func ParseProtocol(s string) (uint8, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, nil
+	case "icmp":
+		return ProtocolICMP, nil
+	case "tcp":
+		return ProtocolTCP, nil
+	case "udp":
+		return ProtocolUDP, nil
+	case "icmpv6":
+		return ProtocolICMPv6, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("unknown protocol: %s", s)
+	}
+	return uint8(n), nil
+}
+
+// ParseNetwork parses a network in CIDR notation or a single address
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network: %s", s)
+	}
+	return network, nil
+}
+
+// ParsePortRange parses a port like "22" or a range like "8000-8080"
+func ParsePortRange(s string) (uint16, uint16, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port: %s", s)
+	}
+	hi := lo
+	if isRange {
+		hi, err = strconv.ParseUint(to, 10, 16)
+		if err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("invalid port range: %s", s)
+		}
+	}
+	return uint16(lo), uint16(hi), nil
+}
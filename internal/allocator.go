@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
@@ -14,6 +16,9 @@ const (
 	dbBucket = "allocator"
 )
 
+// errFound stops iterating over the bucket once a match is found
+var errFound = errors.New("found")
+
 type Allocator struct {
 	db   *bolt.DB
 	mu   sync.Mutex
@@ -29,10 +34,15 @@ func CreateAllocator(cidr string) (*Allocator, error) {
 		db:   db,
 		cidr: cidr,
 	}
-	// Initialize the bucket
+	// Initialize the buckets
 	err = a.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(dbBucket))
-		return err
+		for _, name := range []string{dbBucket, deviceBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -40,6 +50,11 @@ func CreateAllocator(cidr string) (*Allocator, error) {
 	return a, nil
 }
 
+// Close releases the allocator database
+func (a *Allocator) Close() error {
+	return a.db.Close()
+}
+
 func (a *Allocator) RegisterDevice(id string) (string, string, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -71,6 +86,7 @@ func (a *Allocator) RegisterDevice(id string) (string, string, error) {
 			return "", "", err
 		}
 		ip = allocatedIP
+		Audit(AuditAddressAllocated, "", "device", id, "ip", ip.String())
 	}
 	// Create a CIDR block
 	cidr := ip.String() + "/" + strings.Split(a.cidr, "/")[1]
@@ -78,6 +94,40 @@ func (a *Allocator) RegisterDevice(id string) (string, string, error) {
 	return cidr, serverIP, nil
 }
 
+// LookupIP returns the IP registered to the device
+func (a *Allocator) LookupIP(id string) (net.IP, bool) {
+	var ip net.IP
+	a.db.View(func(tx *bolt.Tx) error {
+		// Allocated IPs are keys of the same bucket
+		ipBytes := tx.Bucket([]byte(dbBucket)).Get([]byte(id))
+		if len(ipBytes) == net.IPv4len {
+			ip = bytesToIP(ipBytes)
+		}
+		return nil
+	})
+	return ip, ip != nil
+}
+
+// LookupDevice returns the ID of the device the IP is registered to
+func (a *Allocator) LookupDevice(ip net.IP) (string, bool) {
+	var id string
+	ipBytes := ipToBytes(ip)
+	if ipBytes == nil {
+		return "", false
+	}
+	a.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dbBucket))
+		return bucket.ForEach(func(k, v []byte) error {
+			if bytes.Equal(v, ipBytes) {
+				id = string(k)
+				return errFound
+			}
+			return nil
+		})
+	})
+	return id, id != ""
+}
+
 func (a *Allocator) generateIP() (net.IP, error) {
 	var ip net.IP
 	err := a.db.Update(func(tx *bolt.Tx) error {
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit events
+const (
+	AuditDeviceRegistered = "device.registered"
+	AuditDeviceUpdated    = "device.updated"
+	AuditAddressAllocated = "allocator.allocated"
+	AuditAuthFailed       = "auth.failed"
+	AuditHandshakeFailed  = "handshake.failed"
+	AuditSessionKicked    = "session.kicked"
+	AuditConfigReloaded   = "config.reloaded"
+	AuditQuotaExceeded    = "quota.exceeded"
+)
+
+// AuditEntry is a single line of the audit log. Every entry includes the hash
+// of the previous one, so removing or altering an entry breaks the chain.
+type AuditEntry struct {
+	Seq    uint64            `json:"seq"`
+	Time   time.Time         `json:"time"`
+	Event  string            `json:"event"`
+	Actor  string            `json:"actor,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Prev   string            `json:"prev"`
+	Hash   string            `json:"hash"`
+}
+
+// AuditLog is an append-only log of administrative and security events
+// stored as JSON lines
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+	last string
+}
+
+var auditLog *AuditLog
+
+// OpenAuditLog opens the audit log at path, creating it if needed, and
+// continues the hash chain of existing entries
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{}
+	err := readAuditLog(path, func(e AuditEntry) error {
+		a.seq = e.Seq
+		a.last = e.Hash
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	a.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetAuditLog makes a the destination of `Audit`
+func SetAuditLog(a *AuditLog) {
+	auditLog = a
+}
+
+// Audit records an event to the audit log set by `SetAuditLog`. The actor is
+// whoever caused the event, e.g. a remote address, and fields are key-value pairs.
+// Nothing is recorded if no audit log is set.
+func Audit(event string, actor string, fields ...any) {
+	if auditLog == nil {
+		return
+	}
+	err := auditLog.Record(event, actor, fields...)
+	if err != nil {
+		slog.Error("failed to write audit log", "event", event, "err", err)
+	}
+}
+
+// Record appends an event to the audit log and flushes it to disk
+func (a *AuditLog) Record(event string, actor string, fields ...any) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := AuditEntry{
+		Seq:   a.seq + 1,
+		Time:  time.Now().UTC(),
+		Event: event,
+		Actor: actor,
+		Prev:  a.last,
+	}
+	if len(fields) > 0 {
+		e.Fields = make(map[string]string, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			e.Fields[fmt.Sprint(fields[i])] = fmt.Sprint(fields[i+1])
+		}
+	}
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	a.seq = e.Seq
+	a.last = e.Hash
+	return a.file.Sync()
+}
+
+// Head returns the sequence number and hash of the last entry. Logged
+// elsewhere, it reveals entries removed from the end of the log.
+func (a *AuditLog) Head() (uint64, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seq, a.last
+}
+
+// Close closes the audit log file
+func (a *AuditLog) Close() error {
+	return a.file.Close()
+}
+
+// VerifyAuditLog reads the audit log at path, passes every entry to fn and
+// checks the sequence numbers and the hash chain. It returns the last entry,
+// whose hash identifies the whole chain, or an error describing the first
+// entry which does not match. Entries removed from the end of the log are
+// only detected by comparing the last entry with one seen before.
+func VerifyAuditLog(path string, fn func(e AuditEntry)) (AuditEntry, error) {
+	var head AuditEntry
+	err := readAuditLog(path, func(e AuditEntry) error {
+		if e.Seq != head.Seq+1 {
+			return fmt.Errorf("entry %d: expected sequence number %d", e.Seq, head.Seq+1)
+		}
+		if e.Prev != head.Hash {
+			return fmt.Errorf("entry %d: previous hash does not match", e.Seq)
+		}
+		hash, err := e.hash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("entry %d: hash does not match its content", e.Seq)
+		}
+		head = e
+		if fn != nil {
+			fn(e)
+		}
+		return nil
+	})
+	return head, err
+}
+
+// hash returns the hex encoded SHA-256 of the entry without its own hash
+func (e AuditEntry) hash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func readAuditLog(path string, fn func(e AuditEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) > 0 {
+			var e AuditEntry
+			if err := json.Unmarshal(b, &e); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestAudit(t *testing.T, n int) (string, *AuditLog) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	for i := 0; i < n; i++ {
+		err := a.Record(AuditConfigReloaded, "test", "n", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path, a
+}
+
+func TestVerifyAuditLogHead(t *testing.T) {
+	path, a := writeTestAudit(t, 3)
+	head, err := VerifyAuditLog(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, hash := a.Head()
+	if head.Seq != 3 || head.Seq != seq || head.Hash != hash {
+		t.Fatalf("head %d %s, log at %d %s", head.Seq, head.Hash, seq, hash)
+	}
+
+	// Removing the last entry leaves a valid chain with an earlier head
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	err = os.WriteFile(path, []byte(strings.Join(lines[:2], "")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, err := VerifyAuditLog(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated.Seq != 2 || truncated.Hash == head.Hash {
+		t.Fatalf("head of truncated log %d %s", truncated.Seq, truncated.Hash)
+	}
+}
+
+func TestVerifyAuditLogAltered(t *testing.T) {
+	path, _ := writeTestAudit(t, 3)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(strings.Replace(string(b), `"n":"1"`, `"n":"7"`, 1)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyAuditLog(path, nil)
+	if err == nil || !strings.Contains(err.Error(), "entry 2") {
+		t.Fatalf("altered entry: %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	FirewallAuto     = "auto"
+	FirewallIptables = "iptables"
+	FirewallNftables = "nftables"
+)
+
+const (
+	CodecZstd   = "zstd"
+	CodecLZ4    = "lz4"
+	CodecSnappy = "snappy"
+	// CodecNone is negotiated when client and server share no codec
+	CodecNone = "none"
+)
+
+const (
+	QuotaActionBlock    = "block"
+	QuotaActionThrottle = "throttle"
+)
+
+const (
+	// QueuePolicyTail drops packets to a client once its queue is full
+	QueuePolicyTail = "tail"
+	// QueuePolicyPriority queues small packets separately and sends them first
+	QueuePolicyPriority = "priority"
+)
+
+const (
+	// TransportTCP frames tunnel messages with a length prefix on raw TCP
+	TransportTCP = "tcp"
+	// TransportTLS is `TransportTCP` within TLS
+	TransportTLS = "tls"
+)
+
+// IDaemonConfig holds settings specific to xtund which are not part of the
+// shared xtun-core configuration. It is persisted in the same config file
+// under the "daemon" key.
+type IDaemonConfig struct {
+	// AdminKey grants access to the API managing sessions and devices, the
+	// key of clients does not. The API is disabled without it.
+	AdminKey  string           `json:"adminKey,omitempty"`
+	Firewall  string           `json:"firewall"`
+	Log       ILogConfig       `json:"log"`
+	RateLimit IRateLimitConfig `json:"rateLimit"`
+	Quota     IQuotaConfig     `json:"quota"`
+	ACL       IACLConfig       `json:"acl"`
+	Peers     IPeerConfig      `json:"peers"`
+	Routes    IRoutesConfig    `json:"routes"`
+	DNS       IDNSConfig       `json:"dns"`
+	// LinkMTU is the MTU of the network clients connect over, the tunnel
+	// MTU is derived from it unless set explicitly
+	LinkMTU int `json:"linkMtu"`
+	// Codecs are the compression codecs offered to clients in order of
+	// preference, see `CodecZstd`, `CodecLZ4` and `CodecSnappy`
+	Codecs []string     `json:"codecs,omitempty"`
+	Batch  IBatchConfig `json:"batch"`
+	Queue  IQueueConfig `json:"queue"`
+	// Keepalive detects clients which are gone without closing the connection
+	Keepalive IKeepaliveConfig `json:"keepalive"`
+	Resume    IResumeConfig    `json:"resume"`
+	Links     ILinksConfig     `json:"links"`
+	// Listeners accept tunnels without WebSocket in addition to the HTTP
+	// server, they are started on restart only
+	Listeners []IListenerConfig `json:"listeners,omitempty"`
+	// TunQueues is the number of queues of the TUN device, each is read by
+	// a goroutine of its own
+	TunQueues int `json:"tunQueues"`
+	// TunOffload enables TCP segmentation and receive offloads of the TUN
+	// device, see `CreateTunQueues`
+	TunOffload bool `json:"tunOffload"`
+}
+
+// IBatchConfig controls coalescing of packets into one WebSocket message for
+// clients which support it
+type IBatchConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxSize is the number of bytes which triggers sending a batch
+	MaxSize int `json:"maxSize"`
+	// Delay is the number of microseconds a packet may wait for others
+	Delay int `json:"delay"`
+}
+
+// Validate checks the batch size and delay
+func (c IBatchConfig) Validate() error {
+	if c.MaxSize < 1 || c.MaxSize > 1<<20 {
+		return fmt.Errorf("batch size must be between 1 and %d bytes: %d", 1<<20, c.MaxSize)
+	}
+	if c.Delay < 1 || c.Delay > 100000 {
+		return fmt.Errorf("batch delay must be between 1 and 100000 microseconds: %d", c.Delay)
+	}
+	return nil
+}
+
+// IQueueConfig bounds the packets waiting to be written to a client
+type IQueueConfig struct {
+	// Size is the number of packets of the session MTU a queue holds. Queues
+	// are bounded by bytes, up to `QueueSlots` times as many smaller packets
+	// fit.
+	Size int `json:"size"`
+	// Bytes is the number of frame bytes a queue holds, 0 derives it from
+	// Size and the session MTU
+	Bytes int `json:"bytes"`
+	// Policy is `QueuePolicyTail` or `QueuePolicyPriority`
+	Policy string `json:"policy"`
+	// WriteTimeout is the number of milliseconds a write to a client may
+	// take before the connection is closed, 0 means no timeout
+	WriteTimeout int `json:"writeTimeout"`
+}
+
+// QueueSlots is the number of packets a queue holds per packet of the
+// session MTU, see `IQueueConfig.Size`
+const QueueSlots = 4
+
+// Validate checks the queue size, policy and write timeout
+func (c IQueueConfig) Validate() error {
+	if c.Size < 1 || c.Size > 65536 {
+		return fmt.Errorf("queue size must be between 1 and 65536 packets: %d", c.Size)
+	}
+	if c.Bytes < 0 {
+		return fmt.Errorf("queue bytes must not be negative: %d", c.Bytes)
+	}
+	if c.Policy != QueuePolicyTail && c.Policy != QueuePolicyPriority {
+		return fmt.Errorf("unknown queue policy: %s", c.Policy)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout must not be negative: %d", c.WriteTimeout)
+	}
+	return nil
+}
+
+// IKeepaliveConfig controls pings to clients and the time after which silent
+// clients are disconnected
+type IKeepaliveConfig struct {
+	// Interval is the number of seconds between pings, 0 disables pings
+	Interval int `json:"interval"`
+	// Timeout is the number of seconds without a frame from the client
+	// after which it is disconnected, 0 means no timeout
+	Timeout int `json:"timeout"`
+}
+
+// Validate checks that clients have time to answer a ping before they time out
+func (c IKeepaliveConfig) Validate() error {
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("keepalive interval and timeout must not be negative: %d, %d", c.Interval, c.Timeout)
+	}
+	if c.Interval > 0 && c.Timeout > 0 && c.Timeout <= c.Interval {
+		return fmt.Errorf("keepalive timeout must exceed the interval: %d <= %d", c.Timeout, c.Interval)
+	}
+	return nil
+}
+
+// IResumeConfig controls resumption of sessions by clients which reconnect
+// after a transient disconnect
+type IResumeConfig struct {
+	// Grace is the number of seconds a session is kept for its client, 0
+	// disables resumption
+	Grace int `json:"grace"`
+}
+
+// Validate checks the grace period
+func (c IResumeConfig) Validate() error {
+	if c.Grace < 0 || c.Grace > 3600 {
+		return fmt.Errorf("resume grace period must be between 0 and 3600 seconds: %d", c.Grace)
+	}
+	return nil
+}
+
+// ILinksConfig controls clients which join several connections to one session
+type ILinksConfig struct {
+	// Max is the number of connections per session, 1 disables joining
+	Max int `json:"max"`
+}
+
+// Validate checks the number of connections per session
+func (c ILinksConfig) Validate() error {
+	if c.Max < 1 || c.Max > 16 {
+		return fmt.Errorf("connections per session must be between 1 and 16: %d", c.Max)
+	}
+	return nil
+}
+
+// IListenerConfig is a listener for tunnels of clients connecting without
+// WebSocket, e.g. where no HTTP proxy is in the way
+type IListenerConfig struct {
+	// Addr is the address to listen on, e.g. ":8443"
+	Addr string `json:"addr"`
+	// Transport is `TransportTCP` or `TransportTLS`
+	Transport string `json:"transport"`
+	// CertFile and KeyFile hold the PEM certificate and key of TLS listeners
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// Validate checks the transport and that TLS listeners have a certificate
+func (c IListenerConfig) Validate() error {
+	if c.Addr == "" {
+		return fmt.Errorf("listener address is empty")
+	}
+	switch c.Transport {
+	case TransportTCP:
+	case TransportTLS:
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("TLS listener %s needs a certificate and key file", c.Addr)
+		}
+	default:
+		return fmt.Errorf("unknown transport of listener %s: %s", c.Addr, c.Transport)
+	}
+	return nil
+}
+
+// ParseListener parses a listener given as transport://addr, e.g.
+// tls://:8443
+func ParseListener(s string) (IListenerConfig, error) {
+	transport, addr, ok := strings.Cut(s, "://")
+	if !ok {
+		return IListenerConfig{}, fmt.Errorf("listener must be given as transport://addr: %s", s)
+	}
+	return IListenerConfig{Addr: addr, Transport: transport}, nil
+}
+
+// IRateLimit limits the bandwidth of a device in bytes per second,
+// zero means unlimited
+type IRateLimit struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// IRateLimitConfig holds the default rate limit of devices which have no
+// override in their `DeviceRecord`
+type IRateLimitConfig struct {
+	IRateLimit
+	// MaxDelay is the number of milliseconds an uploaded packet may be held
+	// back to fit the rate before it is dropped. Downloaded packets are
+	// dropped right away.
+	MaxDelay int `json:"maxDelay"`
+}
+
+// IQuotaConfig limits the traffic of a device within a quota period
+type IQuotaConfig struct {
+	// Limit is the number of bytes, upload and download combined, a device
+	// may transfer per period, zero means unlimited. Devices may override it
+	// in their `DeviceRecord`.
+	Limit int64 `json:"limit"`
+	// Action is either `QuotaActionBlock` or `QuotaActionThrottle`
+	Action string `json:"action"`
+	// ThrottleRate is the rate limit of throttled devices in bytes per second
+	ThrottleRate int64 `json:"throttleRate"`
+	// ResetDay is the day of month, 1 to 28, on which a new period starts
+	ResetDay int `json:"resetDay"`
+}
+
+var DaemonConfig = IDaemonConfig{
+	Firewall: FirewallAuto,
+	Log: ILogConfig{
+		Level:      "info",
+		Format:     LogFormatText,
+		MaxSize:    10,
+		MaxBackups: 5,
+	},
+	RateLimit: IRateLimitConfig{
+		MaxDelay: 50,
+	},
+	Quota: IQuotaConfig{
+		Action:       QuotaActionBlock,
+		ThrottleRate: 128 * 1024,
+		ResetDay:     1,
+	},
+	ACL: IACLConfig{
+		Default: ACLAllow,
+	},
+	Peers: IPeerConfig{
+		Default: ACLAllow,
+	},
+	DNS: IDNSConfig{
+		Zone: "xtun",
+	},
+	LinkMTU: 1500,
+	Batch: IBatchConfig{
+		MaxSize: 16 * 1024,
+		Delay:   200,
+	},
+	Queue: IQueueConfig{
+		Size:         512,
+		Policy:       QueuePolicyTail,
+		WriteTimeout: 10000,
+	},
+	Keepalive: IKeepaliveConfig{
+		Interval: 15,
+		Timeout:  45,
+	},
+	Resume: IResumeConfig{
+		Grace: 30,
+	},
+	Links: ILinksConfig{
+		Max: 4,
+	},
+	TunQueues: 1,
+}
+
+// Validate checks that neither rate is negative
+func (r IRateLimit) Validate() error {
+	if r.Upload < 0 || r.Download < 0 {
+		return fmt.Errorf("rate limits must not be negative: upload %d, download %d", r.Upload, r.Download)
+	}
+	return nil
+}
+
+// Validate checks the rates and the maximum delay
+func (c IRateLimitConfig) Validate() error {
+	err := c.IRateLimit.Validate()
+	if err != nil {
+		return err
+	}
+	if c.MaxDelay < 0 || c.MaxDelay > 60000 {
+		return fmt.Errorf("rate limit delay must be between 0 and 60000 milliseconds: %d", c.MaxDelay)
+	}
+	return nil
+}
+
+// Validate checks the quota action and reset day
+func (c IQuotaConfig) Validate() error {
+	if c.Action != "" && c.Action != QuotaActionBlock && c.Action != QuotaActionThrottle {
+		return fmt.Errorf("unknown quota action: %s", c.Action)
+	}
+	if c.ResetDay < 1 || c.ResetDay > 28 {
+		return fmt.Errorf("quota reset day must be between 1 and 28: %d", c.ResetDay)
+	}
+	return nil
+}
+
+// PeriodStart returns the start of the quota period t belongs to
+func (c IQuotaConfig) PeriodStart(t time.Time) time.Time {
+	day := c.ResetDay
+	if day < 1 {
+		day = 1
+	}
+	y, m, d := t.Date()
+	if d < day {
+		m--
+	}
+	return time.Date(y, m, day, 0, 0, 0, 0, t.Location())
+}
+
+// NewAdminKey returns a random admin key
+func NewAdminKey() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidateAdminKey checks that the admin key differs from the client key
+func ValidateAdminKey(adminKey string, clientKey string) error {
+	if adminKey != "" && adminKey == clientKey {
+		return fmt.Errorf("admin key must differ from the client key")
+	}
+	return nil
+}
+
+// ValidateCodecs checks the names of compression codecs
+func ValidateCodecs(codecs []string) error {
+	for _, c := range codecs {
+		if c != CodecZstd && c != CodecLZ4 && c != CodecSnappy {
+			return fmt.Errorf("unknown compression codec: %s", c)
+		}
+	}
+	return nil
+}
+
+// ValidateListeners checks every listener and that addresses are unique
+func ValidateListeners(listeners []IListenerConfig) error {
+	seen := make(map[string]bool)
+	for _, l := range listeners {
+		err := l.Validate()
+		if err != nil {
+			return err
+		}
+		if seen[l.Addr] {
+			return fmt.Errorf("duplicate listener address: %s", l.Addr)
+		}
+		seen[l.Addr] = true
+	}
+	return nil
+}
+
+// MaxTunQueues is the number of queues Linux allows per TUN device
+const MaxTunQueues = 256
+
+// ValidateTunQueues checks the number of TUN queues
+func ValidateTunQueues(n int) error {
+	if n < 1 || n > MaxTunQueues {
+		return fmt.Errorf("TUN queues must be between 1 and %d: %d", MaxTunQueues, n)
+	}
+	return nil
+}
+
+// ResolveFirewall validates the firewall backend and replaces `auto` with
+// the backend detected on the host
+func ResolveFirewall(backend string) (string, error) {
+	switch backend {
+	case FirewallIptables, FirewallNftables:
+		return backend, nil
+	case FirewallAuto, "":
+		return DetectFirewall(), nil
+	default:
+		return "", fmt.Errorf("unknown firewall backend: %s", backend)
+	}
+}
+
+// DetectFirewall prefers nftables when the `nft` utility is available and
+// falls back to iptables otherwise
+func DetectFirewall() string {
+	if _, err := exec.LookPath("nft"); err == nil {
+		return FirewallNftables
+	}
+	return FirewallIptables
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	date := func(y int, m time.Month, d int, hour int) time.Time {
+		return time.Date(y, m, d, hour, 0, 0, 0, zone)
+	}
+	for _, c := range []struct {
+		resetDay int
+		t        time.Time
+		start    time.Time
+	}{
+		{1, date(2026, 3, 1, 0), date(2026, 3, 1, 0)},
+		{1, date(2026, 3, 31, 23), date(2026, 3, 1, 0)},
+		{15, date(2026, 3, 15, 0), date(2026, 3, 15, 0)},
+		{15, date(2026, 3, 14, 23), date(2026, 2, 15, 0)},
+		{15, date(2026, 3, 20, 12), date(2026, 3, 15, 0)},
+		// The period of early January starts in December
+		{28, date(2026, 1, 27, 12), date(2025, 12, 28, 0)},
+		{28, date(2026, 3, 1, 0), date(2026, 2, 28, 0)},
+		// Unset days reset on the first
+		{0, date(2026, 1, 1, 0), date(2026, 1, 1, 0)},
+	} {
+		start := IQuotaConfig{ResetDay: c.resetDay}.PeriodStart(c.t)
+		if !start.Equal(c.start) || start.Location() != zone {
+			t.Errorf("day %d, %v: period starts %v, expected %v", c.resetDay, c.t, start, c.start)
+		}
+	}
+}
+
+func TestAddDeviceUsage(t *testing.T) {
+	path := FilePath.AllocatorPath
+	t.Cleanup(func() { FilePath.AllocatorPath = path })
+	FilePath.AllocatorPath = filepath.Join(t.TempDir(), "allocdb")
+	a, err := CreateAllocator("10.0.10.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, _, err := a.RegisterDevice("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	quota := IQuotaConfig{ResetDay: 15}
+	march := quota.PeriodStart(time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC))
+	april := quota.PeriodStart(time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC))
+	a.AddDeviceUsage("laptop", march, 100, 200)
+	record, err := a.AddDeviceUsage("laptop", march, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := record.UsageIn(march); u.Upload != 101 || u.Download != 202 {
+		t.Fatalf("usage %+v", u)
+	}
+	if u := record.UsageIn(april); u.Total() != 0 || !u.Period.Equal(april) {
+		t.Fatalf("usage %+v of the next period", u)
+	}
+	// Usage of the last period is discarded on rollover
+	record, err = a.AddDeviceUsage("laptop", april, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Usage.Period.Equal(april) || record.Usage.Total() != 5 {
+		t.Fatalf("usage %+v after rollover", record.Usage)
+	}
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	deviceBucket = "devices"
+)
+
+// DeviceRecord holds per-device settings, it is stored in the allocator
+// database next to the device address
+type DeviceRecord struct {
+	// RateLimit overrides `IDaemonConfig.RateLimit` if set
+	RateLimit *IRateLimit `json:"rateLimit,omitempty"`
+	// Quota overrides `IDaemonConfig.Quota.Limit` if set
+	Quota *int64 `json:"quota,omitempty"`
+	// Usage is the traffic of the device in the last recorded quota period
+	Usage DeviceUsage `json:"usage"`
+}
+
+// DeviceUsage is the number of bytes transferred by a device since the
+// start of the period
+type DeviceUsage struct {
+	Period   time.Time `json:"period"`
+	Upload   uint64    `json:"upload"`
+	Download uint64    `json:"download"`
+}
+
+// Total returns upload and download combined
+func (u DeviceUsage) Total() uint64 {
+	return u.Upload + u.Download
+}
+
+// UsageIn returns the usage of the device in the period starting at period,
+// which is empty if nothing was recorded since
+func (r DeviceRecord) UsageIn(period time.Time) DeviceUsage {
+	if !r.Usage.Period.Equal(period) {
+		return DeviceUsage{Period: period}
+	}
+	return r.Usage
+}
+
+// QuotaLimit returns the quota of the device in bytes, zero means unlimited
+func (r DeviceRecord) QuotaLimit(defaultLimit int64) int64 {
+	if r.Quota != nil {
+		return *r.Quota
+	}
+	return defaultLimit
+}
+
+// GetDevice returns the record of a registered device. Devices without
+// any settings have an empty record.
+func (a *Allocator) GetDevice(id string) (DeviceRecord, error) {
+	var record DeviceRecord
+	err := a.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(dbBucket)).Get([]byte(id)) == nil {
+			return fmt.Errorf("device %s is not registered", id)
+		}
+		b := tx.Bucket([]byte(deviceBucket)).Get([]byte(id))
+		if b == nil {
+			return nil
+		}
+		return json.Unmarshal(b, &record)
+	})
+	return record, err
+}
+
+// UpdateDevice changes the record of a registered device in a single
+// transaction and returns the updated record
+func (a *Allocator) UpdateDevice(id string, fn func(record *DeviceRecord)) (DeviceRecord, error) {
+	var record DeviceRecord
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(dbBucket)).Get([]byte(id)) == nil {
+			return fmt.Errorf("device %s is not registered", id)
+		}
+		bucket := tx.Bucket([]byte(deviceBucket))
+		if b := bucket.Get([]byte(id)); b != nil {
+			err := json.Unmarshal(b, &record)
+			if err != nil {
+				return err
+			}
+		}
+		fn(&record)
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), b)
+	})
+	return record, err
+}
+
+// AddDeviceUsage adds transferred bytes to the usage of a device, usage of
+// an earlier period is discarded first
+func (a *Allocator) AddDeviceUsage(id string, period time.Time, upload uint64, download uint64) (DeviceRecord, error) {
+	return a.UpdateDevice(id, func(record *DeviceRecord) {
+		record.Usage = record.UsageIn(period)
+		record.Usage.Upload += upload
+		record.Usage.Download += download
+	})
+}
+
+// DeviceAddress returns the address of a device, the ID is compared
+// case-insensitively as DNS names are
+func (a *Allocator) DeviceAddress(id string) (net.IP, bool) {
+	var ip net.IP
+	a.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dbBucket))
+		if v := bucket.Get([]byte(id)); len(v) == net.IPv4len {
+			ip = bytesToIP(v)
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if len(v) == net.IPv4len && strings.EqualFold(string(k), id) {
+				ip = bytesToIP(v)
+				return errFound
+			}
+			return nil
+		})
+	})
+	return ip, ip != nil
+}
+
+// ListDevices returns the records of all registered devices by device ID
+func (a *Allocator) ListDevices() (map[string]DeviceRecord, error) {
+	records := make(map[string]DeviceRecord)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		devices := tx.Bucket([]byte(deviceBucket))
+		// The allocator bucket also marks allocated addresses, only device
+		// IDs map to an address
+		return tx.Bucket([]byte(dbBucket)).ForEach(func(k, v []byte) error {
+			if len(v) != net.IPv4len {
+				return nil
+			}
+			var record DeviceRecord
+			if b := devices.Get(k); b != nil {
+				err := json.Unmarshal(b, &record)
+				if err != nil {
+					return err
+				}
+			}
+			records[string(k)] = record
+			return nil
+		})
+	})
+	return records, err
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// resolvConf is read for upstream servers when none are configured
+const resolvConf = "/etc/resolv.conf"
+
+// IDNSConfig holds the DNS settings pushed to clients and the built-in
+// forwarder on the tunnel IP
+type IDNSConfig struct {
+	// Servers are pushed to clients, the tunnel IP is pushed first when the
+	// forwarder is enabled
+	Servers []string `json:"servers,omitempty"`
+	// Search domains are pushed to clients, the zone is added when the
+	// forwarder is enabled
+	Search []string `json:"search,omitempty"`
+	// Forwarder enables the DNS server on the tunnel IP, it resolves
+	// `<device>.<zone>` and forwards everything else upstream
+	Forwarder bool `json:"forwarder"`
+	// Zone is the domain registered devices are resolvable in
+	Zone string `json:"zone"`
+	// Upstream are "address" or "address:port" of the servers queries are
+	// forwarded to, the servers of /etc/resolv.conf if empty
+	Upstream []string `json:"upstream,omitempty"`
+}
+
+// Validate checks addresses and the zone
+func (c IDNSConfig) Validate() error {
+	for _, s := range c.Servers {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("invalid DNS server: %s", s)
+		}
+	}
+	for _, s := range c.Upstream {
+		if _, err := UpstreamAddr(s); err != nil {
+			return err
+		}
+	}
+	if c.Forwarder && strings.Trim(c.Zone, ".") == "" {
+		return fmt.Errorf("DNS forwarder requires a zone")
+	}
+	return nil
+}
+
+// UpstreamAddr adds the default port to an upstream server address
+func UpstreamAddr(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(s, "53"), nil
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid upstream DNS server: %s", s)
+	}
+	return s, nil
+}
+
+// UpstreamServers returns the configured upstream servers or those of the host
+func (c IDNSConfig) UpstreamServers() []string {
+	list := c.Upstream
+	if len(list) == 0 {
+		list = systemNameservers()
+	}
+	servers := make([]string, 0, len(list))
+	for _, s := range list {
+		if addr, err := UpstreamAddr(s); err == nil {
+			servers = append(servers, addr)
+		}
+	}
+	return servers
+}
+
+func systemNameservers() []string {
+	file, err := os.Open(resolvConf)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
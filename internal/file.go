@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 
 	"github.com/xorgal/xtun-core/pkg/config"
 )
@@ -28,11 +31,17 @@ type IFilePath struct {
 	BinaryPath    string
 	ConfigPath    string
 	AllocatorPath string
+	NftablesPath  string
+	LogPath       string
+	AuditPath     string
 }
 
 var WorkDirCommonName = "xtun"
 var ConfigFile = "config.json"
 var AllocatorDBFile = "allocdb"
+var NftablesFile = "nftables.conf"
+var LogFile = "xtund.log"
+var AuditFile = "audit.log"
 
 var BinaryMetadata = IBinaryMetadata{
 	BinaryFile:  "xtund",
@@ -40,17 +49,124 @@ var BinaryMetadata = IBinaryMetadata{
 	Version:     AppVersion,
 }
 
-var DirPath = IDirPath{
+// Environment variables overriding the default paths. Command line flags
+// take precedence over them.
+const (
+	EnvInstance  = "XTUN_INSTANCE"
+	EnvConfig    = "XTUN_CONFIG"
+	EnvBinaryDir = "XTUN_BINARY_DIR"
+	EnvConfigDir = "XTUN_CONFIG_DIR"
+	EnvDataDir   = "XTUN_DATA_DIR"
+	EnvLogDir    = "XTUN_LOG_DIR"
+)
+
+// Instance is the name of the running xtund instance, empty for the default one.
+// Each named instance has its own config, data and log directories, systemd
+// units and firewall rules, see `SetupPaths`.
+var Instance = ""
+
+var instanceNameRe = regexp.MustCompile(`^[a-z0-9_]{1,10}$`)
+
+var defaultDirPath = IDirPath{
 	BinaryDir: "/usr/local/sbin",
 	ConfigDir: fmt.Sprintf("/etc/%s", WorkDirCommonName),
 	Data:      fmt.Sprintf("/var/lib/%s", WorkDirCommonName),
 	Log:       fmt.Sprintf("/var/log/%s", WorkDirCommonName),
 }
 
-var FilePath = IFilePath{
-	BinaryPath:    fmt.Sprintf("%s/%s", DirPath.BinaryDir, BinaryMetadata.BinaryFile),
-	ConfigPath:    fmt.Sprintf("%s/%s", DirPath.ConfigDir, ConfigFile),
-	AllocatorPath: fmt.Sprintf("%s/%s", DirPath.Data, AllocatorDBFile),
+var DirPath = defaultDirPath
+
+var FilePath = filePaths(DirPath)
+
+// SetupPaths resolves `DirPath`, `FilePath` and `Service` for the given instance.
+// Empty arguments fall back to `EnvInstance` and `EnvConfig`, every directory may
+// be overridden through its environment variable. Named instances live in a
+// subdirectory of each directory except `DirPath.BinaryDir`.
+func SetupPaths(instance string, configPath string) error {
+	if instance == "" {
+		instance = os.Getenv(EnvInstance)
+	}
+	if instance != "" && !instanceNameRe.MatchString(instance) {
+		return fmt.Errorf("invalid instance name %q: up to 10 lowercase letters, digits or underscores expected", instance)
+	}
+	Instance = instance
+
+	dirs := IDirPath{
+		BinaryDir: envOr(EnvBinaryDir, defaultDirPath.BinaryDir),
+		ConfigDir: envOr(EnvConfigDir, defaultDirPath.ConfigDir),
+		Data:      envOr(EnvDataDir, defaultDirPath.Data),
+		Log:       envOr(EnvLogDir, defaultDirPath.Log),
+	}
+	if instance != "" {
+		dirs.ConfigDir = filepath.Join(dirs.ConfigDir, instance)
+		dirs.Data = filepath.Join(dirs.Data, instance)
+		dirs.Log = filepath.Join(dirs.Log, instance)
+	}
+	DirPath = dirs
+	FilePath = filePaths(dirs)
+
+	if configPath == "" {
+		configPath = os.Getenv(EnvConfig)
+	}
+	if configPath != "" {
+		path, err := filepath.Abs(configPath)
+		if err != nil {
+			return err
+		}
+		FilePath.ConfigPath = path
+	}
+
+	Service = instanceServices(instance)
+	return nil
+}
+
+// PathEnvironment returns the path overrides set in the environment in
+// "KEY=value" form, so they can be handed over to systemd units
+func PathEnvironment() []string {
+	var env []string
+	for _, key := range []string{EnvBinaryDir, EnvConfigDir, EnvDataDir, EnvLogDir} {
+		if value, ok := os.LookupEnv(key); ok && value != "" {
+			env = append(env, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	return env
+}
+
+// DaemonArgs returns the command line arguments which make the daemon
+// started by systemd pick up the same instance and config file
+func DaemonArgs() []string {
+	var args []string
+	if Instance != "" {
+		args = append(args, "--instance", Instance)
+	}
+	if FilePath.ConfigPath != filePaths(DirPath).ConfigPath {
+		args = append(args, "--config", FilePath.ConfigPath)
+	}
+	return args
+}
+
+func filePaths(dirs IDirPath) IFilePath {
+	return IFilePath{
+		BinaryPath:    fmt.Sprintf("%s/%s", dirs.BinaryDir, BinaryMetadata.BinaryFile),
+		ConfigPath:    fmt.Sprintf("%s/%s", dirs.ConfigDir, ConfigFile),
+		AllocatorPath: fmt.Sprintf("%s/%s", dirs.Data, AllocatorDBFile),
+		NftablesPath:  fmt.Sprintf("%s/%s", dirs.ConfigDir, NftablesFile),
+		LogPath:       fmt.Sprintf("%s/%s", dirs.Log, LogFile),
+		AuditPath:     fmt.Sprintf("%s/%s", dirs.Log, AuditFile),
+	}
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// configFile is the on-disk layout of `FilePath.ConfigPath`
+type configFile struct {
+	config.Config
+	Daemon IDaemonConfig `json:"daemon"`
 }
 
 // MakeAppDirs loops through the `DirPath` struct and makes directories
@@ -65,21 +181,44 @@ func MakeAllDirs() []error {
 			errs = append(errs, err)
 		}
 	}
+	// The config file may be placed outside of `DirPath.ConfigDir`
+	_, err := mkdir(filepath.Dir(FilePath.ConfigPath), 0755)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// RemoveDataDirs removes the config file, `DirPath.ConfigDir` and `DirPath.Data`
+// along with their contents. Binaries and logs are left in place.
+func RemoveDataDirs() []error {
+	var errs []error
+	err := os.Remove(FilePath.ConfigPath)
+	if err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	for _, path := range []string{DirPath.ConfigDir, DirPath.Data} {
+		err := os.RemoveAll(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
 	return errs
 }
 
-// SaveConfigFile parses `config.Config` and attempts to write data
-// to `FilePath.ConfigPath` at `DirPath.ConfigDir`
+// SaveConfigFile parses `config.Config` along with `DaemonConfig` and attempts
+// to write data to `FilePath.ConfigPath` at `DirPath.ConfigDir`
 func SaveConfigFile(config config.Config) error {
-	file, err := json.MarshalIndent(config, "", " ")
+	file, err := json.MarshalIndent(configFile{Config: config, Daemon: DaemonConfig}, "", " ")
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(FilePath.ConfigPath, file, 0644)
+	// The file holds the client and admin keys
+	err = os.WriteFile(FilePath.ConfigPath, file, 0600)
 	if err != nil {
 		return err
 	}
-	return nil
+	return os.Chmod(FilePath.ConfigPath, 0600)
 }
 
 func LoadConfigFile() error {
@@ -87,13 +226,113 @@ func LoadConfigFile() error {
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(file, &config.AppConfig)
+	c := configFile{Config: config.AppConfig, Daemon: DaemonConfig}
+	err = json.Unmarshal(file, &c)
 	if err != nil {
 		return err
 	}
+	config.AppConfig = c.Config
+	DaemonConfig = c.Daemon
 	return nil
 }
 
+// InstanceNetwork holds the addresses an instance listens on and the
+// network of its tunnel
+type InstanceNetwork struct {
+	Addrs []string
+	CIDR  string
+}
+
+// InstanceNetworks returns the server and listener addresses and the tunnel
+// network of every other instance, keyed by instance name. The default
+// instance is named "default". Instances are found in the default location
+// and through their xtund units, which include the config and path
+// overrides of instances set up with them.
+func InstanceNetworks() (map[string]InstanceNetwork, error) {
+	base := envOr(EnvConfigDir, defaultDirPath.ConfigDir)
+	paths := map[string]string{"default": filepath.Join(base, ConfigFile)}
+	entries, err := os.ReadDir(base)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && instanceNameRe.MatchString(e.Name()) {
+			paths[e.Name()] = filepath.Join(base, e.Name(), ConfigFile)
+		}
+	}
+	units, err := unitConfigPaths()
+	if err != nil {
+		return nil, err
+	}
+	for name, path := range units {
+		paths[name] = path
+	}
+	current := Instance
+	if current == "" {
+		current = "default"
+	}
+	networks := make(map[string]InstanceNetwork)
+	for name, path := range paths {
+		if name == current || path == FilePath.ConfigPath {
+			continue
+		}
+		file, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var c configFile
+		err = json.Unmarshal(file, &c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		n := InstanceNetwork{Addrs: []string{c.ServerAddr}, CIDR: c.CIDR}
+		for _, l := range c.Daemon.Listeners {
+			n.Addrs = append(n.Addrs, l.Addr)
+		}
+		networks[name] = n
+	}
+	return networks, nil
+}
+
+// AddrsConflict reports whether two listen addresses use the same port on
+// the same or an unspecified host
+func AddrsConflict(a string, b string) bool {
+	hostA, portA, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hostB, portB, err := net.SplitHostPort(b)
+	if err != nil || portA != portB || portA == "0" {
+		return false
+	}
+	return hostA == hostB || isUnspecifiedHost(hostA) || isUnspecifiedHost(hostB)
+}
+
+// CIDRsOverlap reports whether two networks in CIDR notation share any
+// address
+func CIDRsOverlap(a string, b string) bool {
+	_, netA, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+	_, netB, err := net.ParseCIDR(b)
+	if err != nil {
+		return false
+	}
+	return netA.Contains(netB.IP) || netB.Contains(netA.IP)
+}
+
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
 func IsConfigFileExists() bool {
 	if _, err := os.Stat(FilePath.ConfigPath); err != nil {
 		if os.IsNotExist(err) {
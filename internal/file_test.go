@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+func writeInstanceConfig(t *testing.T, dir string, serverAddr string, cidr string, listeners ...string) {
+	writeConfigAt(t, filepath.Join(dir, ConfigFile), serverAddr, cidr, listeners...)
+}
+
+func writeConfigAt(t *testing.T, path string, serverAddr string, cidr string, listeners ...string) {
+	c := configFile{Config: config.Config{ServerAddr: serverAddr, CIDR: cidr}}
+	for _, addr := range listeners {
+		c.Daemon.Listeners = append(c.Daemon.Listeners, IListenerConfig{Addr: addr, Transport: TransportTCP})
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeUnit writes an xtund unit of the lines to the unit directory
+func writeUnit(t *testing.T, name string, lines ...string) {
+	unit := "[Service]\n"
+	for _, line := range lines {
+		unit += "    " + line + "\n"
+	}
+	err := os.WriteFile(filepath.Join(systemdUnitDir, name), []byte(unit), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstanceNetworks(t *testing.T) {
+	base := t.TempDir()
+	elsewhere := t.TempDir()
+	unitDir := systemdUnitDir
+	t.Cleanup(func() {
+		SetupPaths("", "")
+		systemdUnitDir = unitDir
+	})
+	systemdUnitDir = t.TempDir()
+	t.Setenv(EnvInstance, "")
+	t.Setenv(EnvConfig, "")
+	t.Setenv(EnvConfigDir, base)
+	writeInstanceConfig(t, base, "0.0.0.0:3001", "10.0.1.1/24")
+	writeInstanceConfig(t, filepath.Join(base, "office"), "0.0.0.0:3002", "10.0.2.1/24", ":8443")
+	writeInstanceConfig(t, filepath.Join(base, "lab"), "0.0.0.0:3003", "10.0.3.1/24")
+	// Instances set up with path overrides are found through their units
+	writeInstanceConfig(t, filepath.Join(elsewhere, "vpn"), "0.0.0.0:3004", "10.0.4.1/24")
+	writeUnit(t, "xtund@vpn.service", "Environment=XTUN_CONFIG_DIR="+elsewhere, "ExecStart=/usr/local/sbin/xtund --instance vpn")
+	writeConfigAt(t, filepath.Join(elsewhere, "edge.json"), "0.0.0.0:3005", "10.0.5.1/24")
+	writeUnit(t, "xtund@edge.service", "ExecStart=/usr/local/sbin/xtund --instance edge --config "+filepath.Join(elsewhere, "edge.json"))
+	writeUnit(t, "xtund@lab.service", "ExecStart=/usr/local/sbin/xtund --instance lab --config "+filepath.Join(base, "lab", ConfigFile))
+	writeUnit(t, "xtun-iptables@vpn.service", "ExecStart=/sbin/iptables --config /nonexistent")
+	err := SetupPaths("lab", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks, err := InstanceNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]InstanceNetwork{
+		"default": {Addrs: []string{"0.0.0.0:3001"}, CIDR: "10.0.1.1/24"},
+		"office":  {Addrs: []string{"0.0.0.0:3002", ":8443"}, CIDR: "10.0.2.1/24"},
+		"vpn":     {Addrs: []string{"0.0.0.0:3004"}, CIDR: "10.0.4.1/24"},
+		"edge":    {Addrs: []string{"0.0.0.0:3005"}, CIDR: "10.0.5.1/24"},
+	}
+	if !reflect.DeepEqual(networks, expect) {
+		t.Fatalf("networks %v", networks)
+	}
+}
+
+func TestUnitConfigPath(t *testing.T) {
+	for _, c := range []struct {
+		unit, instance string
+		name, path     string
+	}{
+		{"ExecStart=/usr/local/sbin/xtund\n", "", "default", "/etc/xtun/config.json"},
+		{"ExecStart=/usr/local/sbin/xtund --instance office\n", "office", "office", "/etc/xtun/office/config.json"},
+		{"Environment=XTUN_CONFIG_DIR=/opt/etc\nExecStart=/usr/local/sbin/xtund --instance=office\n", "", "office", "/opt/etc/office/config.json"},
+		{"Environment=XTUN_CONFIG=/opt/lab.json\nExecStart=/usr/local/sbin/xtund\n", "lab", "lab", "/opt/lab.json"},
+		{"ExecStart=/usr/local/sbin/xtund --config /opt/x.json --instance lab\n", "", "lab", "/opt/x.json"},
+	} {
+		name, path := unitConfigPath(c.unit, c.instance)
+		if name != c.name || path != c.path {
+			t.Errorf("%q: %s at %s", c.unit, name, path)
+		}
+	}
+}
+
+func TestCIDRsOverlap(t *testing.T) {
+	for _, c := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"10.0.10.1/24", "10.0.10.5/24", true},
+		{"10.0.0.1/16", "10.0.10.1/24", true},
+		{"10.0.10.1/24", "10.0.0.1/16", true},
+		{"10.0.10.1/24", "10.0.11.1/24", false},
+		{"10.0.10.1/24", "", false},
+		{"invalid", "10.0.10.1/24", false},
+	} {
+		if CIDRsOverlap(c.a, c.b) != c.overlap {
+			t.Errorf("%s and %s: overlap expected %v", c.a, c.b, c.overlap)
+		}
+	}
+}
+
+func TestAddrsConflict(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		conflict bool
+	}{
+		{"0.0.0.0:3001", "0.0.0.0:3001", true},
+		{"192.0.2.1:3001", ":3001", true},
+		{"[::]:3001", "192.0.2.1:3001", true},
+		{"192.0.2.1:3001", "192.0.2.2:3001", false},
+		{"0.0.0.0:3001", "0.0.0.0:3002", false},
+		{":0", ":0", false},
+		{"invalid", ":3001", false},
+	} {
+		if AddrsConflict(c.a, c.b) != c.conflict {
+			t.Errorf("%s and %s: conflict expected %v", c.a, c.b, c.conflict)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+//go:embed template/firewall.tmpl
+var firewallT string
+
+//go:embed template/xtun.nft.tmpl
+var nftRulesT string
+
+// firewallCommand is a single command installing or removing firewall rules.
+// Optional commands are allowed to fail, e.g. when removing a rule which
+// is not installed.
+type firewallCommand struct {
+	Args     []string
+	Optional bool
+}
+
+// String formats the command as an Exec line of a systemd unit
+func (c firewallCommand) String() string {
+	line := strings.Join(c.Args, " ")
+	if c.Optional {
+		return "-" + line
+	}
+	return line
+}
+
+func (c firewallCommand) run() error {
+	out, err := exec.Command(c.Args[0], c.Args[1:]...).CombinedOutput()
+	if err != nil && !c.Optional {
+		return fmt.Errorf("%s: %v: %s", strings.Join(c.Args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// CreateFirewallService initializes the routing service of the configured
+// firewall backend, see `FirewallService`, by creating and configuring its
+// systemd service file. Rules are kept in a dedicated iptables chain or nftables
+// table which is replaced on start and removed on stop, so restarting the service
+// never stacks duplicate rules. It then enables the service to run at startup.
+func CreateFirewallService(cfg config.Config) {
+	sc, err := firewallConfig(cfg)
+	if err != nil {
+		log.Fatalf("Cannot configure firewall: %v", err)
+	}
+	if DaemonConfig.Firewall == FirewallNftables {
+		err = writeNftablesRuleset(sc)
+		if err != nil {
+			log.Fatalf("Cannot write %s file: %v", FilePath.NftablesPath, err)
+		}
+	}
+
+	service := FirewallService()
+	file, err := os.Create(servicePath(service))
+	if err != nil {
+		log.Fatalf("Cannot create %s file: %v", service, err)
+	}
+	defer file.Close()
+	err = renderService(file, firewallT, sc)
+	if err != nil {
+		log.Fatalf("Cannot write %s file: %v", service, err)
+	}
+	cmd := exec.Command("systemctl", "enable", service)
+	err = cmd.Run()
+	if err != nil {
+		log.Fatalf("Cannot enable %s: %v", service, err)
+	}
+}
+
+// SetupFirewall enables IPv4 forwarding and installs the same NAT and forwarding
+// rules as the routing service does, but directly. It is meant for hosts where
+// xtund runs without systemd.
+func SetupFirewall(cfg config.Config) error {
+	sc, err := firewallConfig(cfg)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to enable ip forwarding: %v", err)
+	}
+	if DaemonConfig.Firewall == FirewallNftables {
+		err = writeNftablesRuleset(sc)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range sc.ExecStart {
+		err = c.run()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TeardownFirewall removes rules installed by `SetupFirewall`
+func TeardownFirewall(cfg config.Config) error {
+	sc, err := firewallConfig(cfg)
+	if err != nil {
+		return err
+	}
+	for _, c := range sc.ExecStop {
+		err = c.run()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firewallConfig returns commands installing and removing the rules of the
+// configured firewall backend
+func firewallConfig(cfg config.Config) (ServiceConfig, error) {
+	_, network, err := net.ParseCIDR(cfg.CIDR)
+	if err != nil {
+		return ServiceConfig{}, err
+	}
+	sc := ServiceConfig{
+		DeviceName: cfg.DeviceName,
+		Network:    network.String(),
+		Table:      nftablesTable(),
+	}
+	if DaemonConfig.Firewall == FirewallNftables {
+		nft := lookPath("nft", "/usr/sbin/nft")
+		sc.ExecStart = []firewallCommand{
+			{Args: []string{nft, "-f", FilePath.NftablesPath}},
+		}
+		sc.ExecStop = []firewallCommand{
+			{Args: []string{nft, "delete", "table", "ip", sc.Table}, Optional: true},
+		}
+		return sc, nil
+	}
+
+	ipt := lookPath("iptables", "/sbin/iptables")
+	chain := iptablesChain()
+	cmd := func(optional bool, args ...string) firewallCommand {
+		return firewallCommand{Args: append([]string{ipt}, args...), Optional: optional}
+	}
+	// The jump into the dedicated chain is deleted before being appended,
+	// so there is never more than one
+	sc.ExecStart = []firewallCommand{
+		cmd(true, "-t", "nat", "-N", chain),
+		cmd(false, "-t", "nat", "-F", chain),
+		cmd(false, "-t", "nat", "-A", chain, "-s", sc.Network, "!", "-o", sc.DeviceName, "-j", "MASQUERADE"),
+		cmd(true, "-t", "nat", "-D", "POSTROUTING", "-j", chain),
+		cmd(false, "-t", "nat", "-A", "POSTROUTING", "-j", chain),
+		cmd(true, "-N", chain),
+		cmd(false, "-F", chain),
+		cmd(false, "-A", chain, "-i", sc.DeviceName, "-j", "ACCEPT"),
+		cmd(false, "-A", chain, "-o", sc.DeviceName, "-j", "ACCEPT"),
+		cmd(true, "-D", "FORWARD", "-j", chain),
+		cmd(false, "-A", "FORWARD", "-j", chain),
+	}
+	sc.ExecStop = []firewallCommand{
+		cmd(true, "-t", "nat", "-D", "POSTROUTING", "-j", chain),
+		cmd(true, "-t", "nat", "-F", chain),
+		cmd(true, "-t", "nat", "-X", chain),
+		cmd(true, "-D", "FORWARD", "-j", chain),
+		cmd(true, "-F", chain),
+		cmd(true, "-X", chain),
+	}
+	return sc, nil
+}
+
+// writeNftablesRuleset renders the xtun nftables ruleset to `FilePath.NftablesPath`.
+// The ruleset lives in a dedicated table, so it does not collide with other
+// firewall users and is removed by a single command.
+func writeNftablesRuleset(sc ServiceConfig) error {
+	t, err := template.New("nftables").Parse(nftRulesT)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(FilePath.NftablesPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return t.Execute(file, sc)
+}
+
+// nftablesTable returns the name of the dedicated nftables table holding
+// xtun rules of the current instance
+func nftablesTable() string {
+	if Instance == "" {
+		return "xtun"
+	}
+	return fmt.Sprintf("xtun_%s", Instance)
+}
+
+// iptablesChain returns the name of the dedicated chain holding xtun rules
+// of the current instance in both the nat and filter tables
+func iptablesChain() string {
+	if Instance == "" {
+		return "XTUN"
+	}
+	return fmt.Sprintf("XTUN-%s", strings.ToUpper(Instance))
+}
+
+// lookPath resolves the absolute path of a utility, falling back to its
+// usual location if it is not found in PATH
+func lookPath(file string, fallback string) string {
+	path, err := exec.LookPath(file)
+	if err != nil {
+		return fallback
+	}
+	return path
+}
@@ -1,22 +1,106 @@
 package internal
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"runtime"
 	"strings"
 )
 
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// ILogConfig configures the daemon logger, see `ConfigureLogger`
+type ILogConfig struct {
+	// Level is one of "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+	// Format is either `LogFormatText` or `LogFormatJSON`
+	Format string `json:"format"`
+	// File enables writing to `FilePath.LogPath` in addition to the console
+	File bool `json:"file"`
+	// MaxSize is the size of the log file in megabytes which triggers rotation
+	MaxSize int `json:"maxSize"`
+	// MaxBackups is the number of rotated log files to keep
+	MaxBackups int `json:"maxBackups"`
+}
+
+var logLevel = new(slog.LevelVar)
+
+// Validate checks the log level and format
+func (c ILogConfig) Validate() error {
+	var l slog.Level
+	if c.Level != "" && l.UnmarshalText([]byte(c.Level)) != nil {
+		return fmt.Errorf("unknown log level: %s", c.Level)
+	}
+	if c.Format != "" && c.Format != LogFormatText && c.Format != LogFormatJSON {
+		return fmt.Errorf("unknown log format: %s", c.Format)
+	}
+	return nil
+}
+
+// SetupLogger configures the `log` package for command line output
 func SetupLogger() {
 	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
 }
 
+// ConfigureLogger replaces the default logger of the daemon with a leveled
+// structured one writing to w and, if enabled, to a rotating log file.
+// Output of the `log` package is redirected to it as well.
+func ConfigureLogger(cfg ILogConfig, w io.Writer) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	SetLogLevel(cfg.Level)
+	if cfg.File {
+		file, err := newRotatingFile(FilePath.LogPath, int64(cfg.MaxSize)*1024*1024, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w = io.MultiWriter(w, file)
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if cfg.Format == LogFormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLogLevel changes the level of the daemon logger, it is safe to call
+// while the daemon is running
+func SetLogLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// PrintErr logs err at error level along with the calling function and
+// the operation which failed
 func PrintErr(id string, err error) {
-	log.Println(getFuncName(2), id, err)
+	slog.Error(strings.TrimSuffix(id, ":"), "func", getFuncName(2), "err", err)
 }
 
 func getFuncName(depth int) string {
-	pc, _, _, _ := runtime.Caller(depth)
+	pc, _, _, ok := runtime.Caller(depth)
+	if !ok {
+		return "unknown"
+	}
 	funcPath := runtime.FuncForPC(pc).Name()
-	funcName := strings.Split(funcPath, "/")[3]
-	return funcName
+	return funcPath[strings.LastIndex(funcPath, "/")+1:]
 }
@@ -0,0 +1,40 @@
+package internal
+
+import "github.com/xorgal/xtun-core/pkg/config"
+
+// Overhead of the transport in bytes, the worst case of each layer is used
+// as it is not known which path a client connection takes
+const (
+	// IPv6 header, IPv4 needs 20 bytes less
+	ipOverhead = 40
+	// TCP header with the timestamp option
+	tcpOverhead = 32
+	// TLS 1.2 record with an AES-GCM nonce and tag, TLS 1.3 needs less
+	tlsOverhead = 29
+	// WebSocket frame of a client with a 16 bit length and a masking key
+	wsOverhead = 8
+	// MinMTU is the smallest MTU a tunnel may use, it is required by IPv4
+	MinMTU = 576
+)
+
+// TunnelMTU returns the largest MTU of the TUN device which does not
+// fragment tunnel traffic on a link with the given MTU
+func TunnelMTU(linkMTU int, protocol string) int {
+	mtu := linkMTU - ipOverhead - tcpOverhead - wsOverhead
+	if protocol == "wss" {
+		mtu -= tlsOverhead
+	}
+	if mtu < MinMTU {
+		return MinMTU
+	}
+	return mtu
+}
+
+// EffectiveMTU returns the configured MTU, or the one computed from the
+// link MTU if it is not set
+func EffectiveMTU(cfg config.Config) int {
+	if cfg.MTU > 0 {
+		return cfg.MTU
+	}
+	return TunnelMTU(DaemonConfig.LinkMTU, cfg.Protocol)
+}
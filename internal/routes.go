@@ -0,0 +1,68 @@
+package internal
+
+import "fmt"
+
+// IRouteSet tells clients which networks to send through the tunnel
+type IRouteSet struct {
+	// Routes are networks routed through the tunnel
+	Routes []string `json:"routes,omitempty"`
+	// Exclude are networks which bypass the tunnel, also in full tunnel mode
+	Exclude []string `json:"exclude,omitempty"`
+	// FullTunnel routes all traffic through the tunnel
+	FullTunnel bool `json:"fullTunnel"`
+}
+
+// IRoutesConfig holds the routes pushed to every client of the pool and
+// overrides for single devices
+type IRoutesConfig struct {
+	IRouteSet
+	Devices map[string]IRouteSet `json:"devices,omitempty"`
+}
+
+// Validate checks that every route is a network or an address
+func (c IRoutesConfig) Validate() error {
+	err := c.IRouteSet.validate()
+	if err != nil {
+		return err
+	}
+	for id, set := range c.Devices {
+		err := set.validate()
+		if err != nil {
+			return fmt.Errorf("device %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (s IRouteSet) validate() error {
+	for _, r := range append(append([]string(nil), s.Routes...), s.Exclude...) {
+		if _, err := ParseNetwork(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RoutesFor returns the routes of a device in CIDR notation. A device
+// override replaces the routes of the pool entirely.
+func (c IRoutesConfig) RoutesFor(id string) IRouteSet {
+	set, ok := c.Devices[id]
+	if !ok || id == "" {
+		set = c.IRouteSet
+	}
+	return IRouteSet{
+		Routes:     normalizeNetworks(set.Routes),
+		Exclude:    normalizeNetworks(set.Exclude),
+		FullTunnel: set.FullTunnel,
+	}
+}
+
+func normalizeNetworks(list []string) []string {
+	networks := make([]string, 0, len(list))
+	for _, s := range list {
+		if n, err := ParseNetwork(s); err == nil {
+			networks = append(networks, n.String())
+		}
+	}
+	return networks
+}
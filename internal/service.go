@@ -1,11 +1,122 @@
 package internal
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
 type IService struct {
 	XTUND    string
 	IPTABLES string
+	NFTABLES string
+}
+
+var Service = instanceServices("")
+
+// FirewallService returns the name of the systemd service which sets up
+// routing for the configured firewall backend
+func FirewallService() string {
+	if DaemonConfig.Firewall == FirewallNftables {
+		return Service.NFTABLES
+	}
+	return Service.IPTABLES
+}
+
+// instanceServices returns systemd unit names for the instance, e.g.
+// "xtund.service" for the default instance and "xtund@office.service"
+// for the instance named "office"
+func instanceServices(instance string) IService {
+	name := func(unit string) string {
+		if instance == "" {
+			return fmt.Sprintf("%s.service", unit)
+		}
+		return fmt.Sprintf("%s@%s.service", unit, instance)
+	}
+	return IService{
+		XTUND:    name("xtund"),
+		IPTABLES: name("xtun-iptables"),
+		NFTABLES: name("xtun-nftables"),
+	}
+}
+
+// systemdUnitDir holds the unit files of every instance
+var systemdUnitDir = "/etc/systemd/system"
+
+var xtundUnitRe = regexp.MustCompile(`^xtund(?:@(.+))?\.service$`)
+
+// unitConfigPaths returns the config files of the instances installed as
+// xtund units, keyed by instance name
+func unitConfigPaths() (map[string]string, error) {
+	entries, err := os.ReadDir(systemdUnitDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	paths := make(map[string]string)
+	for _, e := range entries {
+		m := xtundUnitRe.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() || m[1] != "" && !instanceNameRe.MatchString(m[1]) {
+			continue
+		}
+		unit, err := os.ReadFile(filepath.Join(systemdUnitDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		name, path := unitConfigPath(string(unit), m[1])
+		paths[name] = path
+	}
+	return paths, nil
 }
 
-var Service = IService{
-	XTUND:    "xtund.service",
-	IPTABLES: "xtun-iptables.service",
+// unitConfigPath resolves the config file of an xtund unit from the
+// arguments and path overrides it starts the daemon with, the same way
+// `SetupPaths` does. It returns the name of the instance and the path.
+func unitConfigPath(unit string, instance string) (string, string) {
+	env := make(map[string]string)
+	var configPath string
+	for _, line := range strings.Split(unit, "\n") {
+		line = strings.TrimSpace(line)
+		if v, ok := strings.CutPrefix(line, "Environment="); ok {
+			if key, value, ok := strings.Cut(v, "="); ok {
+				env[key] = value
+			}
+		}
+		if v, ok := strings.CutPrefix(line, "ExecStart="); ok {
+			args := strings.Fields(v)
+			for i := 1; i < len(args); i++ {
+				flag, value, ok := strings.Cut(args[i], "=")
+				if !ok && i+1 < len(args) {
+					value = args[i+1]
+				}
+				switch flag {
+				case "--instance":
+					instance = value
+				case "--config":
+					configPath = value
+				}
+			}
+		}
+	}
+	if instance == "" {
+		instance = env[EnvInstance]
+	}
+	if configPath == "" {
+		configPath = env[EnvConfig]
+	}
+	if configPath == "" {
+		dir := defaultDirPath.ConfigDir
+		if v := env[EnvConfigDir]; v != "" {
+			dir = v
+		}
+		if instance != "" {
+			dir = filepath.Join(dir, instance)
+		}
+		configPath = filepath.Join(dir, ConfigFile)
+	}
+	if instance == "" {
+		instance = "default"
+	}
+	return instance, configPath
 }
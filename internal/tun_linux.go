@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/net-byte/water"
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtun-core/pkg/tun"
+)
+
+// Flags of TUNSETIFF and TUNSETOFFLOAD, see linux/if_tun.h
+const (
+	iffTun        = 0x0001
+	iffNoPI       = 0x1000
+	iffMultiQueue = 0x0100
+	iffVnetHdr    = 0x4000
+
+	tunSetOffload = 0x400454d0
+	tunFCsum      = 0x01
+	tunFTSO4      = 0x02
+	tunFTSO6      = 0x04
+)
+
+// CreateTunQueues creates the TUN device with n queues. Every queue is a file
+// descriptor of its own, the kernel spreads packets to the queues by flow so
+// they can be read in parallel. A single queue is created by xtun-core.
+//
+// With offload every packet read or written starts with a virtio-net header
+// and the kernel passes TCP segments of up to 64 KiB which are only split
+// into packets of the MTU at the tunnel boundary.
+func CreateTunQueues(cfg config.Config, n int, offload bool) ([]io.ReadWriteCloser, error) {
+	if n <= 1 && !offload {
+		iface, err := tun.CreateTunInterface(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []io.ReadWriteCloser{iface}, nil
+	}
+	queues := make([]io.ReadWriteCloser, 0, n)
+	for i := 0; i < n; i++ {
+		q, err := openTunQueue(cfg.DeviceName, n > 1, offload)
+		if err != nil {
+			CloseTunQueues(queues)
+			return nil, fmt.Errorf("failed to open queue %d of %s: %v", i, cfg.DeviceName, err)
+		}
+		queues = append(queues, q)
+	}
+	err := configureTun(cfg)
+	if err != nil {
+		CloseTunQueues(queues)
+		return nil, err
+	}
+	return queues, nil
+}
+
+// CloseTunQueues closes every queue, the device is removed with the last one
+func CloseTunQueues(queues []io.ReadWriteCloser) {
+	for _, q := range queues {
+		q.Close()
+	}
+}
+
+// openTunQueue attaches a queue to the TUN device name, creating the device
+// if it does not exist
+func openTunQueue(name string, multiQueue bool, offload bool) (io.ReadWriteCloser, error) {
+	if !offload {
+		return water.New(water.Config{
+			DeviceType: water.TUN,
+			PlatformSpecificParams: water.PlatformSpecificParams{
+				Name:       name,
+				MultiQueue: multiQueue,
+			},
+		})
+	}
+	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], name)
+	req.flags = iffTun | iffNoPI | iffVnetHdr
+	if multiQueue {
+		req.flags |= iffMultiQueue
+	}
+	err = ioctl(fd, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	err = ioctl(fd, tunSetOffload, tunFCsum|tunFTSO4|tunFTSO6)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("kernel does not support TUN offloads: %v", err)
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+func ioctl(fd int, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, arg)
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// configureTun assigns the address and MTU of the device and brings it up
+func configureTun(cfg config.Config) error {
+	commands := [][]string{
+		{"ip", "addr", "replace", cfg.CIDR, "dev", cfg.DeviceName},
+		{"ip", "link", "set", "dev", cfg.DeviceName, "mtu", strconv.Itoa(cfg.MTU), "up"},
+	}
+	for _, args := range commands {
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
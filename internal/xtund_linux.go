@@ -6,18 +6,27 @@ package internal
 import (
 	_ "embed"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"text/template"
-
-	"github.com/xorgal/xtun-core/pkg/config"
 )
 
 type ServiceConfig struct {
-	DeviceName string
+	DeviceName      string
+	Network         string
+	Table           string
+	ExecStart       []firewallCommand
+	ExecStop        []firewallCommand
+	BinaryPath      string
+	Args            string
+	Environment     []string
+	DataDir         string
+	LogDir          string
+	FirewallService string
 }
 
 type Services struct {
@@ -28,22 +37,18 @@ type Services struct {
 //go:embed template/xtund.tmpl
 var xtundT string
 
-//go:embed template/iptables.tmpl
-var iptablesT string
-
 // CreateXtundService initializes the xtund service by creating and configuring
-// its systemd service file. It then enables the service to run at startup.
+// its systemd service file. The daemon is sandboxed: it keeps only the capabilities
+// needed to manage the TUN device and bind privileged ports, sees a read-only
+// filesystem except for its data and log directories, and requires the routing
+// service of the configured firewall backend. It then enables the service to run at startup.
 func CreateXtundService() {
-	t, err := template.New("xtund").Parse(xtundT)
-	if err != nil {
-		log.Fatalf("Cannot parse service template: %v", err)
-	}
-	file, err := os.Create(fmt.Sprintf("/etc/systemd/system/%s", Service.XTUND))
+	file, err := os.Create(servicePath(Service.XTUND))
 	if err != nil {
 		log.Fatalf("Cannot create %v file: %v", Service.XTUND, err)
 	}
 	defer file.Close()
-	err = t.Execute(file, nil)
+	err = renderService(file, xtundT, xtundServiceConfig())
 	if err != nil {
 		log.Fatalf("Cannot write %s file: %v", Service.XTUND, err)
 	}
@@ -55,29 +60,26 @@ func CreateXtundService() {
 	}
 }
 
-// CreateIptablesService initializes the iptables service by creating and configuring
-// its systemd service file. It then enables the service to run at startup.
-func CreateIptablesService(cfg config.Config) {
-	t, err := template.New("iptables").Parse(iptablesT)
-	if err != nil {
-		log.Fatalf("Cannot parse service template: %v", err)
+// xtundServiceConfig returns the settings of the xtund unit of the current
+// instance
+func xtundServiceConfig() ServiceConfig {
+	return ServiceConfig{
+		BinaryPath:      FilePath.BinaryPath,
+		Args:            strings.Join(DaemonArgs(), " "),
+		Environment:     PathEnvironment(),
+		DataDir:         DirPath.Data,
+		LogDir:          DirPath.Log,
+		FirewallService: FirewallService(),
 	}
-	file, err := os.Create(fmt.Sprintf("/etc/systemd/system/%s", Service.IPTABLES))
-	if err != nil {
-		log.Fatalf("Cannot create %s file: %v", Service.IPTABLES, err)
-	}
-	defer file.Close()
-	err = t.Execute(file, ServiceConfig{
-		DeviceName: cfg.DeviceName,
-	})
-	if err != nil {
-		log.Fatalf("Cannot write %s file: %v", Service.IPTABLES, err)
-	}
-	cmd := exec.Command("systemctl", "enable", Service.IPTABLES)
-	err = cmd.Run()
+}
+
+// renderService writes the unit file of a service template to w
+func renderService(w io.Writer, text string, sc ServiceConfig) error {
+	t, err := template.New("service").Parse(text)
 	if err != nil {
-		log.Fatalf("Cannot enable %s: %v", Service.IPTABLES, err)
+		return err
 	}
+	return t.Execute(w, sc)
 }
 
 // IsXtundServiceExists checks if the xtund service exists.
@@ -106,6 +108,17 @@ func IsIptablesServiceExists(isRunning bool) bool {
 	return serviceExists
 }
 
+// IsFirewallServiceExists checks if the routing service of the configured firewall
+// backend exists, see `IsIptablesServiceExists` for the meaning of isRunning.
+func IsFirewallServiceExists(isRunning bool) bool {
+	serviceExists, err := IsServiceExists(FirewallService(), isRunning)
+	if err != nil {
+		return false
+	}
+
+	return serviceExists
+}
+
 // ReloadSystemd instructs systemd to reload its configuration. This is necessary
 // after changes to systemd service files.
 func ReloadSystemd() {
@@ -179,6 +192,47 @@ func RestartService(serviceName string) {
 	}
 }
 
+// ReloadService asks a running systemd service to reload its configuration.
+// It does nothing if the service is not running.
+func ReloadService(serviceName string) {
+	serviceExists, err := IsServiceExists(serviceName, true)
+	if err != nil {
+		serviceExists = false
+	}
+
+	if serviceExists {
+		cmd := exec.Command("systemctl", "reload", serviceName)
+		err := cmd.Run()
+		if err != nil {
+			log.Fatalf("failed to reload %s: %v", serviceName, err)
+		}
+
+		log.Printf("%s reloaded", serviceName)
+	}
+}
+
+// RemoveService disables a systemd service and deletes its unit file.
+// It does nothing if the service does not exist. The service is expected to be
+// stopped beforehand, see `StopService`.
+func RemoveService(serviceName string) {
+	serviceExists, err := IsServiceExists(serviceName, false)
+	if err != nil || !serviceExists {
+		return
+	}
+
+	cmd := exec.Command("systemctl", "disable", serviceName)
+	err = cmd.Run()
+	if err != nil {
+		log.Fatalf("failed to disable %s: %v", serviceName, err)
+	}
+	err = os.Remove(servicePath(serviceName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("failed to remove %s: %v", serviceName, err)
+	}
+
+	log.Printf("%s removed", serviceName)
+}
+
 // IsServiceExists checks if a systemd service exists.
 //
 // The function takes a service name and a boolean flag isRunning as arguments.
@@ -224,3 +278,7 @@ func IsServiceExists(serviceName string, isRunning bool) (bool, error) {
 
 	return true, nil // service exists
 }
+
+func servicePath(serviceName string) string {
+	return filepath.Join(systemdUnitDir, serviceName)
+}
@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+)
+
+// setupTestInstance resolves the paths of the "office" instance below fixed
+// directories and restores the default instance afterwards
+func setupTestInstance(t *testing.T, firewall string) {
+	t.Cleanup(func() {
+		SetupPaths("", "")
+		DaemonConfig.Firewall = FirewallAuto
+	})
+	t.Setenv(EnvInstance, "")
+	t.Setenv(EnvConfig, "")
+	t.Setenv(EnvBinaryDir, "/opt/xtun/bin")
+	t.Setenv(EnvConfigDir, "/opt/xtun/etc")
+	t.Setenv(EnvDataDir, "/opt/xtun/data")
+	t.Setenv(EnvLogDir, "/opt/xtun/log")
+	err := SetupPaths("office", "/opt/xtun/office.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DaemonConfig.Firewall = firewall
+}
+
+func assertLines(t *testing.T, unit string, lines []string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(unit, "\n    "+line+"\n") {
+			t.Errorf("missing %q in unit:\n%s", line, unit)
+		}
+	}
+}
+
+// hasExec reports whether the unit has a line starting with prefix which runs
+// a command ending with args
+func hasExec(unit string, prefix string, args string) bool {
+	for _, line := range strings.Split(unit, "\n") {
+		if strings.HasPrefix(line, "    "+prefix) && strings.HasSuffix(line, " "+args) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestXtundService(t *testing.T) {
+	for _, firewall := range []string{FirewallIptables, FirewallNftables} {
+		t.Run(firewall, func(t *testing.T) {
+			setupTestInstance(t, firewall)
+			var b strings.Builder
+			err := renderService(&b, xtundT, xtundServiceConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			service := "xtun-" + firewall + "@office.service"
+			assertLines(t, b.String(), []string{
+				"After=network-online.target " + service,
+				"Requires=" + service,
+				"Environment=XTUN_BINARY_DIR=/opt/xtun/bin",
+				"Environment=XTUN_DATA_DIR=/opt/xtun/data",
+				"ExecStart=/opt/xtun/bin/xtund --instance office --config /opt/xtun/office.json",
+				"ExecReload=/bin/kill -HUP $MAINPID",
+				"CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_BIND_SERVICE",
+				"AmbientCapabilities=CAP_NET_ADMIN CAP_NET_BIND_SERVICE",
+				"NoNewPrivileges=yes",
+				"ProtectSystem=strict",
+				"ReadWritePaths=/opt/xtun/data/office /opt/xtun/log/office",
+			})
+		})
+	}
+}
+
+func TestFirewallService(t *testing.T) {
+	cfg := config.Config{DeviceName: "xtun-office", CIDR: "10.0.20.1/24"}
+	tests := []struct {
+		firewall string
+		start    []string
+		stop     []string
+	}{
+		{
+			firewall: FirewallNftables,
+			start:    []string{"-f /opt/xtun/etc/office/nftables.conf"},
+			stop:     []string{"delete table ip xtun_office"},
+		},
+		{
+			firewall: FirewallIptables,
+			start: []string{
+				"-t nat -A XTUN-OFFICE -s 10.0.20.0/24 ! -o xtun-office -j MASQUERADE",
+				"-A XTUN-OFFICE -i xtun-office -j ACCEPT",
+				"-A FORWARD -j XTUN-OFFICE",
+			},
+			stop: []string{"-t nat -X XTUN-OFFICE", "-X XTUN-OFFICE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.firewall, func(t *testing.T) {
+			setupTestInstance(t, tt.firewall)
+			sc, err := firewallConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b strings.Builder
+			err = renderService(&b, firewallT, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unit := b.String()
+			assertLines(t, unit, []string{"ExecStart=/sbin/sysctl -w net.ipv4.ip_forward=1", "RemainAfterExit=yes"})
+			for _, args := range tt.start {
+				if !hasExec(unit, "ExecStart=/", args) {
+					t.Errorf("missing ExecStart with %q in unit:\n%s", args, unit)
+				}
+			}
+			// Removing rules which are not installed must not fail the unit
+			for _, args := range tt.stop {
+				if !hasExec(unit, "ExecStop=-/", args) {
+					t.Errorf("missing optional ExecStop with %q in unit:\n%s", args, unit)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// File: server/acl.go
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// aclPolicy is the compiled form of `internal.IACLConfig`. A new policy with
+// fresh hit counters replaces it on configuration reload.
+type aclPolicy struct {
+	allow       bool
+	rules       []*aclRule
+	defaultHits atomic.Uint64
+}
+
+type aclRule struct {
+	config  internal.IACLRule
+	allow   bool
+	devices map[string]bool
+	nets    []*net.IPNet
+	proto   uint8
+	ports   []portRange
+	hits    atomic.Uint64
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+// sessionACL holds the rules of the policy which apply to a session's device
+type sessionACL struct {
+	policy *aclPolicy
+	rules  []*aclRule
+}
+
+// packetInfo is the part of a packet ACL rules match on
+type packetInfo struct {
+	dst   net.IP
+	proto uint8
+	// port is only set for the first fragment of TCP and UDP packets
+	port    uint16
+	hasPort bool
+}
+
+// acl is the active policy, sessions pick it up on identification and reload
+var acl atomic.Pointer[aclPolicy]
+
+// compileACL validates the configuration and prepares it for matching
+func compileACL(cfg internal.IACLConfig) (*aclPolicy, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	p := &aclPolicy{allow: cfg.Default != internal.ACLDeny}
+	for _, rc := range cfg.Rules {
+		r := &aclRule{config: rc, allow: rc.Action == internal.ACLAllow}
+		if len(rc.Devices)+len(rc.Groups) > 0 {
+			r.devices = make(map[string]bool)
+			for _, d := range rc.GroupDevices(cfg.Groups) {
+				r.devices[d] = true
+			}
+		}
+		for _, d := range rc.Destinations {
+			network, _ := internal.ParseNetwork(d)
+			r.nets = append(r.nets, network)
+		}
+		r.proto, _ = internal.ParseProtocol(rc.Protocol)
+		for _, port := range rc.Ports {
+			from, to, _ := internal.ParsePortRange(port)
+			r.ports = append(r.ports, portRange{from, to})
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// forDevice returns the rules which apply to the device, an empty ID
+// matches only rules for every client
+func (p *aclPolicy) forDevice(id string) *sessionACL {
+	a := &sessionACL{policy: p}
+	for _, r := range p.rules {
+		if r.devices == nil || (id != "" && r.devices[id]) {
+			a.rules = append(a.rules, r)
+		}
+	}
+	return a
+}
+
+// allowed evaluates the packet against the rules, the first match decides.
+// Packets which cannot be parsed are denied.
+func (a *sessionACL) allowed(packet []byte) bool {
+	if a == nil {
+		return true
+	}
+	info, ok := parsePacket(packet)
+	if !ok {
+		return false
+	}
+	for _, r := range a.rules {
+		if r.match(info) {
+			r.hits.Add(1)
+			return r.allow
+		}
+	}
+	a.policy.defaultHits.Add(1)
+	return a.policy.allow
+}
+
+func (r *aclRule) match(info packetInfo) bool {
+	if r.proto != 0 && r.proto != info.proto {
+		return false
+	}
+	if len(r.nets) > 0 && !containsIP(r.nets, info.dst) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		if !info.hasPort {
+			return false
+		}
+		for _, p := range r.ports {
+			if info.port >= p.from && info.port <= p.to {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePacket extracts the destination of an IPv4 or IPv6 packet. IPv6
+// extension headers are not followed, such packets match no port rule.
+func parsePacket(packet []byte) (packetInfo, bool) {
+	var info packetInfo
+	var payload []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl {
+			return info, false
+		}
+		info.dst = net.IP(packet[16:20])
+		info.proto = packet[9]
+		// Only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			payload = packet[ihl:]
+		}
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		info.dst = net.IP(packet[24:40])
+		info.proto = packet[6]
+		payload = packet[40:]
+	default:
+		return info, false
+	}
+	if (info.proto == internal.ProtocolTCP || info.proto == internal.ProtocolUDP) && len(payload) >= 4 {
+		info.port = binary.BigEndian.Uint16(payload[2:4])
+		info.hasPort = true
+	}
+	return info, true
+}
+
+// setACL activates a compiled policy for new and open sessions
+func setACL(p *aclPolicy) {
+	acl.Store(p)
+	for _, s := range sessions.all() {
+		s.refreshACL()
+	}
+}
+
+// aclResponse returns the active rules and their hit counters
+func aclResponse() ACLResponse {
+	p := acl.Load()
+	if p == nil {
+		return ACLResponse{Default: internal.ACLAllow, Rules: []ACLRuleResponse{}}
+	}
+	r := ACLResponse{
+		Default:     internal.ACLDeny,
+		DefaultHits: p.defaultHits.Load(),
+		Rules:       make([]ACLRuleResponse, 0, len(p.rules)),
+	}
+	if p.allow {
+		r.Default = internal.ACLAllow
+	}
+	for _, rule := range p.rules {
+		r.Rules = append(r.Rules, ACLRuleResponse{IACLRule: rule.config, Hits: rule.hits.Load()})
+	}
+	return r
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+// testPacketTo returns an IPv4 packet from src to dst of the protocol with
+// the destination port in its transport header
+func testPacketTo(src, dst string, proto uint8, port uint16) []byte {
+	b := testPacket(64)
+	copy(b[12:16], net.ParseIP(src).To4())
+	copy(b[16:20], net.ParseIP(dst).To4())
+	b[9] = proto
+	binary.BigEndian.PutUint16(b[22:24], port)
+	return b
+}
+
+func TestACLAllowed(t *testing.T) {
+	p, err := compileACL(internal.IACLConfig{
+		Default: internal.ACLDeny,
+		Groups:  map[string][]string{"admins": {"laptop"}},
+		Rules: []internal.IACLRule{
+			{Action: internal.ACLAllow, Groups: []string{"admins"}},
+			{Action: internal.ACLDeny, Destinations: []string{"192.168.1.10"}},
+			{Action: internal.ACLAllow, Destinations: []string{"192.168.1.0/24"}, Protocol: "tcp", Ports: []string{"80", "8000-8080"}},
+			{Action: internal.ACLAllow, Protocol: "udp", Ports: []string{"53"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := p.forDevice("phone")
+	laptop := p.forDevice("laptop")
+	for _, c := range []struct {
+		name   string
+		acl    *sessionACL
+		packet []byte
+		allow  bool
+	}{
+		{"group member", laptop, testPacketTo("10.0.10.2", "192.168.1.10", internal.ProtocolTCP, 22), true},
+		{"denied host", phone, testPacketTo("10.0.10.3", "192.168.1.10", internal.ProtocolTCP, 80), false},
+		{"allowed port", phone, testPacketTo("10.0.10.3", "192.168.1.20", internal.ProtocolTCP, 80), true},
+		{"allowed range", phone, testPacketTo("10.0.10.3", "192.168.1.20", internal.ProtocolTCP, 8080), true},
+		{"other port", phone, testPacketTo("10.0.10.3", "192.168.1.20", internal.ProtocolTCP, 443), false},
+		{"other protocol", phone, testPacketTo("10.0.10.3", "192.168.1.20", internal.ProtocolUDP, 80), false},
+		{"any destination", phone, testPacketTo("10.0.10.3", "203.0.113.1", internal.ProtocolUDP, 53), true},
+		{"default", phone, testPacketTo("10.0.10.3", "203.0.113.1", internal.ProtocolTCP, 53), false},
+		{"no policy", nil, testPacketTo("10.0.10.3", "203.0.113.1", internal.ProtocolTCP, 53), true},
+	} {
+		if c.acl.allowed(c.packet) != c.allow {
+			t.Errorf("%s: allowed expected %v", c.name, c.allow)
+		}
+	}
+	if p.rules[0].hits.Load() != 1 || p.defaultHits.Load() != 3 {
+		t.Fatalf("hits %d, default hits %d", p.rules[0].hits.Load(), p.defaultHits.Load())
+	}
+}
+
+func TestACLFragments(t *testing.T) {
+	p, err := compileACL(internal.IACLConfig{
+		Default: internal.ACLDeny,
+		Rules:   []internal.IACLRule{{Action: internal.ACLAllow, Protocol: "udp", Ports: []string{"53"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.forDevice("")
+	packet := testPacketTo("10.0.10.2", "203.0.113.1", internal.ProtocolUDP, 53)
+	if !a.allowed(packet) {
+		t.Fatal("first fragment denied")
+	}
+	// Later fragments carry no ports and match no port rule
+	binary.BigEndian.PutUint16(packet[6:8], 185)
+	if a.allowed(packet) {
+		t.Fatal("later fragment allowed by a port rule")
+	}
+}
+
+func TestACLDeniesMalformed(t *testing.T) {
+	p, err := compileACL(internal.IACLConfig{Default: internal.ACLAllow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.forDevice("")
+	for _, first := range []byte{0x40, 0x41, 0x4f, 0x00, 0x70} {
+		packet := testPacket(40)
+		packet[0] = first
+		if a.allowed(packet) {
+			t.Errorf("first byte %#02x allowed", first)
+		}
+	}
+	if a.allowed(make([]byte, 10)) {
+		t.Error("short packet allowed")
+	}
+}
+
+// packetRecorder is a TUN queue which keeps the packets written to it
+type packetRecorder struct {
+	packets [][]byte
+}
+
+func (r *packetRecorder) Read(p []byte) (int, error) {
+	select {}
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	r.packets = append(r.packets, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// newTestAllocator returns an allocator of 10.0.10.1/24 in a temporary file
+func newTestAllocator(t testing.TB) *internal.Allocator {
+	path := internal.FilePath.AllocatorPath
+	t.Cleanup(func() { internal.FilePath.AllocatorPath = path })
+	internal.FilePath.AllocatorPath = filepath.Join(t.TempDir(), "allocdb")
+	a, err := internal.CreateAllocator("10.0.10.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+// sendFromClient passes packet to fromClient as a frame received on a link
+// of s, it returns the packets written to the TUN device
+func sendFromClient(allocator *internal.Allocator, s *session, packet []byte) [][]byte {
+	tun := &packetRecorder{}
+	l := &link{s: s}
+	fromClient(config.Config{}, l, &tunQueue{rw: tun}, allocator, s.encodeFrame(nil, packet))
+	return tun.packets
+}
+
+func TestBindSourceRefusesRegisteredDevice(t *testing.T) {
+	allocator := newTestAllocator(t)
+	cidr, _, err := allocator.RegisterDevice("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := netip.MustParsePrefix(cidr)
+	laptop := prefix.Addr().String()
+
+	// A client without a device header sends from the laptop's address
+	s := newTestSession(internal.CodecNone)
+	t.Cleanup(s.close)
+	if n := len(sendFromClient(allocator, s, testPacketTo(laptop, "203.0.113.1", internal.ProtocolUDP, 53))); n != 0 {
+		t.Fatalf("%d packets of a spoofed device forwarded", n)
+	}
+	if s.bound.IsValid() || s.device() != "" {
+		t.Fatalf("session bound to %v as %q", s.bound, s.device())
+	}
+	if _, ok := clientRoutes.get(prefix.Addr()); ok {
+		t.Fatal("route of the device taken over")
+	}
+	// The session stays unbound
+	if n := len(sendFromClient(allocator, s, testPacketTo("10.0.10.200", "203.0.113.1", internal.ProtocolUDP, 53))); n != 0 {
+		t.Fatalf("%d packets of an unbound session forwarded", n)
+	}
+	if s.stats.spoofed.Load() != 2 {
+		t.Fatalf("%d spoofed packets counted", s.stats.spoofed.Load())
+	}
+}
+
+func TestBindSourceRefusesOtherSession(t *testing.T) {
+	allocator := newTestAllocator(t)
+	owner := newTestSession(internal.CodecNone)
+	t.Cleanup(owner.close)
+	packet := testPacketTo("10.0.10.200", "203.0.113.1", internal.ProtocolUDP, 53)
+	if n := len(sendFromClient(allocator, owner, packet)); n != 1 {
+		t.Fatalf("%d packets forwarded", n)
+	}
+	if owner.bound != netip.MustParseAddr("10.0.10.200") {
+		t.Fatalf("session bound to %v", owner.bound)
+	}
+
+	thief := newTestSession(internal.CodecNone)
+	t.Cleanup(thief.close)
+	if n := len(sendFromClient(allocator, thief, packet)); n != 0 {
+		t.Fatalf("%d packets of a spoofed session forwarded", n)
+	}
+	if s, _ := clientRoutes.get(owner.bound); s != owner {
+		t.Fatal("route taken over by another session")
+	}
+	// Packets from another address than the bound one are dropped
+	if n := len(sendFromClient(allocator, owner, testPacketTo("10.0.10.201", "203.0.113.1", internal.ProtocolUDP, 53))); n != 0 {
+		t.Fatalf("%d spoofed packets forwarded", n)
+	}
+}
+
+func TestIdentifyByDevice(t *testing.T) {
+	allocator := newTestAllocator(t)
+	cidr, _, err := allocator.RegisterDevice("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParsePrefix(cidr).Addr()
+	s := newTestSession(internal.CodecNone)
+	t.Cleanup(s.close)
+	s.identified.Do(func() { s.identify(addr, allocator) })
+	if s.device() != "laptop" {
+		t.Fatalf("device %q", s.device())
+	}
+	if n := len(sendFromClient(allocator, s, testPacketTo(addr.String(), "203.0.113.1", internal.ProtocolUDP, 53))); n != 1 {
+		t.Fatalf("%d packets of the device forwarded", n)
+	}
+}
@@ -4,7 +4,9 @@ package server
 import (
 	"encoding/json"
 	"io"
+	"log/slog"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/xorgal/xtun-core/pkg/config"
@@ -25,10 +27,14 @@ func initAPIRoutes(config config.Config, allocator *internal.Allocator) {
 		if !checkPermission(w, r, config) {
 			return
 		}
+		// Clients pass their device ID to receive their own routes
 		response := ServerConfigurationResponse{
-			BufferSize: config.BufferSize,
-			MTU:        config.MTU,
-			Compress:   config.Compress,
+			BufferSize:     config.BufferSize,
+			MTU:            config.MTU,
+			Compress:       config.Compress,
+			Codecs:         codecsResponse(config),
+			RoutesResponse: routesResponse(r.URL.Query().Get("id")),
+			DNSResponse:    dnsResponse(),
 		}
 		sendJsonResponse(w, http.StatusOK, response)
 	})
@@ -46,18 +52,166 @@ func initAPIRoutes(config config.Config, allocator *internal.Allocator) {
 		client, serverIP, err := allocator.RegisterDevice(request.DeviceId)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			internal.PrintErr("allocator.RegisterDevice(request.DeviceId):", err)
+			slog.Error("failed to register device", "device", request.DeviceId, "remote", r.RemoteAddr, "err", err)
+			return
 		}
+		internal.Audit(internal.AuditDeviceRegistered, r.RemoteAddr, "device", request.DeviceId, "ip", client)
 		response := RegisterDeviceResponse{
-			Client: client,
-			Server: serverIP,
+			Client:         client,
+			Server:         serverIP,
+			RoutesResponse: routesResponse(request.DeviceId),
+			DNSResponse:    dnsResponse(),
+		}
+		sendJsonResponse(w, http.StatusOK, response)
+	})
+
+	http.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(w, r) {
+			return
+		}
+		list := sessions.all()
+		response := SessionsResponse{
+			Sessions: make([]SessionResponse, 0, len(list)),
+			Totals: SessionTotalsResponse{
+				ReadBytes:       totals.readBytes.Load(),
+				WrittenBytes:    totals.writtenBytes.Load(),
+				UploadDelayed:   totals.uploadDelayed.Load(),
+				UploadDropped:   totals.uploadDropped.Load(),
+				DownloadDropped: totals.downloadDropped.Load(),
+				ACLDenied:       totals.aclDenied.Load(),
+				PeerForwarded:   totals.peerForwarded.Load(),
+				PeerDenied:      totals.peerDenied.Load(),
+				TooBig:          totals.tooBig.Load(),
+				DecodeFailed:    totals.decodeFailed.Load(),
+				Spoofed:         totals.spoofed.Load(),
+				QueueDropped:    totals.queueDropped.Load(),
+				TimedOut:        totals.timedOut.Load(),
+			},
+		}
+		for _, s := range list {
+			response.Sessions = append(response.Sessions, s.response())
+		}
+		sendJsonResponse(w, http.StatusOK, response)
+	})
+
+	http.HandleFunc("/devices/ratelimit", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var request RateLimitRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rate := internal.IRateLimit{Upload: request.Upload, Download: request.Download}
+		err = rate.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		record, err := allocator.UpdateDevice(request.DeviceId, func(record *internal.DeviceRecord) {
+			if request.Reset {
+				record.RateLimit = nil
+			} else {
+				record.RateLimit = &rate
+			}
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		for _, s := range sessions.byDevice(request.DeviceId) {
+			s.setRateLimit(record.RateLimit)
+		}
+		internal.Audit(internal.AuditDeviceUpdated, r.RemoteAddr, "device", request.DeviceId,
+			"upload", request.Upload, "download", request.Download, "reset", request.Reset)
+		sendJsonResponse(w, http.StatusOK, DeviceResponse{DeviceId: request.DeviceId, DeviceRecord: record})
+	})
+
+	http.HandleFunc("/devices/usage", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(w, r) {
+			return
+		}
+		flushUsage(allocator, sessions.all())
+		response := []DeviceUsageResponse{}
+		if id := r.URL.Query().Get("id"); id != "" {
+			record, err := allocator.GetDevice(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			response = append(response, usageResponse(id, record))
+		} else {
+			records, err := allocator.ListDevices()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for id, record := range records {
+				response = append(response, usageResponse(id, record))
+			}
+			sort.Slice(response, func(i, j int) bool { return response[i].DeviceId < response[j].DeviceId })
+		}
+		sendJsonResponse(w, http.StatusOK, response)
+	})
+
+	http.HandleFunc("/devices/quota", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var request QuotaRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		list := sessions.byDevice(request.DeviceId)
+		// Pending traffic belongs to the usage which may be reset
+		flushUsage(allocator, list)
+		record, err := allocator.UpdateDevice(request.DeviceId, func(record *internal.DeviceRecord) {
+			if request.Reset {
+				record.Quota = nil
+			} else if request.Quota != nil {
+				record.Quota = request.Quota
+			}
+			if request.ResetUsage {
+				record.Usage = internal.DeviceUsage{Period: currentPeriod()}
+			}
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		applyQuota(request.DeviceId, record, list)
+		fields := []any{"device", request.DeviceId, "reset", request.Reset, "resetUsage", request.ResetUsage}
+		if request.Quota != nil {
+			fields = append(fields, "quota", *request.Quota)
+		}
+		internal.Audit(internal.AuditDeviceUpdated, r.RemoteAddr, fields...)
+		sendJsonResponse(w, http.StatusOK, usageResponse(request.DeviceId, record))
+	})
+
+	http.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(w, r) {
+			return
+		}
+		response := aclResponse()
+		response.Peers = peersResponse()
 		sendJsonResponse(w, http.StatusOK, response)
 	})
 
 	// Todo: convert to json
 	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		if !checkPermission(w, r, config) {
+		if !checkAdmin(w, r) {
 			return
 		}
 		io.WriteString(w, counter.PrintBytes(true))
@@ -0,0 +1,95 @@
+// File: server/audit.go
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+const (
+	// authAuditInterval is the minimum time between audited authentication
+	// failures of one source, failures in between are counted
+	authAuditInterval = time.Minute
+	// maxAuthSources bounds the number of sources tracked at once
+	maxAuthSources = 4096
+)
+
+// authFailures coalesces authentication failures per source host, so a client
+// guessing keys cannot flood the audit log
+var authFailures = &failureAudit{sources: make(map[string]*failureSource)}
+
+type failureAudit struct {
+	mu      sync.Mutex
+	sources map[string]*failureSource
+}
+
+type failureSource struct {
+	next       time.Time
+	suppressed int
+}
+
+// auditAuthFailure records a failed authentication of remote unless one of the
+// same host was recorded within `authAuditInterval`. The number of failures
+// not recorded meanwhile is added to the next entry.
+func auditAuthFailure(remote string, fields ...any) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	if !authFailures.allow(host, time.Now(), &fields) {
+		return
+	}
+	internal.Audit(internal.AuditAuthFailed, remote, fields...)
+}
+
+// allow reports whether a failure of host is recorded now and appends the
+// number of failures suppressed before it to fields
+func (a *failureAudit) allow(host string, now time.Time, fields *[]any) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	src, ok := a.sources[host]
+	if ok && now.Before(src.next) {
+		src.suppressed++
+		return false
+	}
+	if !ok {
+		if len(a.sources) >= maxAuthSources-1 {
+			a.pruneLocked(now)
+		}
+		// Sources beyond the bound share one entry, it takes the last slot
+		if len(a.sources) >= maxAuthSources-1 {
+			host = ""
+		}
+		src = a.sources[host]
+		if src == nil {
+			src = &failureSource{}
+			a.sources[host] = src
+		} else if now.Before(src.next) {
+			src.suppressed++
+			return false
+		}
+	}
+	if src.suppressed > 0 {
+		*fields = append(*fields, "suppressed", src.suppressed)
+	}
+	src.next = now.Add(authAuditInterval)
+	src.suppressed = 0
+	return true
+}
+
+// pruneLocked forgets sources whose interval is over, failures suppressed for
+// them are recorded as a summary
+func (a *failureAudit) pruneLocked(now time.Time) {
+	for host, src := range a.sources {
+		if now.Before(src.next) {
+			continue
+		}
+		if src.suppressed > 0 {
+			internal.Audit(internal.AuditAuthFailed, host, "suppressed", src.suppressed)
+		}
+		delete(a.sources, host)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFailureAuditCoalesces(t *testing.T) {
+	a := &failureAudit{sources: make(map[string]*failureSource)}
+	now := time.Now()
+	var fields []any
+	if !a.allow("192.0.2.1", now, &fields) || len(fields) != 0 {
+		t.Fatalf("first failure: %v", fields)
+	}
+	for i := 0; i < 5; i++ {
+		if a.allow("192.0.2.1", now.Add(time.Second), &fields) {
+			t.Fatalf("failure %d within the interval was recorded", i)
+		}
+	}
+	if !a.allow("192.0.2.2", now, &fields) {
+		t.Fatal("failure of another source was not recorded")
+	}
+	fields = nil
+	if !a.allow("192.0.2.1", now.Add(authAuditInterval), &fields) {
+		t.Fatal("failure after the interval was not recorded")
+	}
+	if len(fields) != 2 || fields[0] != "suppressed" || fields[1] != 5 {
+		t.Fatalf("fields %v", fields)
+	}
+}
+
+func TestFailureAuditBounded(t *testing.T) {
+	a := &failureAudit{sources: make(map[string]*failureSource)}
+	now := time.Now()
+	var fields []any
+	for i := 0; i < maxAuthSources+100; i++ {
+		a.allow(fmt.Sprintf("host%d", i), now, &fields)
+	}
+	if len(a.sources) > maxAuthSources {
+		t.Fatalf("%d sources tracked", len(a.sources))
+	}
+	if a.allow("another", now, &fields) {
+		t.Fatal("sources beyond the bound are not coalesced")
+	}
+	// Sources whose interval is over make room again
+	if !a.allow("another", now.Add(authAuditInterval), &fields) {
+		t.Fatal("failure after the interval was not recorded")
+	}
+	if len(a.sources) > maxAuthSources {
+		t.Fatalf("%d sources tracked", len(a.sources))
+	}
+}
@@ -0,0 +1,144 @@
+// File: server/batch.go
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// batchSettings apply to new sessions, they are updated on configuration reload
+var batchSettings atomic.Pointer[internal.IBatchConfig]
+
+var errBatch = errors.New("invalid batch")
+
+// batcher coalesces frames to a client into one WebSocket message. Every
+// frame is prefixed with its length as a 16 bit big-endian number. The
+// message is sent once it reaches maxSize or delay after its first frame.
+// Frames which do not fit the length are sent in a message of their own
+// with a zero length prefix, the rest of the message is the frame.
+type batcher struct {
+	mu      sync.Mutex
+	buf     []byte
+	maxSize int
+	delay   time.Duration
+	timer   *time.Timer
+	pending bool
+	err     error
+	write   func(b []byte) error
+	// fail is called when a delayed write fails
+	fail func(err error)
+}
+
+func newBatcher(cfg internal.IBatchConfig, write func(b []byte) error, fail func(err error)) *batcher {
+	return &batcher{
+		maxSize: cfg.MaxSize,
+		delay:   time.Duration(cfg.Delay) * time.Microsecond,
+		write:   write,
+		fail:    fail,
+	}
+}
+
+// add appends a frame to the batch. An error of an earlier write is returned
+// as the connection is unusable then.
+func (b *batcher) add(frame []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if len(frame) > 0xffff {
+		// Frames queued before are sent first
+		if err := b.flushLocked(); err != nil {
+			return err
+		}
+		b.buf = append(b.buf, 0, 0)
+		b.buf = append(b.buf, frame...)
+		err := b.flushLocked()
+		// The buffer is not kept at the size of a rare large frame
+		if cap(b.buf) > 2*b.maxSize {
+			b.buf = nil
+		}
+		return err
+	}
+	if len(b.buf) > 0 && len(b.buf)+2+len(frame) > b.maxSize {
+		if err := b.flushLocked(); err != nil {
+			return err
+		}
+	}
+	b.buf = binary.BigEndian.AppendUint16(b.buf, uint16(len(frame)))
+	b.buf = append(b.buf, frame...)
+	if len(b.buf) >= b.maxSize {
+		return b.flushLocked()
+	}
+	if !b.pending {
+		b.pending = true
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.delay, b.flush)
+		} else {
+			b.timer.Reset(b.delay)
+		}
+	}
+	return nil
+}
+
+// flush sends the batch when its delay expired
+func (b *batcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return
+	}
+	if err := b.flushLocked(); err != nil {
+		b.fail(err)
+	}
+}
+
+func (b *batcher) flushLocked() error {
+	if b.pending {
+		b.timer.Stop()
+		b.pending = false
+	}
+	if len(b.buf) == 0 {
+		return nil
+	}
+	b.err = b.write(b.buf)
+	b.buf = b.buf[:0]
+	return b.err
+}
+
+// stop discards the batch and cancels a pending flush
+func (b *batcher) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.pending = false
+	b.err = errBatch
+}
+
+// splitBatch calls fn for every frame of a batch received from a client
+func splitBatch(b []byte, fn func(frame []byte)) error {
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return errBatch
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		// A zero length prefixes a single frame too large for a batch
+		if n == 0 {
+			fn(b[2:])
+			return nil
+		}
+		if len(b) < 2+n {
+			return errBatch
+		}
+		fn(b[2 : 2+n])
+		b = b[2+n:]
+	}
+	return nil
+}
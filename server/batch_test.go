@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/xorgal/xtund/internal"
+)
+
+var testBatchConfig = internal.IBatchConfig{Enabled: true, MaxSize: 16 * 1024, Delay: 200}
+
+func TestBatcherRoundTrip(t *testing.T) {
+	var messages [][]byte
+	b := newBatcher(testBatchConfig, func(m []byte) error {
+		messages = append(messages, bytes.Clone(m))
+		return nil
+	}, func(err error) { t.Error(err) })
+	defer b.stop()
+	var frames [][]byte
+	for i := 0; i < 100; i++ {
+		frames = append(frames, testPacket(64+i*5))
+	}
+	// A frame too large for a batch goes in a message of its own after
+	// the frames before it
+	frames = append(frames[:50], append([][]byte{testPacket(0xffff + 1)}, frames[50:]...)...)
+	for _, f := range frames {
+		err := b.add(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.mu.Lock()
+	b.flushLocked()
+	b.mu.Unlock()
+
+	var received [][]byte
+	for _, m := range messages {
+		err := splitBatch(m, func(frame []byte) {
+			received = append(received, frame)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) > testBatchConfig.MaxSize && len(m) != 2+0xffff+1 {
+			t.Fatalf("batch of %d bytes", len(m))
+		}
+	}
+	if len(received) != len(frames) {
+		t.Fatalf("received %d of %d frames", len(received), len(frames))
+	}
+	for i := range frames {
+		if !bytes.Equal(received[i], frames[i]) {
+			t.Fatalf("frame %d differs", i)
+		}
+	}
+}
+
+func TestSplitBatchInvalid(t *testing.T) {
+	for _, b := range [][]byte{{0}, {0, 5, 1, 2}} {
+		err := splitBatch(b, func([]byte) {})
+		if err != errBatch {
+			t.Fatalf("%v: %v", b, err)
+		}
+	}
+}
+
+var batchPacketSizes = []int{64, 128, 512}
+
+// testBatch returns a full batch of copies of packet and their number
+func testBatch(packet []byte) ([]byte, int) {
+	var batch []byte
+	var frames int
+	for len(batch)+2+len(packet) <= testBatchConfig.MaxSize {
+		batch = binary.BigEndian.AppendUint16(batch, uint16(len(packet)))
+		batch = append(batch, packet...)
+		frames++
+	}
+	return batch, frames
+}
+
+// loopbackConn returns a TCP connection over loopback, whatever is written to
+// it is discarded by the peer
+func loopbackConn(b *testing.B) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip(err)
+	}
+	defer ln.Close()
+	go func() {
+		peer, err := ln.Accept()
+		if err == nil {
+			io.Copy(io.Discard, peer)
+			peer.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// BenchmarkSend compares writing every packet as a WebSocket message with
+// coalescing packets into batches
+func BenchmarkSend(b *testing.B) {
+	for _, size := range batchPacketSizes {
+		packet := testPacket(size)
+		newWrite := func(b *testing.B) func(m []byte) error {
+			conn := loopbackConn(b)
+			var wbuf []byte
+			return func(m []byte) error {
+				wbuf = appendFrame(wbuf[:0], ws.OpBinary, m)
+				_, err := conn.Write(wbuf)
+				return err
+			}
+		}
+		b.Run(byteSize(size)+"/unbatched", func(b *testing.B) {
+			write := newWrite(b)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				write(packet)
+			}
+		})
+		b.Run(byteSize(size)+"/batched", func(b *testing.B) {
+			// The delay never expires, batches are sent once full
+			cfg := testBatchConfig
+			cfg.Delay = 1e9
+			batch := newBatcher(cfg, newWrite(b), func(err error) { b.Error(err) })
+			defer batch.stop()
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				batch.add(packet)
+			}
+		})
+	}
+}
+
+// BenchmarkReceive compares reading every packet as a WebSocket message
+// with reading batches and splitting them
+func BenchmarkReceive(b *testing.B) {
+	for _, size := range batchPacketSizes {
+		packet := testPacket(size)
+		b.Run(byteSize(size)+"/unbatched", func(b *testing.B) {
+			fr := newFrameReader(&loopReader{data: appendClientFrame(nil, ws.OpBinary, packet)}, nil)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := fr.next()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(byteSize(size)+"/batched", func(b *testing.B) {
+			batch, frames := testBatch(packet)
+			fr := newFrameReader(&loopReader{data: appendClientFrame(nil, ws.OpBinary, batch)}, nil)
+			count := func([]byte) {}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i += frames {
+				m, _, err := fr.next()
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = splitBatch(m, count)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSplitBatch(b *testing.B) {
+	for _, size := range batchPacketSizes {
+		b.Run(byteSize(size), func(b *testing.B) {
+			batch, frames := testBatch(testPacket(size))
+			count := func([]byte) {}
+			b.SetBytes(int64(len(batch)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				splitBatch(batch, count)
+			}
+			b.ReportMetric(float64(frames), "frames/batch")
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// File: server/buffer.go
+package server
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// bufferSize fits a frame of the largest packet with the overhead of any codec
+var bufferSize = maxFrameSize(maxPacketSize)
+
+// bufferClasses are the capacities of pooled buffers. Frames of packets up
+// to the usual MTUs take small buffers, only jumbo and offloaded packets
+// take the largest ones.
+var bufferClasses = [...]int{maxFrameSize(1500), maxFrameSize(9000), bufferSize}
+
+// bufferPools hold buffers of every class, goroutines which write to a
+// client take one per packet. Pointers are pooled so that putting a buffer
+// back does not allocate.
+var bufferPools [len(bufferClasses)]sync.Pool
+
+func init() {
+	for i, size := range bufferClasses {
+		size := size
+		bufferPools[i].New = func() any {
+			b := make([]byte, 0, size)
+			return &b
+		}
+	}
+}
+
+// maxFrameSize returns the size of a frame of a packet of n bytes with the
+// overhead of any codec
+func maxFrameSize(n int) int {
+	return 1 + snappy.MaxEncodedLen(n)
+}
+
+// getBuffer returns an empty buffer with room for at least size bytes, or
+// of the largest class
+func getBuffer(size int) *[]byte {
+	for i, c := range bufferClasses {
+		if size <= c {
+			return bufferPools[i].Get().(*[]byte)
+		}
+	}
+	return bufferPools[len(bufferPools)-1].Get().(*[]byte)
+}
+
+// putBuffer returns a buffer to the pool of the largest class it fits,
+// buffers which grew beyond the largest class are left to the garbage
+// collector
+func putBuffer(b *[]byte) {
+	n := cap(*b)
+	if n > bufferSize {
+		return
+	}
+	for i := len(bufferClasses) - 1; i >= 0; i-- {
+		if n >= bufferClasses[i] {
+			*b = (*b)[:0]
+			bufferPools[i].Put(b)
+			return
+		}
+	}
+}
+
+// grow makes room for n more bytes after the length of b
+func grow(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	nb := make([]byte, len(b), len(b)+n)
+	copy(nb, b)
+	return nb
+}
@@ -0,0 +1,203 @@
+// File: server/codec.go
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+// Every frame of a negotiated session starts with one of these flags, so
+// packets which do not compress well are sent as they are
+const (
+	frameRaw        = 0
+	frameCompressed = 1
+)
+
+// maxPacketSize bounds the size of a decompressed packet
+const maxPacketSize = 64 * 1024
+
+var errDecodedSize = errors.New("decoded packet is too large")
+var errFrame = errors.New("invalid frame")
+
+// codec compresses single packets, implementations are safe for
+// concurrent use. Both methods append to dst so callers can reuse buffers.
+type codec interface {
+	// encode returns dst unchanged if src does not compress
+	encode(dst, src []byte) []byte
+	decode(dst, src []byte) ([]byte, error)
+}
+
+// offeredCodecs are the codecs new sessions may negotiate, they are updated
+// on configuration reload
+var offeredCodecs atomic.Pointer[[]string]
+
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxPacketSize))
+
+var lz4Compressors = sync.Pool{New: func() any { return new(lz4.Compressor) }}
+
+type snappyCodec struct{}
+
+func (snappyCodec) encode(dst, src []byte) []byte {
+	dst = grow(dst, snappy.MaxEncodedLen(len(src)))
+	c := snappy.Encode(dst[len(dst):cap(dst)], src)
+	return dst[:len(dst)+len(c)]
+}
+
+func (snappyCodec) decode(dst, src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxPacketSize {
+		return nil, errDecodedSize
+	}
+	dst = grow(dst, n)
+	d, err := snappy.Decode(dst[len(dst):cap(dst)], src)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:len(dst)+len(d)], nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) encode(dst, src []byte) []byte {
+	return zstdEncoder.EncodeAll(src, dst)
+}
+
+func (zstdCodec) decode(dst, src []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(src, dst)
+}
+
+type lz4Codec struct{}
+
+// encode leaves dst unchanged for incompressible data as lz4 blocks do not
+// store it
+func (lz4Codec) encode(dst, src []byte) []byte {
+	c := lz4Compressors.Get().(*lz4.Compressor)
+	defer lz4Compressors.Put(c)
+	dst = grow(dst, lz4.CompressBlockBound(len(src)))
+	n, err := c.CompressBlock(src, dst[len(dst):cap(dst)])
+	if err != nil {
+		return dst
+	}
+	return dst[:len(dst)+n]
+}
+
+func (lz4Codec) decode(dst, src []byte) ([]byte, error) {
+	dst = grow(dst, maxPacketSize)
+	n, err := lz4.UncompressBlock(src, dst[len(dst):len(dst)+maxPacketSize])
+	if err != nil {
+		return nil, err
+	}
+	return dst[:len(dst)+n], nil
+}
+
+func newCodec(name string) codec {
+	switch name {
+	case internal.CodecZstd:
+		return zstdCodec{}
+	case internal.CodecLZ4:
+		return lz4Codec{}
+	case internal.CodecSnappy:
+		return snappyCodec{}
+	}
+	return nil
+}
+
+// negotiateCodec picks the first offered codec of the server the client
+// supports. Clients which do not take part in negotiation get snappy
+// without frame flags if compression is enabled, as before negotiation existed.
+func negotiateCodec(config config.Config, offer string) (name string, framed bool) {
+	if offer == "" {
+		if config.Compress {
+			return internal.CodecSnappy, false
+		}
+		return internal.CodecNone, false
+	}
+	supported := make(map[string]bool)
+	for _, c := range strings.Split(offer, ",") {
+		supported[strings.ToLower(strings.TrimSpace(c))] = true
+	}
+	for _, c := range codecsResponse(config) {
+		if supported[c] {
+			return c, true
+		}
+	}
+	return internal.CodecNone, true
+}
+
+// codecsResponse returns the codecs offered to clients
+func codecsResponse(config config.Config) []string {
+	if p := offeredCodecs.Load(); p != nil && len(*p) > 0 {
+		return *p
+	}
+	if config.Compress {
+		return []string{internal.CodecSnappy}
+	}
+	return []string{}
+}
+
+// encodeFrame appends a packet prepared to be sent to the client of the
+// session to dst
+func (s *session) encodeFrame(dst, b []byte) []byte {
+	if !s.framed {
+		if s.codec != nil {
+			return s.codec.encode(dst, b)
+		}
+		return append(dst, b...)
+	}
+	if s.codec != nil {
+		start := len(dst)
+		c := s.codec.encode(append(dst, frameCompressed), b)
+		if len(c) > start+1 && len(c)-start-1 < len(b) {
+			return c
+		}
+		dst = c[:start]
+	}
+	dst = append(dst, frameRaw)
+	return append(dst, b...)
+}
+
+// decodeFrame returns the packet of a frame received from the client.
+// Compressed packets are decoded into the buffer of the link, which is only
+// used by the goroutine reading from the link.
+func (l *link) decodeFrame(b []byte) ([]byte, error) {
+	s := l.s
+	if !s.framed {
+		if s.codec != nil {
+			return l.decodeInto(b)
+		}
+		return b, nil
+	}
+	if len(b) == 0 {
+		return nil, errFrame
+	}
+	switch {
+	case b[0] == frameRaw:
+		return b[1:], nil
+	case b[0] == frameCompressed && s.codec != nil:
+		return l.decodeInto(b[1:])
+	}
+	return nil, errFrame
+}
+
+func (l *link) decodeInto(b []byte) ([]byte, error) {
+	d, err := l.s.codec.decode(l.decoded[:0], b)
+	if err != nil {
+		return nil, err
+	}
+	if cap(d) <= bufferSize {
+		l.decoded = d[:0]
+	}
+	return d, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+var testCodecs = []string{internal.CodecNone, internal.CodecSnappy, internal.CodecLZ4, internal.CodecZstd}
+
+// testPacket returns an IPv4 UDP packet of n bytes with a payload which
+// compresses like text
+func testPacket(n int) []byte {
+	b := make([]byte, n)
+	b[0] = 0x45
+	b[2], b[3] = byte(n>>8), byte(n)
+	b[8] = 64
+	b[9] = 17
+	copy(b[12:16], []byte{10, 0, 10, 2})
+	copy(b[16:20], []byte{10, 0, 10, 3})
+	text := []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n")
+	for i := 28; i < n; i++ {
+		b[i] = text[i%len(text)]
+	}
+	return b
+}
+
+func newTestSession(codec string) *session {
+	return newSession("test", sessionParams{mtu: 1500, codec: codec, framed: true}, slog.Default())
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, codec := range testCodecs {
+		t.Run(codec, func(t *testing.T) {
+			s := newTestSession(codec)
+			l := &link{s: s}
+			for _, n := range []int{28, 64, 1400, maxPacketSize} {
+				packet := testPacket(n)
+				frame := s.encodeFrame(nil, packet)
+				b, err := l.decodeFrame(frame)
+				if err != nil {
+					t.Fatalf("%d bytes: %v", n, err)
+				}
+				if !bytes.Equal(b, packet) {
+					t.Fatalf("%d bytes: decoded packet differs", n)
+				}
+				if len(frame) > maxFrameSize(n) {
+					t.Fatalf("%d bytes: frame of %d bytes exceeds %d", n, len(frame), maxFrameSize(n))
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeFrameAllocs(t *testing.T) {
+	packet := testPacket(1400)
+	for _, codec := range testCodecs {
+		t.Run(codec, func(t *testing.T) {
+			s := newTestSession(codec)
+			allocs := testing.AllocsPerRun(100, func() {
+				buf := getBuffer(maxFrameSize(len(packet)))
+				*buf = s.encodeFrame(*buf, packet)
+				putBuffer(buf)
+			})
+			if allocs != 0 {
+				t.Fatalf("%v allocations per frame", allocs)
+			}
+		})
+	}
+}
+
+func TestDecodeFrameAllocs(t *testing.T) {
+	packet := testPacket(1400)
+	for _, codec := range testCodecs {
+		t.Run(codec, func(t *testing.T) {
+			s := newTestSession(codec)
+			l := &link{s: s}
+			frame := s.encodeFrame(nil, packet)
+			allocs := testing.AllocsPerRun(100, func() {
+				_, err := l.decodeFrame(frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+			if allocs != 0 {
+				t.Fatalf("%v allocations per frame", allocs)
+			}
+		})
+	}
+}
+
+func TestBufferClasses(t *testing.T) {
+	for _, size := range []int{0, 1500, maxFrameSize(1500), maxFrameSize(1500) + 1, maxFrameSize(9000), bufferSize} {
+		buf := getBuffer(size)
+		if cap(*buf) < size || len(*buf) != 0 {
+			t.Fatalf("buffer for %d bytes has length %d and capacity %d", size, len(*buf), cap(*buf))
+		}
+		putBuffer(buf)
+	}
+	// Frames of packets up to the MTU do not take the largest buffers
+	if buf := getBuffer(maxFrameSize(1500)); cap(*buf) >= bufferSize {
+		t.Fatalf("buffer of %d bytes for a 1500 byte packet", cap(*buf))
+	}
+}
+
+func BenchmarkEncodeFrame(b *testing.B) {
+	packet := testPacket(1400)
+	for _, codec := range testCodecs {
+		b.Run(codec, func(b *testing.B) {
+			s := newTestSession(codec)
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf := getBuffer(maxFrameSize(len(packet)))
+				*buf = s.encodeFrame(*buf, packet)
+				putBuffer(buf)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeFrame(b *testing.B) {
+	packet := testPacket(1400)
+	for _, codec := range testCodecs {
+		b.Run(codec, func(b *testing.B) {
+			s := newTestSession(codec)
+			l := &link{s: s}
+			frame := s.encodeFrame(nil, packet)
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := l.decodeFrame(frame)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
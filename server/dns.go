@@ -0,0 +1,272 @@
+// File: server/dns.go
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsTTL is the TTL of device records in seconds
+	dnsTTL = 60
+	// dnsTimeout bounds a query to an upstream server
+	dnsTimeout = 3 * time.Second
+	// dnsMaxSize is the largest message accepted over UDP
+	dnsMaxSize = 4096
+	// dnsMaxQueries bounds the UDP queries answered at once, further
+	// queries wait in the socket buffer
+	dnsMaxQueries = 64
+)
+
+// dnsBuffers hold the buffers of UDP queries
+var dnsBuffers = sync.Pool{New: func() any {
+	b := make([]byte, dnsMaxSize)
+	return &b
+}}
+
+// dnsSettings are the DNS settings pushed to clients and used by the
+// forwarder, they are updated on configuration reload
+var dnsSettings atomic.Pointer[internal.IDNSConfig]
+
+// dnsResponse returns the DNS servers and search domains pushed to clients
+func dnsResponse() DNSResponse {
+	r := DNSResponse{Servers: []string{}, Search: []string{}}
+	c := dnsSettings.Load()
+	if c == nil {
+		return r
+	}
+	if c.Forwarder && tunnelIP != nil {
+		r.Servers = append(r.Servers, tunnelIP.String())
+	}
+	r.Servers = append(r.Servers, c.Servers...)
+	if c.Forwarder {
+		r.Search = append(r.Search, strings.Trim(c.Zone, "."))
+	}
+	r.Search = append(r.Search, c.Search...)
+	return r
+}
+
+// dnsForwarder answers queries for registered devices from the allocator
+// and forwards everything else upstream
+type dnsForwarder struct {
+	allocator *internal.Allocator
+}
+
+// startDNS serves DNS over UDP and TCP on the tunnel IP until ctx is done.
+// Changes of the forwarder switch take effect on restart.
+func startDNS(ctx context.Context, allocator *internal.Allocator) error {
+	addr := net.JoinHostPort(tunnelIP.String(), "53")
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		udp.Close()
+		tcp.Close()
+	}()
+	f := &dnsForwarder{allocator: allocator}
+	go f.serveUDP(udp)
+	go f.serveTCP(tcp)
+	slog.Info("DNS forwarder listening", "addr", addr)
+	return nil
+}
+
+// serveUDP answers queries on conn, at most dnsMaxQueries at once. Reading
+// stops while all are in flight.
+func (f *dnsForwarder) serveUDP(conn net.PacketConn) {
+	sem := make(chan struct{}, dnsMaxQueries)
+	for {
+		sem <- struct{}{}
+		buf := dnsBuffers.Get().(*[]byte)
+		n, addr, err := conn.ReadFrom(*buf)
+		if err != nil {
+			dnsBuffers.Put(buf)
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("DNS forwarder stopped", "err", err)
+			}
+			return
+		}
+		go func() {
+			defer func() {
+				dnsBuffers.Put(buf)
+				<-sem
+			}()
+			if resp := f.handle((*buf)[:n], "udp"); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("DNS forwarder stopped", "err", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsTimeout * 2))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := f.handle(query, "tcp")
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle returns the response to a query, or nil if it can not be answered
+func (f *dnsForwarder) handle(query []byte, network string) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	c := dnsSettings.Load()
+	if resp, ok := f.resolveLocal(header, q, c.Zone); ok {
+		return resp
+	}
+	resp, err := f.forward(query, network, c.UpstreamServers())
+	if err != nil {
+		slog.Debug("DNS query failed", "name", q.Name.String(), "err", err)
+		return reply(header, q, dnsmessage.RCodeServerFailure, nil)
+	}
+	return resp
+}
+
+// resolveLocal answers queries for names in the zone
+func (f *dnsForwarder) resolveLocal(header dnsmessage.Header, q dnsmessage.Question, zone string) ([]byte, bool) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if name == zone {
+		return reply(header, q, dnsmessage.RCodeSuccess, nil), true
+	}
+	id, ok := strings.CutSuffix(name, "."+zone)
+	if !ok {
+		return nil, false
+	}
+	ip, ok := f.allocator.DeviceAddress(id)
+	if !ok || strings.Contains(id, ".") {
+		return reply(header, q, dnsmessage.RCodeNameError, nil), true
+	}
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeALL {
+		return reply(header, q, dnsmessage.RCodeSuccess, nil), true
+	}
+	var a dnsmessage.AResource
+	copy(a.A[:], ip.To4())
+	return reply(header, q, dnsmessage.RCodeSuccess, &a), true
+}
+
+// reply builds an authoritative response with an optional A record
+func reply(header dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, a *dnsmessage.AResource) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      rcode != dnsmessage.RCodeServerFailure,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	if a != nil {
+		b.StartAnswers()
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}, *a)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// forward passes the query to the upstream servers in turn and returns the
+// first response
+func (f *dnsForwarder) forward(query []byte, network string, upstream []string) ([]byte, error) {
+	err := errors.New("no upstream DNS server")
+	for _, addr := range upstream {
+		var resp []byte
+		resp, err = exchange(query, network, addr)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+func exchange(query []byte, network string, addr string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, addr, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if network == "tcp" {
+		err = writeTCPMessage(conn, query)
+		if err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// DNS over TCP prefixes every message with its length
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testQuery returns a query for name of type typ
+func testQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// parseReply returns the header and the A records of a response
+func parseReply(t *testing.T, b []byte) (dnsmessage.Header, []net.IP) {
+	var m dnsmessage.Message
+	if err := m.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	var ips []net.IP
+	for _, a := range m.Answers {
+		if r, ok := a.Body.(*dnsmessage.AResource); ok {
+			ips = append(ips, net.IP(r.A[:]))
+		}
+	}
+	return m.Header, ips
+}
+
+// testUpstream serves answers with the A record 192.0.2.53 to every query
+// and returns its address
+func testUpstream(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, dnsMaxSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(reply(header, q, dnsmessage.RCodeSuccess, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 53}}), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// closedPort returns an address of a UDP port nothing listens on
+func closedPort(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+// setDNSSettings uses c for the duration of the test
+func setDNSSettings(t *testing.T, c internal.IDNSConfig) {
+	prev := dnsSettings.Load()
+	t.Cleanup(func() { dnsSettings.Store(prev) })
+	dnsSettings.Store(&c)
+}
+
+func TestResolveLocal(t *testing.T) {
+	allocator := newTestAllocator(t)
+	cidr, _, err := allocator.RegisterDevice("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, _ := net.ParseCIDR(cidr)
+	f := &dnsForwarder{allocator: allocator}
+	for _, c := range []struct {
+		name  string
+		typ   dnsmessage.Type
+		local bool
+		rcode dnsmessage.RCode
+		ip    net.IP
+	}{
+		{"laptop.xtun.", dnsmessage.TypeA, true, dnsmessage.RCodeSuccess, laptop},
+		{"LAPTOP.Xtun.", dnsmessage.TypeA, true, dnsmessage.RCodeSuccess, laptop},
+		{"laptop.xtun.", dnsmessage.TypeAAAA, true, dnsmessage.RCodeSuccess, nil},
+		{"xtun.", dnsmessage.TypeA, true, dnsmessage.RCodeSuccess, nil},
+		{"phone.xtun.", dnsmessage.TypeA, true, dnsmessage.RCodeNameError, nil},
+		{"www.laptop.xtun.", dnsmessage.TypeA, true, dnsmessage.RCodeNameError, nil},
+		{"example.com.", dnsmessage.TypeA, false, 0, nil},
+		{"laptopxtun.", dnsmessage.TypeA, false, 0, nil},
+	} {
+		var p dnsmessage.Parser
+		header, _ := p.Start(testQuery(t, c.name, c.typ))
+		q, _ := p.Question()
+		resp, ok := f.resolveLocal(header, q, ".xtun.")
+		if ok != c.local {
+			t.Errorf("%s: answered locally %v", c.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		h, ips := parseReply(t, resp)
+		if h.ID != 42 || !h.Response || !h.Authoritative || h.RCode != c.rcode {
+			t.Errorf("%s: header %+v", c.name, h)
+		}
+		if c.ip == nil && len(ips) != 0 || c.ip != nil && (len(ips) != 1 || !ips[0].Equal(c.ip)) {
+			t.Errorf("%s: records %v", c.name, ips)
+		}
+	}
+}
+
+func TestHandleUpstreamFallback(t *testing.T) {
+	f := &dnsForwarder{allocator: newTestAllocator(t)}
+	setDNSSettings(t, internal.IDNSConfig{Zone: "xtun", Upstream: []string{closedPort(t), testUpstream(t)}})
+	h, ips := parseReply(t, f.handle(testQuery(t, "example.com.", dnsmessage.TypeA), "udp"))
+	if h.RCode != dnsmessage.RCodeSuccess || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 53)) {
+		t.Fatalf("answer %+v %v", h, ips)
+	}
+	// Names in the zone are never forwarded
+	h, _ = parseReply(t, f.handle(testQuery(t, "unknown.xtun.", dnsmessage.TypeA), "udp"))
+	if h.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("unknown device: %v", h.RCode)
+	}
+
+	setDNSSettings(t, internal.IDNSConfig{Zone: "xtun", Upstream: []string{closedPort(t)}})
+	h, _ = parseReply(t, f.handle(testQuery(t, "example.com.", dnsmessage.TypeA), "udp"))
+	if h.RCode != dnsmessage.RCodeServerFailure || h.Authoritative {
+		t.Fatalf("no upstream: %+v", h)
+	}
+	if f.handle([]byte{0, 1, 2}, "udp") != nil {
+		t.Fatal("malformed query answered")
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	allocator := newTestAllocator(t)
+	if _, _, err := allocator.RegisterDevice("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	setDNSSettings(t, internal.IDNSConfig{Zone: "xtun", Upstream: []string{testUpstream(t)}})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go (&dnsForwarder{allocator: allocator}).serveUDP(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// More queries than are answered at once, buffers are reused
+	names := []string{"laptop.xtun.", "example.com.", "phone.xtun."}
+	const queries = 2 * dnsMaxQueries
+	expected := make(map[dnsmessage.RCode]int)
+	for i := 0; i < queries; i++ {
+		name := names[i%len(names)]
+		if _, err := client.Write(testQuery(t, name, dnsmessage.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		if name == "phone.xtun." {
+			expected[dnsmessage.RCodeNameError]++
+		} else {
+			expected[dnsmessage.RCodeSuccess]++
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rcodes := make(map[dnsmessage.RCode]int)
+	buf := make([]byte, dnsMaxSize)
+	for i := 0; i < queries; i++ {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("%d of %d answers: %v", i, queries, err)
+		}
+		h, _ := parseReply(t, buf[:n])
+		rcodes[h.RCode]++
+	}
+	if rcodes[dnsmessage.RCodeSuccess] != expected[dnsmessage.RCodeSuccess] || rcodes[dnsmessage.RCodeNameError] != expected[dnsmessage.RCodeNameError] {
+		t.Fatalf("answers %v, expected %v", rcodes, expected)
+	}
+}
@@ -0,0 +1,158 @@
+// File: server/frame.go
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/gobwas/ws"
+)
+
+// maxMessageSize bounds a message received from a client, it fits the
+// largest batch and packet
+const maxMessageSize = 2 << 20
+
+var errMessageSize = errors.New("message too large")
+var errUnmasked = errors.New("unmasked client frame")
+
+// frameReader reads WebSocket messages of a client into a buffer which is
+// reused for every message, unlike `wsutil.ReadClientData` it does not
+// allocate once the buffer has grown to the size of the largest message
+type frameReader struct {
+	r      *bufio.Reader
+	header [ws.MaxHeaderSize]byte
+	buf    []byte
+	// payload holds control frames, it would escape to the heap on every
+	// frame as a local variable
+	payload [125]byte
+	// control answers ping and close frames
+	control func(op ws.OpCode, payload []byte) error
+}
+
+func newFrameReader(r io.Reader, control func(op ws.OpCode, payload []byte) error) *frameReader {
+	return &frameReader{
+		r:       bufio.NewReaderSize(r, 64*1024),
+		control: control,
+	}
+}
+
+// next returns the next text or binary message, it is valid until the
+// following call. Control frames are handled in between, a close frame
+// ends reading with io.EOF.
+func (fr *frameReader) next() ([]byte, ws.OpCode, error) {
+	fr.buf = fr.buf[:0]
+	var op ws.OpCode
+	for {
+		fin, frameOp, length, mask, err := fr.readHeader()
+		if err != nil {
+			return nil, 0, err
+		}
+		if frameOp.IsControl() {
+			if !fin || length > int64(len(fr.payload)) {
+				return nil, 0, ws.ErrProtocolControlPayloadOverflow
+			}
+			p := fr.payload[:length]
+			_, err = io.ReadFull(fr.r, p)
+			if err != nil {
+				return nil, 0, err
+			}
+			ws.Cipher(p, mask, 0)
+			err = fr.control(frameOp, p)
+			if err != nil {
+				return nil, 0, err
+			}
+			if frameOp == ws.OpClose {
+				return nil, 0, io.EOF
+			}
+			continue
+		}
+		if frameOp == ws.OpContinuation {
+			if op == 0 {
+				return nil, 0, ws.ErrProtocolContinuationUnexpected
+			}
+		} else {
+			if op != 0 {
+				return nil, 0, ws.ErrProtocolContinuationExpected
+			}
+			op = frameOp
+		}
+		if int64(len(fr.buf))+length > maxMessageSize {
+			return nil, 0, errMessageSize
+		}
+		start := len(fr.buf)
+		fr.buf = grow(fr.buf, int(length))[:start+int(length)]
+		_, err = io.ReadFull(fr.r, fr.buf[start:])
+		if err != nil {
+			return nil, 0, err
+		}
+		ws.Cipher(fr.buf[start:], mask, 0)
+		if fin {
+			return fr.buf, op, nil
+		}
+	}
+}
+
+func (fr *frameReader) readHeader() (fin bool, op ws.OpCode, length int64, mask [4]byte, err error) {
+	h := fr.header[:2]
+	_, err = io.ReadFull(fr.r, h)
+	if err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = ws.OpCode(h[0] & 0x0f)
+	if h[0]&0x70 != 0 {
+		err = ws.ErrProtocolNonZeroRsv
+		return
+	}
+	// Clients must mask every frame
+	if h[1]&0x80 == 0 {
+		err = errUnmasked
+		return
+	}
+	extra := 4
+	switch h[1] & 0x7f {
+	case 126:
+		extra += 2
+	case 127:
+		extra += 8
+	}
+	e := fr.header[2 : 2+extra]
+	_, err = io.ReadFull(fr.r, e)
+	if err != nil {
+		return
+	}
+	switch h[1] & 0x7f {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(e))
+		e = e[2:]
+	case 127:
+		length = int64(binary.BigEndian.Uint64(e))
+		e = e[8:]
+	default:
+		length = int64(h[1] & 0x7f)
+	}
+	if length < 0 {
+		err = errMessageSize
+		return
+	}
+	copy(mask[:], e)
+	return
+}
+
+// appendFrame appends an unmasked single frame message as sent by a server
+func appendFrame(dst []byte, op ws.OpCode, payload []byte) []byte {
+	n := len(payload)
+	switch {
+	case n < 126:
+		dst = append(dst, 0x80|byte(op), byte(n))
+	case n <= 0xffff:
+		dst = append(dst, 0x80|byte(op), 126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	default:
+		dst = append(dst, 0x80|byte(op), 127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(n))
+	}
+	return append(dst, payload...)
+}
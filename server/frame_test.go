@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+// appendClientFrame appends a masked single frame message as sent by a client
+func appendClientFrame(dst []byte, op ws.OpCode, payload []byte) []byte {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	n := len(payload)
+	switch {
+	case n < 126:
+		dst = append(dst, 0x80|byte(op), 0x80|byte(n))
+	case n <= 0xffff:
+		dst = append(dst, 0x80|byte(op), 0x80|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	default:
+		dst = append(dst, 0x80|byte(op), 0x80|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(n))
+	}
+	dst = append(dst, mask[:]...)
+	start := len(dst)
+	dst = append(dst, payload...)
+	ws.Cipher(dst[start:], mask, 0)
+	return dst
+}
+
+// loopReader reads the same data over and over
+type loopReader struct {
+	data []byte
+	off  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func TestFrameReader(t *testing.T) {
+	packet := testPacket(1400)
+	var stream []byte
+	stream = appendClientFrame(stream, ws.OpBinary, packet)
+	stream = appendClientFrame(stream, ws.OpPing, []byte("ping"))
+	// A message split into a text frame and a continuation
+	stream = append(stream, 0x01, 0x80|3, 0, 0, 0, 0, 'a', 'b', 'c')
+	stream = append(stream, 0x80, 0x80|1, 0, 0, 0, 0, 'd')
+	stream = appendClientFrame(stream, ws.OpBinary, testPacket(maxPacketSize))
+	stream = appendClientFrame(stream, ws.OpClose, []byte{0x03, 0xe8})
+
+	var pings int
+	fr := newFrameReader(bytes.NewReader(stream), func(op ws.OpCode, payload []byte) error {
+		if op == ws.OpPing {
+			pings++
+		}
+		return nil
+	})
+	expect := []struct {
+		op      ws.OpCode
+		payload []byte
+	}{
+		{ws.OpBinary, packet},
+		{ws.OpText, []byte("abcd")},
+		{ws.OpBinary, testPacket(maxPacketSize)},
+	}
+	for i, e := range expect {
+		b, op, err := fr.next()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if op != e.op || !bytes.Equal(b, e.payload) {
+			t.Fatalf("message %d: got %v of %d bytes", i, op, len(b))
+		}
+	}
+	_, _, err := fr.next()
+	if err != io.EOF {
+		t.Fatalf("close frame: %v", err)
+	}
+	if pings != 1 {
+		t.Fatalf("%d pings handled", pings)
+	}
+}
+
+func TestFrameReaderRejectsUnmasked(t *testing.T) {
+	stream := appendFrame(nil, ws.OpBinary, testPacket(64))
+	fr := newFrameReader(bytes.NewReader(stream), nil)
+	_, _, err := fr.next()
+	if err != errUnmasked {
+		t.Fatalf("unmasked frame: %v", err)
+	}
+}
+
+func TestFrameReaderAllocs(t *testing.T) {
+	stream := appendClientFrame(nil, ws.OpBinary, testPacket(1400))
+	stream = appendClientFrame(stream, ws.OpPing, []byte("ping"))
+	fr := newFrameReader(&loopReader{data: stream}, func(op ws.OpCode, payload []byte) error { return nil })
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _, err := fr.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per message", allocs)
+	}
+}
+
+func BenchmarkFrameReader(b *testing.B) {
+	for _, size := range []int{64, 1400, 16 * 1024} {
+		b.Run(byteSize(size), func(b *testing.B) {
+			stream := appendClientFrame(nil, ws.OpBinary, testPacket(size))
+			fr := newFrameReader(&loopReader{data: stream}, nil)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := fr.next()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// byteSize names a sub-benchmark after a size in bytes
+func byteSize(n int) string {
+	return fmt.Sprintf("%dB", n)
+}
@@ -2,46 +2,218 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/xorgal/xtun-core/pkg/config"
 	"github.com/xorgal/xtun-core/pkg/tun"
 	"github.com/xorgal/xtund/internal"
 )
 
+// headerAdminKey carries the admin key in requests to the admin API
+const headerAdminKey = "X-Xtun-Admin-Key"
+
+// adminKey grants access to the admin API, it is updated on configuration
+// reload
+var adminKey atomic.Pointer[string]
+
+// shutdownTimeout bounds the time given to in-flight API requests on exit
+const shutdownTimeout = 5 * time.Second
+
 func InitProtocol(config config.Config) {
 	_, err := internal.CreateAllocator(config.CIDR)
 	if err != nil {
 		log.Fatal(err)
 	}
+	config.MTU = internal.EffectiveMTU(config)
 	tun.CreateTunInterface(config)
 }
 
+// StartServer runs the server until SIGINT or SIGTERM is received
 func StartServer(config config.Config) {
-	iface, err := tun.CreateTunInterface(config)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := Run(ctx, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Run starts the server and blocks until ctx is done or the listener fails.
+// The TUN device and the allocator are released before returning.
+func Run(ctx context.Context, config config.Config) error {
+	safeMTU := internal.TunnelMTU(internal.DaemonConfig.LinkMTU, config.Protocol)
+	if config.MTU > safeMTU {
+		slog.Warn("MTU exceeds the link MTU less transport overhead, tunnel traffic will be fragmented", "mtu", config.MTU, "safe", safeMTU)
+	}
+	config.MTU = internal.EffectiveMTU(config)
+	err := internal.ValidateTunQueues(internal.DaemonConfig.TunQueues)
+	if err != nil {
+		return err
+	}
+	queues, err := internal.CreateTunQueues(config, internal.DaemonConfig.TunQueues, internal.DaemonConfig.TunOffload)
 	if err != nil {
-		log.Fatalf("failed to create tun device: %v", err)
+		return fmt.Errorf("failed to create tun device: %v", err)
 	}
+	defer internal.CloseTunQueues(queues)
 	allocator, err := internal.CreateAllocator(config.CIDR)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer allocator.Close()
+	audit, err := internal.OpenAuditLog(internal.FilePath.AuditPath)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer audit.Close()
+	internal.SetAuditLog(audit)
+	defer internal.SetAuditLog(nil)
+	seq, head := audit.Head()
+	slog.Info("Audit log opened", "path", internal.FilePath.AuditPath, "seq", seq, "head", head)
+
+	admin := internal.DaemonConfig.AdminKey
+	err = internal.ValidateAdminKey(admin, config.Key)
+	if err != nil {
+		return err
+	}
+	if admin == "" {
+		slog.Warn("admin key is not configured, the admin API is disabled")
+	}
+	adminKey.Store(&admin)
+	rl := internal.DaemonConfig.RateLimit
+	err = rl.Validate()
+	if err != nil {
+		return err
+	}
+	defaultRateLimit.Store(&rl)
+	quota := internal.DaemonConfig.Quota
+	err = quota.Validate()
+	if err != nil {
+		return err
+	}
+	defaultQuota.Store(&quota)
+	policy, err := compileACL(internal.DaemonConfig.ACL)
+	if err != nil {
+		return err
+	}
+	setACL(policy)
+	peerPolicy, err := compilePeers(internal.DaemonConfig.Peers, internal.DaemonConfig.ACL.Groups)
+	if err != nil {
+		return err
+	}
+	peers.Store(peerPolicy)
+	routes := internal.DaemonConfig.Routes
+	err = routes.Validate()
+	if err != nil {
+		return err
+	}
+	pushedRoutes.Store(&routes)
+	err = setTunnelNetwork(config.CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %s: %v", config.CIDR, err)
+	}
+	codecs := internal.DaemonConfig.Codecs
+	err = internal.ValidateCodecs(codecs)
+	if err != nil {
+		return err
+	}
+	offeredCodecs.Store(&codecs)
+	batch := internal.DaemonConfig.Batch
+	err = batch.Validate()
+	if err != nil {
+		return err
+	}
+	batchSettings.Store(&batch)
+	queue := internal.DaemonConfig.Queue
+	err = queue.Validate()
+	if err != nil {
+		return err
+	}
+	queueSettings.Store(&queue)
+	keepalive := internal.DaemonConfig.Keepalive
+	err = keepalive.Validate()
+	if err != nil {
+		return err
+	}
+	keepaliveSettings.Store(&keepalive)
+	resume := internal.DaemonConfig.Resume
+	err = resume.Validate()
+	if err != nil {
+		return err
+	}
+	resumeSettings.Store(&resume)
+	links := internal.DaemonConfig.Links
+	err = links.Validate()
+	if err != nil {
+		return err
+	}
+	linkSettings.Store(&links)
+	dns := internal.DaemonConfig.DNS
+	err = dns.Validate()
+	if err != nil {
+		return err
+	}
+	dnsSettings.Store(&dns)
+	if dns.Forwarder {
+		err = startDNS(ctx, allocator)
+		if err != nil {
+			return fmt.Errorf("failed to start DNS forwarder: %v", err)
+		}
 	}
 
 	initAPIRoutes(config, allocator)
-	initWebSocket(config, iface)
+	tunnels := newTunnelServer(config, newTunDevice(queues, internal.DaemonConfig.TunOffload), allocator)
+	initWebSocket(tunnels)
+	err = tunnels.listenRaw(ctx, internal.DaemonConfig.Listeners)
+	if err != nil {
+		return err
+	}
+	go watchReload()
+	go watchQuota(ctx, allocator)
 
-	log.Printf("Starting server on: %v...", config.ServerAddr)
-	log.Fatal(http.ListenAndServe(config.ServerAddr, nil))
+	srv := &http.Server{Addr: config.ServerAddr}
+	go func() {
+		<-ctx.Done()
+		// Shutdown does not close hijacked connections
+		tunnels.closeConns()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Starting server", "addr", config.ServerAddr, "version", internal.AppVersion, "tunQueues", len(queues), "tunOffload", internal.DaemonConfig.TunOffload)
+	err = srv.ListenAndServe()
+	flushUsage(allocator, sessions.all())
+	if errors.Is(err, http.ErrServerClosed) {
+		slog.Info("Server stopped")
+		return nil
+	}
+	return err
 }
 
-// checkPermission checks the permission of the request
-func checkPermission(w http.ResponseWriter, req *http.Request, config config.Config) bool {
-	if config.Key == "" {
+// authenticate checks the key in the headers of a client, failures are
+// audited with the path or transport the client used, see `auditAuthFailure`
+func authenticate(config config.Config, header http.Header, remote string, path string) bool {
+	if config.Key == "" || header.Get("key") == config.Key {
 		return true
 	}
-	key := req.Header.Get("key")
-	if key != config.Key {
+	auditAuthFailure(remote, "path", path)
+	return false
+}
+
+// checkPermission checks the permission of the request
+func checkPermission(w http.ResponseWriter, req *http.Request, config config.Config) bool {
+	if !authenticate(config, req.Header, req.RemoteAddr, req.URL.Path) {
 		response := ErrorResponse{
 			Message: "not permitted",
 		}
@@ -50,3 +222,20 @@ func checkPermission(w http.ResponseWriter, req *http.Request, config config.Con
 	}
 	return true
 }
+
+// checkAdmin checks the admin key of a request to the admin API. The client
+// key is not accepted, any client knows it.
+func checkAdmin(w http.ResponseWriter, req *http.Request) bool {
+	key := *adminKey.Load()
+	given := req.Header.Get(headerAdminKey)
+	if key != "" && subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+		return true
+	}
+	auditAuthFailure(req.RemoteAddr, "path", req.URL.Path, "admin", true)
+	message := "not permitted"
+	if key == "" {
+		message = "admin key is not configured"
+	}
+	sendJsonResponse(w, http.StatusForbidden, ErrorResponse{Message: message})
+	return false
+}
@@ -0,0 +1,72 @@
+// File: server/keepalive.go
+package server
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/xorgal/xtund/internal"
+)
+
+// keepaliveSettings apply to new sessions, they are updated on configuration
+// reload
+var keepaliveSettings atomic.Pointer[internal.IKeepaliveConfig]
+
+// The built-in settings apply until `Run` stores the configured ones
+func init() {
+	keepalive := internal.DaemonConfig.Keepalive
+	keepaliveSettings.Store(&keepalive)
+}
+
+// deadlineResolution is how often the read deadline of a session moves
+const deadlineResolution = time.Second
+
+// keepalive pings the client on the link every interval until it is
+// detached. Pings carry the time they were sent to measure the round-trip
+// time.
+func (l *link) keepalive(interval time.Duration) {
+	defer l.serving.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var payload [8]byte
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-t.C:
+			binary.BigEndian.PutUint64(payload[:], uint64(now.UnixNano()))
+			err := l.writeMessage(ws.OpPing, payload[:])
+			if err != nil {
+				l.s.log().Debug("failed to ping client", "err", err, "via", l.remote)
+				l.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// pong records the round-trip time of a ping of the link, the session
+// reports the latest of all its links
+func (l *link) pong(payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	rtt := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(payload))))
+	if rtt >= 0 && rtt < time.Minute {
+		l.rtt.Store(int64(rtt))
+		l.s.rtt.Store(int64(rtt))
+	}
+}
+
+// touch records activity of the client and extends the read deadline of the
+// link, it is only called by the goroutine reading from the link
+func (l *link) touch() {
+	now := time.Now()
+	l.s.lastSeen.Store(now.Unix())
+	if l.idleTimeout > 0 && now.Sub(l.deadlineSet) >= deadlineResolution {
+		l.conn.SetReadDeadline(now.Add(l.idleTimeout))
+		l.deadlineSet = now
+	}
+}
@@ -0,0 +1,258 @@
+// File: server/link.go
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/xorgal/xtund/internal"
+)
+
+// linkSettings apply to connections joining from then on, they are updated
+// on configuration reload
+var linkSettings atomic.Pointer[internal.ILinksConfig]
+
+var errSessionGone = errors.New("session has no connection left")
+var errTooManyLinks = errors.New("too many connections to the session")
+
+// link is one connection of a session. Clients may join several connections
+// to a session, packets to the client are spread over them by flow and the
+// session survives the loss of all but one.
+type link struct {
+	s         *session
+	conn      net.Conn
+	transport transport
+	remote    string
+	created   time.Time
+	// queue holds frames for the writer goroutine of the link
+	queue *writeQueue
+	batch *batcher
+	// writeMu serializes writes of the writer goroutine, batch timers and
+	// control frames. wbuf holds the message being written.
+	writeMu sync.Mutex
+	wbuf    []byte
+	// reader, decoded, gro and deadlineSet are only accessed by the
+	// goroutine reading from the client
+	reader      messageReader
+	decoded     []byte
+	gro         *groBuffer
+	idleTimeout time.Duration
+	deadlineSet time.Time
+
+	// rtt is the round-trip time of the last ping in nanoseconds
+	rtt          atomic.Int64
+	writtenBytes atomic.Uint64
+	// done stops the goroutines serving the link
+	done    chan struct{}
+	serving sync.WaitGroup
+}
+
+// maxLinks returns the number of connections a session may have
+func maxLinks() int {
+	if p := linkSettings.Load(); p != nil {
+		return p.Max
+	}
+	return 1
+}
+
+// attach serves the session on conn as well. Joining fails if the session
+// lost its last connection meanwhile, it is resumed with its ticket then.
+func (s *session) attach(conn net.Conn, tr transport, remote string, join bool) (*link, error) {
+	s.linksMu.Lock()
+	defer s.linksMu.Unlock()
+	links := *s.links.Load()
+	if join && len(links) == 0 {
+		return nil, errSessionGone
+	}
+	if len(links) >= maxLinks() {
+		return nil, errTooManyLinks
+	}
+	l := &link{
+		s:         s,
+		conn:      conn,
+		transport: tr,
+		remote:    remote,
+		created:   time.Now(),
+		queue:     newWriteQueue(s.queueConfig, s.mtu),
+		done:      make(chan struct{}),
+	}
+	l.reader = tr.reader(l.control)
+	if s.batched {
+		l.batch = newBatcher(*batchSettings.Load(), l.write, func(err error) {
+			s.log().Debug("failed to write batch to client", "err", err, "via", remote)
+			l.closeConn()
+		})
+	}
+	keepalive := keepaliveSettings.Load()
+	l.idleTimeout = time.Duration(keepalive.Timeout) * time.Second
+	l.serving.Add(1)
+	go l.writeLoop()
+	if keepalive.Interval > 0 {
+		l.serving.Add(1)
+		go l.keepalive(time.Duration(keepalive.Interval) * time.Second)
+	}
+	s.links.Store(appendLink(links, l))
+	s.mu.Lock()
+	s.remote = remote
+	s.mu.Unlock()
+	return l, nil
+}
+
+// detach stops serving l and closes its connection. Frames queued on it are
+// moved to the backlog of the session, which the remaining links send. It
+// returns the number of links left.
+func (s *session) detach(l *link) int {
+	s.linksMu.Lock()
+	links := *s.links.Load()
+	left := make([]*link, 0, len(links))
+	for _, other := range links {
+		if other != l {
+			left = append(left, other)
+		}
+	}
+	s.links.Store(&left)
+	s.linksMu.Unlock()
+
+	// Frames pushed from now on go to the remaining links
+	l.queue.close()
+	close(l.done)
+	l.closeConn()
+	l.serving.Wait()
+	if l.batch != nil {
+		l.batch.stop()
+	}
+	l.queue.drain(func(f queuedFrame) {
+		if s.backlog.push(f) != nil {
+			putBuffer(f.buf)
+			s.countQueueDropped()
+		}
+	})
+	return len(left)
+}
+
+// appendLink returns a copy of links with l added, the slice read by the data
+// path is never modified
+func appendLink(links []*link, l *link) *[]*link {
+	list := make([]*link, 0, len(links)+1)
+	list = append(list, links...)
+	list = append(list, l)
+	return &list
+}
+
+// pick returns the link for packets of flow, nil if the session has no
+// connection
+func (s *session) pick(flow uint32) *link {
+	links := *s.links.Load()
+	switch len(links) {
+	case 0:
+		return nil
+	case 1:
+		return links[0]
+	}
+	return links[flow%uint32(len(links))]
+}
+
+// closeConn closes the connection of the link
+func (l *link) closeConn() {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	l.conn.Close()
+}
+
+// send adds a frame to the batch if the session is batched and writes it
+// right away otherwise
+func (l *link) send(frame []byte) error {
+	if l.batch != nil {
+		return l.batch.add(frame)
+	}
+	return l.write(frame)
+}
+
+// write sends a binary message to the client
+func (l *link) write(b []byte) error {
+	return l.writeMessage(ws.OpBinary, b)
+}
+
+// writeMessage sends a message in a single frame and a single write
+func (l *link) writeMessage(op ws.OpCode, b []byte) error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	l.wbuf = l.transport.appendMessage(l.wbuf[:0], op, b)
+	if l.s.writeTimeout > 0 {
+		l.conn.SetWriteDeadline(time.Now().Add(l.s.writeTimeout))
+	}
+	_, err := l.conn.Write(l.wbuf)
+	if cap(l.wbuf) > maxMessageSize {
+		l.wbuf = nil
+	}
+	return err
+}
+
+// control answers control frames of the client
+func (l *link) control(op ws.OpCode, payload []byte) error {
+	l.touch()
+	switch op {
+	case ws.OpPong:
+		l.pong(payload)
+	case ws.OpPing:
+		return l.writeMessage(ws.OpPong, payload)
+	case ws.OpClose:
+		// Echo the status code, the reason is not required
+		l.writeMessage(ws.OpClose, payload[:min(len(payload), 2)])
+	}
+	return nil
+}
+
+func (l *link) response() LinkResponse {
+	return LinkResponse{
+		Remote:       l.remote,
+		Transport:    l.transport.name(),
+		Since:        l.created.Unix(),
+		WrittenBytes: l.writtenBytes.Load(),
+		QueueDepth:   l.queue.depth(),
+		QueueBytes:   l.queue.queuedBytes(),
+		RTT:          float64(l.rtt.Load()) / float64(time.Millisecond),
+	}
+}
+
+// flowHash hashes addresses, protocol and ports of a packet with FNV-1a, so
+// packets of a flow take the same link and stay in order
+func flowHash(b []byte) uint32 {
+	var fields []byte
+	var proto byte
+	var transport []byte
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		ihl, ok := ipv4HeaderLen(b)
+		proto = b[9]
+		fields = b[12:20]
+		// Fragments of a packet take the same link, only the first has ports
+		if ok && binary.BigEndian.Uint16(b[6:8])&0x3fff == 0 && len(b) >= ihl+4 {
+			transport = b[ihl : ihl+4]
+		}
+	case len(b) >= 40 && b[0]>>4 == 6:
+		proto = b[6]
+		fields = b[8:40]
+		if len(b) >= 44 {
+			transport = b[40:44]
+		}
+	default:
+		return 0
+	}
+	h := uint32(2166136261)
+	for _, c := range fields {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	h = (h ^ uint32(proto)) * 16777619
+	if proto == 6 || proto == 17 {
+		for _, c := range transport {
+			h = (h ^ uint32(c)) * 16777619
+		}
+	}
+	return h
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// setMaxLinks allows n links per session for the duration of the test
+func setMaxLinks(t *testing.T, n int) {
+	prev := linkSettings.Load()
+	t.Cleanup(func() { linkSettings.Store(prev) })
+	linkSettings.Store(&internal.ILinksConfig{Max: n})
+}
+
+// attachPipe attaches a raw link on a pipe to s, it returns the link and the
+// client end of the pipe
+func attachPipe(t *testing.T, s *session, join bool) (*link, net.Conn, error) {
+	server, client := net.Pipe()
+	l, err := s.attach(server, &rawTransport{transport: "raw", r: bufio.NewReader(server)}, "pipe", join)
+	if err != nil {
+		server.Close()
+		client.Close()
+		return nil, nil, err
+	}
+	t.Cleanup(func() { client.Close() })
+	return l, client, nil
+}
+
+// flowPacket returns a packet of the flow to port with seq in its payload
+func flowPacket(port uint16, seq uint32) []byte {
+	b := testPacketTo("10.0.10.2", "192.0.2.1", internal.ProtocolUDP, port)
+	binary.BigEndian.PutUint32(b[28:32], seq)
+	return b
+}
+
+// enqueueFlow queues the packet as deliver does
+func enqueueFlow(s *session, packet []byte) error {
+	buf := getBuffer(maxFrameSize(len(packet)))
+	*buf = s.encodeFrame(*buf, packet)
+	return s.enqueue(buf, len(packet), flowHash(packet))
+}
+
+// readPackets reads n raw frames from conn and returns their packets
+func readPackets(t *testing.T, s *session, conn net.Conn, n int) [][]byte {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	l := &link{s: s}
+	var packets [][]byte
+	header := make([]byte, rawHeaderSize)
+	for i := 0; i < n; i++ {
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			t.Fatalf("packet %d of %d: %v", i, n, err)
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(conn, frame)
+		if err != nil {
+			t.Fatalf("packet %d of %d: %v", i, n, err)
+		}
+		b, err := l.decodeFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, append([]byte(nil), b...))
+	}
+	return packets
+}
+
+func TestAttachJoin(t *testing.T) {
+	setMaxLinks(t, 2)
+	s := newTestSession(internal.CodecNone)
+	t.Cleanup(s.close)
+	if _, _, err := attachPipe(t, s, true); err != errSessionGone {
+		t.Fatalf("join without a link: %v", err)
+	}
+	if _, _, err := attachPipe(t, s, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := attachPipe(t, s, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := attachPipe(t, s, true); err != errTooManyLinks {
+		t.Fatalf("join beyond the maximum: %v", err)
+	}
+	if n := len(*s.links.Load()); n != 2 {
+		t.Fatalf("%d links", n)
+	}
+}
+
+func TestLinkFlows(t *testing.T) {
+	setMaxLinks(t, 2)
+	s := newTestSession(internal.CodecNone)
+	t.Cleanup(s.close)
+	var conns [2]net.Conn
+	for i := range conns {
+		_, conn, err := attachPipe(t, s, i > 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	const flows, perFlow = 16, 8
+	expected := [2]int{}
+	for port := uint16(1); port <= flows; port++ {
+		expected[flowHash(flowPacket(port, 0))%2] += perFlow
+	}
+	if expected[0] == 0 || expected[1] == 0 {
+		t.Fatalf("flows not spread: %v", expected)
+	}
+	// Frames are read from both pipes while they are queued
+	received := make([]chan [][]byte, len(conns))
+	for i, conn := range conns {
+		received[i] = make(chan [][]byte, 1)
+		go func(i int, conn net.Conn) {
+			received[i] <- readPackets(t, s, conn, expected[i])
+		}(i, conn)
+	}
+	for seq := uint32(0); seq < perFlow; seq++ {
+		for port := uint16(1); port <= flows; port++ {
+			if err := enqueueFlow(s, flowPacket(port, seq)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Every flow takes a single link in order
+	next := make(map[uint16]uint32)
+	for i := range conns {
+		for _, p := range <-received[i] {
+			port := binary.BigEndian.Uint16(p[22:24])
+			seq := binary.BigEndian.Uint32(p[28:32])
+			if int(flowHash(p)%2) != i {
+				t.Fatalf("flow %d on link %d", port, i)
+			}
+			if seq != next[port] {
+				t.Fatalf("flow %d: packet %d, expected %d", port, seq, next[port])
+			}
+			next[port]++
+		}
+	}
+	for port := uint16(1); port <= flows; port++ {
+		if next[port] != perFlow {
+			t.Fatalf("flow %d: %d of %d packets", port, next[port], perFlow)
+		}
+	}
+}
+
+func TestLinkFailover(t *testing.T) {
+	setMaxLinks(t, 2)
+	s := newTestSession(internal.CodecNone)
+	t.Cleanup(s.close)
+	lost, lostConn, err := attachPipe(t, s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, conn, err := attachPipe(t, s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A flow of the first link, nobody reads from it so its writer is
+	// stuck on the first packet and the others stay queued
+	port := uint16(1)
+	for flowHash(flowPacket(port, 0))%2 != 0 {
+		port++
+	}
+	const queued = 10
+	for seq := uint32(0); seq < queued; seq++ {
+		if err := enqueueFlow(s, flowPacket(port, seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); lost.queue.depth() != queued-1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets queued", lost.queue.depth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The connection fails, the packet being written is lost
+	lostConn.Close()
+	if left := s.detach(lost); left != 1 {
+		t.Fatalf("%d links left", left)
+	}
+	if err := enqueueFlow(s, flowPacket(port, queued)); err != nil {
+		t.Fatal(err)
+	}
+	// The remaining link sends the queued packets first
+	for i, p := range readPackets(t, s, conn, queued) {
+		if seq := binary.BigEndian.Uint32(p[28:32]); seq != uint32(i+1) {
+			t.Fatalf("packet %d after failover, expected %d", seq, i+1)
+		}
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	udp := func(sport, dport uint16) []byte {
+		b := flowPacket(dport, 0)
+		binary.BigEndian.PutUint16(b[20:22], sport)
+		return b
+	}
+	if flowHash(udp(1000, 53)) != flowHash(udp(1000, 53)) {
+		t.Fatal("packets of a flow hash differently")
+	}
+	if flowHash(udp(1000, 53)) == flowHash(udp(1001, 53)) || flowHash(udp(1000, 53)) == flowHash(udp(53, 1000)) {
+		t.Fatal("ports are not hashed")
+	}
+	// Fragments take the link of their packet
+	first, later := udp(1000, 53), udp(2000, 80)
+	binary.BigEndian.PutUint16(first[6:8], 0x2000)
+	binary.BigEndian.PutUint16(later[6:8], 185)
+	if flowHash(first) != flowHash(later) {
+		t.Fatal("fragments hash differently")
+	}
+	// Ports of other protocols are not hashed
+	other := udp(1000, 53)
+	other[9] = 1
+	other2 := udp(1001, 53)
+	other2[9] = 1
+	if flowHash(other) != flowHash(other2) {
+		t.Fatal("ports of ICMP hashed")
+	}
+
+	v6 := make([]byte, 48)
+	v6[0], v6[6] = 0x60, internal.ProtocolTCP
+	v6[23], v6[39] = 1, 2
+	h := flowHash(v6)
+	binary.BigEndian.PutUint16(v6[40:42], 443)
+	if h == 0 || h == flowHash(v6) {
+		t.Fatal("IPv6 ports are not hashed")
+	}
+
+	// Addresses of malformed headers are hashed without ports
+	malformed, malformed2 := udp(1000, 53), udp(2000, 80)
+	malformed[0], malformed2[0] = 0x41, 0x41
+	if flowHash(malformed) != flowHash(malformed2) {
+		t.Fatal("ports of a malformed header hashed")
+	}
+	for _, b := range [][]byte{nil, make([]byte, 19), {0x60, 0, 0}, make([]byte, 64)} {
+		if flowHash(b) != 0 {
+			t.Fatalf("%d bytes hashed", len(b))
+		}
+	}
+}
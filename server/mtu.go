@@ -0,0 +1,235 @@
+// File: server/mtu.go
+package server
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+)
+
+const (
+	icmpv4DestUnreachable = 3
+	icmpv4FragNeeded      = 4
+	icmpv6PacketTooBig    = 2
+	// ipv6MinMTU is the smallest MTU of IPv6 links
+	ipv6MinMTU = 1280
+	// tcpOptionMSS is the kind of the maximum segment size option
+	tcpOptionMSS = 2
+)
+
+// ipv4HeaderLen returns the header length of an IPv4 packet, false if it is
+// shorter than the minimum header or than the packet itself claims
+func ipv4HeaderLen(packet []byte) (int, bool) {
+	if len(packet) < 20 {
+		return 0, false
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	return ihl, ihl >= 20 && ihl <= len(packet)
+}
+
+// clampMSS lowers the maximum segment size option of a TCP SYN to fit the
+// MTU and fixes the checksum. Other packets are left unchanged.
+func clampMSS(packet []byte, mtu int) {
+	var tcp []byte
+	var max int
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl, ok := ipv4HeaderLen(packet)
+		// Fragments other than the first do not carry a TCP header
+		if !ok || packet[9] != 6 || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 || len(packet) < ihl+20 {
+			return
+		}
+		tcp = packet[ihl:]
+		max = mtu - ihl - 20
+	case len(packet) >= 60 && packet[0]>>4 == 6:
+		if packet[6] != 6 {
+			return
+		}
+		tcp = packet[40:]
+		max = mtu - 60
+	default:
+		return
+	}
+	// SYN flag
+	if tcp[13]&0x02 == 0 {
+		return
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || len(tcp) < offset {
+		return
+	}
+	options := tcp[20:offset]
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == 0 {
+			return
+		}
+		if kind == 1 {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return
+		}
+		if kind == tcpOptionMSS && options[i+1] == 4 {
+			mss := binary.BigEndian.Uint16(options[i+2:])
+			if int(mss) > max {
+				binary.BigEndian.PutUint16(options[i+2:], uint16(max))
+				old, new := mss, uint16(max)
+				// The checksum sums 16 bit words from the start of the
+				// header, a value at an odd offset counts byte swapped
+				if (20+i+2)%2 == 1 {
+					old, new = bits.ReverseBytes16(old), bits.ReverseBytes16(new)
+				}
+				updateChecksum(tcp[16:18], old, new)
+			}
+			return
+		}
+		i += int(options[i+1])
+	}
+}
+
+// updateChecksum adjusts an internet checksum after a 16 bit word changed
+// from old to new (RFC 1624)
+func updateChecksum(field []byte, old uint16, new uint16) {
+	sum := uint32(^binary.BigEndian.Uint16(field)) + uint32(^old) + uint32(new)
+	sum = (sum & 0xffff) + (sum >> 16)
+	sum = (sum & 0xffff) + (sum >> 16)
+	binary.BigEndian.PutUint16(field, ^uint16(sum))
+}
+
+// checksum returns the internet checksum of the data with an initial sum
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// dontFragment reports whether an IPv4 packet may not be fragmented, IPv6
+// packets are never fragmented on the way
+func dontFragment(packet []byte) bool {
+	if packet[0]>>4 == 6 {
+		return true
+	}
+	return len(packet) >= 20 && packet[6]&0x40 != 0
+}
+
+// fragmentIPv4 splits an IPv4 packet into fragments of at most mtu bytes
+func fragmentIPv4(packet []byte, mtu int) [][]byte {
+	ihl, ok := ipv4HeaderLen(packet)
+	if !ok || mtu < ihl+8 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(packet[6:8])
+	offset := int(flags & 0x1fff)
+	payload := packet[ihl:]
+	size := (mtu - ihl) &^ 7
+	var fragments [][]byte
+	for len(payload) > 0 {
+		n := size
+		more := uint16(0x2000)
+		if len(payload) <= n {
+			n = len(payload)
+			// The last fragment keeps the MF flag of a fragmented original
+			more = flags & 0x2000
+		}
+		f := make([]byte, ihl+n)
+		copy(f, packet[:ihl])
+		copy(f[ihl:], payload[:n])
+		binary.BigEndian.PutUint16(f[2:4], uint16(len(f)))
+		binary.BigEndian.PutUint16(f[6:8], more|uint16(offset))
+		f[10], f[11] = 0, 0
+		binary.BigEndian.PutUint16(f[10:12], checksum(f[:ihl], 0))
+		fragments = append(fragments, f)
+		payload = payload[n:]
+		offset += n / 8
+	}
+	return fragments
+}
+
+// tooBig returns an ICMP "fragmentation needed" or ICMPv6 "packet too big"
+// error telling the source of packet to use mtu. The error is sent from src,
+// nil is returned for packets which must not trigger an error.
+func tooBig(packet []byte, mtu int, src net.IP) []byte {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl, ok := ipv4HeaderLen(packet)
+		if !ok {
+			return nil
+		}
+		// Never answer ICMP errors with ICMP errors
+		if packet[9] == 1 && len(packet) > ihl && isICMPError(packet[ihl]) {
+			return nil
+		}
+		return icmpv4TooBig(packet, mtu, src)
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		if packet[6] == 58 && len(packet) > 40 && packet[40] < 128 {
+			return nil
+		}
+		if mtu < ipv6MinMTU {
+			mtu = ipv6MinMTU
+		}
+		return icmpv6TooBig(packet, mtu)
+	}
+	return nil
+}
+
+func isICMPError(t byte) bool {
+	return t == 3 || t == 4 || t == 5 || t == 11 || t == 12
+}
+
+// icmpv4TooBig expects a packet with a valid header, see `ipv4HeaderLen`
+func icmpv4TooBig(packet []byte, mtu int, src net.IP) []byte {
+	ihl, _ := ipv4HeaderLen(packet)
+	// The original header and 8 bytes of its payload
+	quote := packet[:min(len(packet), ihl+8)]
+	b := make([]byte, 20+8+len(quote))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = 1
+	copy(b[12:16], src.To4())
+	copy(b[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:20], 0))
+	icmp := b[20:]
+	icmp[0] = icmpv4DestUnreachable
+	icmp[1] = icmpv4FragNeeded
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[8:], quote)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+	return b
+}
+
+// icmpv6TooBig is sent from the destination of packet as the tunnel has no
+// IPv6 address of its own
+func icmpv6TooBig(packet []byte, mtu int) []byte {
+	// The error must fit into the minimum MTU
+	quote := packet[:min(len(packet), ipv6MinMTU-40-8)]
+	b := make([]byte, 40+8+len(quote))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(quote)))
+	b[6] = 58
+	b[7] = 64
+	copy(b[8:24], packet[24:40])
+	copy(b[24:40], packet[8:24])
+	icmp := b[40:]
+	icmp[0] = icmpv6PacketTooBig
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[8:], quote)
+	// Pseudo header of source, destination, length and next header
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	sum += uint32(len(icmp)) + 58
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, sum))
+	return b
+}
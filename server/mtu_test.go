@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// pseudoSum returns the sum of the IPv4 pseudo header of a transport payload
+func pseudoSum(packet []byte, ihl int) uint32 {
+	var sum uint32
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	return sum + uint32(packet[9]) + uint32(len(packet)-ihl)
+}
+
+// testSYN returns an IPv4 TCP SYN carrying the MSS option with valid checksums
+func testSYN(mss uint16) []byte {
+	b := make([]byte, 20+28)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = 6
+	copy(b[12:16], []byte{10, 0, 10, 2})
+	copy(b[16:20], []byte{192, 0, 2, 1})
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:20], 0))
+	tcp := b[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 443)
+	tcp[12] = 7 << 4
+	tcp[13] = 0x02
+	// NOP, MSS, NOP, NOP, NOP
+	tcp[20] = 1
+	tcp[21], tcp[22] = tcpOptionMSS, 4
+	binary.BigEndian.PutUint16(tcp[23:25], mss)
+	tcp[25], tcp[26], tcp[27] = 1, 1, 1
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(tcp, pseudoSum(b, 20)))
+	return b
+}
+
+func TestChecksum(t *testing.T) {
+	// The example of RFC 1071
+	data := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if sum := checksum(data, 0); sum != ^uint16(0xddf2) {
+		t.Fatalf("checksum %#04x", sum)
+	}
+	// An odd length is padded with zero
+	if checksum([]byte{0x12, 0x34, 0x56}, 0) != checksum([]byte{0x12, 0x34, 0x56, 0}, 0) {
+		t.Fatal("odd length")
+	}
+	packet := testPacket(64)
+	binary.BigEndian.PutUint16(packet[10:12], checksum(packet[:20], 0))
+	if checksum(packet[:20], 0) != 0 {
+		t.Fatal("header with its checksum does not sum to zero")
+	}
+	old := binary.BigEndian.Uint16(packet[8:10])
+	packet[8]--
+	updateChecksum(packet[10:12], old, binary.BigEndian.Uint16(packet[8:10]))
+	if checksum(packet[:20], 0) != 0 {
+		t.Fatal("updated checksum does not match the header")
+	}
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	packet := testPacket(1500)
+	binary.BigEndian.PutUint16(packet[4:6], 0x1234)
+	binary.BigEndian.PutUint16(packet[10:12], checksum(packet[:20], 0))
+	fragments := fragmentIPv4(packet, 576)
+	if len(fragments) != 3 {
+		t.Fatalf("%d fragments", len(fragments))
+	}
+	var payload []byte
+	for i, f := range fragments {
+		if len(f) > 576 || int(binary.BigEndian.Uint16(f[2:4])) != len(f) {
+			t.Fatalf("fragment %d: %d bytes, total length %d", i, len(f), binary.BigEndian.Uint16(f[2:4]))
+		}
+		if checksum(f[:20], 0) != 0 {
+			t.Fatalf("fragment %d: invalid header checksum", i)
+		}
+		if binary.BigEndian.Uint16(f[4:6]) != 0x1234 {
+			t.Fatalf("fragment %d: identification changed", i)
+		}
+		flags := binary.BigEndian.Uint16(f[6:8])
+		if int(flags&0x1fff)*8 != len(payload) {
+			t.Fatalf("fragment %d: offset %d, expected %d", i, int(flags&0x1fff)*8, len(payload))
+		}
+		if more := flags&0x2000 != 0; more != (i < len(fragments)-1) {
+			t.Fatalf("fragment %d: more fragments %v", i, more)
+		}
+		payload = append(payload, f[20:]...)
+	}
+	if !bytes.Equal(payload, packet[20:]) {
+		t.Fatal("reassembled payload differs")
+	}
+}
+
+func TestFragmentIPv4Malformed(t *testing.T) {
+	for _, first := range []byte{0x40, 0x41, 0x44} {
+		packet := testPacket(581)
+		packet[0] = first
+		if fragments := fragmentIPv4(packet, 576); fragments != nil {
+			t.Fatalf("header length %d: %d fragments", first&0x0f, len(fragments))
+		}
+	}
+	// A header longer than the packet
+	packet := testPacket(40)
+	packet[0] = 0x4f
+	if fragments := fragmentIPv4(packet, 28); fragments != nil {
+		t.Fatalf("%d fragments", len(fragments))
+	}
+}
+
+func TestClampMSS(t *testing.T) {
+	packet := testSYN(1460)
+	clampMSS(packet, 1400)
+	if mss := binary.BigEndian.Uint16(packet[43:45]); mss != 1360 {
+		t.Fatalf("MSS %d", mss)
+	}
+	if checksum(packet[20:], pseudoSum(packet, 20)) != 0 {
+		t.Fatal("invalid TCP checksum after clamping")
+	}
+
+	// An MSS at an even offset
+	packet = testSYN(1460)
+	copy(packet[40:45], []byte{tcpOptionMSS, 4, packet[43], packet[44], 1})
+	binary.BigEndian.PutUint16(packet[36:38], 0)
+	binary.BigEndian.PutUint16(packet[36:38], checksum(packet[20:], pseudoSum(packet, 20)))
+	clampMSS(packet, 1400)
+	if mss := binary.BigEndian.Uint16(packet[42:44]); mss != 1360 {
+		t.Fatalf("MSS %d", mss)
+	}
+	if checksum(packet[20:], pseudoSum(packet, 20)) != 0 {
+		t.Fatal("invalid TCP checksum after clamping")
+	}
+
+	// A lower MSS is kept
+	packet = testSYN(1200)
+	clampMSS(packet, 1400)
+	if mss := binary.BigEndian.Uint16(packet[43:45]); mss != 1200 {
+		t.Fatalf("MSS %d", mss)
+	}
+
+	// Segments without SYN are not touched
+	packet = testSYN(1460)
+	packet[33] = 0x10
+	original := bytes.Clone(packet)
+	clampMSS(packet, 1400)
+	if !bytes.Equal(packet, original) {
+		t.Fatal("segment without SYN changed")
+	}
+
+	for _, first := range []byte{0x40, 0x41, 0x4f} {
+		packet := testSYN(1460)
+		packet[0] = first
+		original := bytes.Clone(packet)
+		clampMSS(packet, 576)
+		if !bytes.Equal(packet, original) {
+			t.Fatalf("header length %d: packet changed", first&0x0f)
+		}
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	src := net.IPv4(10, 0, 10, 1)
+	packet := testPacket(1500)
+	icmp := tooBig(packet, 1400, src)
+	if icmp == nil {
+		t.Fatal("no ICMP error")
+	}
+	if checksum(icmp[:20], 0) != 0 || checksum(icmp[20:], 0) != 0 {
+		t.Fatal("invalid checksums")
+	}
+	if !bytes.Equal(icmp[12:16], src.To4()) || !bytes.Equal(icmp[16:20], packet[12:16]) {
+		t.Fatal("addresses do not match")
+	}
+	if icmp[20] != icmpv4DestUnreachable || icmp[21] != icmpv4FragNeeded || binary.BigEndian.Uint16(icmp[26:28]) != 1400 {
+		t.Fatalf("ICMP type %d code %d", icmp[20], icmp[21])
+	}
+	if !bytes.Equal(icmp[28:], packet[:28]) {
+		t.Fatal("quoted header differs")
+	}
+
+	// ICMP errors are never answered
+	packet[9] = 1
+	packet[20] = icmpv4DestUnreachable
+	if tooBig(packet, 1400, src) != nil {
+		t.Fatal("ICMP error answered")
+	}
+
+	for _, first := range []byte{0x40, 0x41, 0x4f} {
+		packet := testPacket(30)
+		packet[0] = first
+		if tooBig(packet, 20, src) != nil {
+			t.Fatalf("header length %d: ICMP error", first&0x0f)
+		}
+	}
+
+	packet = make([]byte, 1500)
+	packet[0] = 0x60
+	packet[6] = 17
+	copy(packet[8:24], net.ParseIP("fd00::2"))
+	copy(packet[24:40], net.ParseIP("2001:db8::1"))
+	icmp = tooBig(packet, 1000, src)
+	if icmp == nil || icmp[40] != icmpv6PacketTooBig {
+		t.Fatal("no ICMPv6 error")
+	}
+	if mtu := binary.BigEndian.Uint32(icmp[44:48]); mtu != ipv6MinMTU {
+		t.Fatalf("MTU %d", mtu)
+	}
+	if len(icmp) > ipv6MinMTU {
+		t.Fatalf("ICMPv6 error of %d bytes", len(icmp))
+	}
+	if !bytes.Equal(icmp[8:24], packet[24:40]) || !bytes.Equal(icmp[24:40], packet[8:24]) {
+		t.Fatal("addresses are not swapped")
+	}
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(icmp[i:]))
+	}
+	if checksum(icmp[40:], sum+uint32(len(icmp)-40)+58) != 0 {
+		t.Fatal("invalid ICMPv6 checksum")
+	}
+}
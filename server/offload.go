@@ -0,0 +1,275 @@
+// File: server/offload.go
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// The virtio-net header precedes packets of TUN queues with offloads, see
+// linux/virtio_net.h. It is in native byte order.
+const (
+	vnetHdrLen       = 10
+	vnetFlagNeedCsum = 1
+	vnetGSONone      = 0
+	vnetGSOTCPv4     = 1
+	vnetGSOTCPv6     = 4
+	vnetGSOECN       = 0x80
+	// maxSuperPacket bounds packets passed between the kernel and xtund
+	maxSuperPacket = 65535
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+var errOffload = errors.New("invalid offload packet")
+
+type vnetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func decodeVnetHdr(b []byte) vnetHdr {
+	return vnetHdr{
+		flags:      b[0],
+		gsoType:    b[1],
+		hdrLen:     binary.NativeEndian.Uint16(b[2:]),
+		gsoSize:    binary.NativeEndian.Uint16(b[4:]),
+		csumStart:  binary.NativeEndian.Uint16(b[6:]),
+		csumOffset: binary.NativeEndian.Uint16(b[8:]),
+	}
+}
+
+func (h vnetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// pseudoHeaderSum returns the unfolded sum of the TCP pseudo header of an
+// IPv4 or IPv6 packet for a TCP segment of length bytes
+func pseudoHeaderSum(packet []byte, length int) uint32 {
+	var addrs []byte
+	if packet[0]>>4 == 4 {
+		addrs = packet[12:20]
+	} else {
+		addrs = packet[8:40]
+	}
+	var sum uint32
+	for i := 0; i < len(addrs); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(addrs[i:]))
+	}
+	return sum + 6 + uint32(length)
+}
+
+// splitOffload passes the packets of a super-packet read from the TUN device
+// to fn. TCP segments are split to gsoSize and partial checksums completed.
+// Packets are built in scratch, which fits any packet.
+func splitOffload(hdr vnetHdr, packet []byte, scratch []byte, fn func(b []byte)) error {
+	if hdr.gsoType == vnetGSONone {
+		if hdr.flags&vnetFlagNeedCsum != 0 {
+			start, field := int(hdr.csumStart), int(hdr.csumStart)+int(hdr.csumOffset)
+			if field+2 > len(packet) {
+				return errOffload
+			}
+			sum := checksum(packet[start:], 0)
+			// A zero UDP checksum means none
+			if hdr.csumOffset == 6 && sum == 0 {
+				sum = 0xffff
+			}
+			binary.BigEndian.PutUint16(packet[field:], sum)
+		}
+		fn(packet)
+		return nil
+	}
+	gsoType := hdr.gsoType &^ vnetGSOECN
+	if gsoType != vnetGSOTCPv4 && gsoType != vnetGSOTCPv6 || len(packet) < 20 {
+		return errOffload
+	}
+	v4 := gsoType == vnetGSOTCPv4
+	if v4 != (packet[0]>>4 == 4) {
+		return errOffload
+	}
+	tcpOff := int(hdr.csumStart)
+	if v4 && tcpOff < int(packet[0]&0x0f)*4 || !v4 && tcpOff < 40 || len(packet) < tcpOff+20 {
+		return errOffload
+	}
+	hdrLen := tcpOff + int(packet[tcpOff+12]>>4)*4
+	gsoSize := int(hdr.gsoSize)
+	if gsoSize == 0 || len(packet) < hdrLen {
+		return errOffload
+	}
+	payload := packet[hdrLen:]
+	seq := binary.BigEndian.Uint32(packet[tcpOff+4:])
+	id := binary.BigEndian.Uint16(packet[4:])
+	for i, off := 0, 0; off < len(payload); i++ {
+		n := min(gsoSize, len(payload)-off)
+		seg := scratch[:hdrLen+n]
+		copy(seg, packet[:hdrLen])
+		copy(seg[hdrLen:], payload[off:off+n])
+		if v4 {
+			binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:], checksum(seg[:tcpOff], 0))
+		} else {
+			binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)-40))
+		}
+		tcp := seg[tcpOff:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(off))
+		// FIN and PSH belong to the last segment, CWR to the first
+		if off+n < len(payload) {
+			tcp[13] &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i > 0 {
+			tcp[13] &^= tcpFlagCWR
+		}
+		tcp[16], tcp[17] = 0, 0
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudoHeaderSum(seg, len(tcp))))
+		fn(seg)
+		off += n
+	}
+	return nil
+}
+
+// groBuffer coalesces consecutive segments of a TCP flow received from a
+// client in one batch into a single packet for the TUN device, the kernel
+// segments it again if it is forwarded.
+type groBuffer struct {
+	q *tunQueue
+	// buf holds the virtio-net header and the coalesced packet
+	buf      []byte
+	segments int
+	gsoSize  int
+	tcpOff   int
+	hdrLen   int
+	nextSeq  uint32
+	// closed is set once a segment ended the run, e.g. with PSH
+	closed bool
+}
+
+func newGROBuffer(q *tunQueue) *groBuffer {
+	return &groBuffer{q: q, buf: make([]byte, vnetHdrLen, vnetHdrLen+maxSuperPacket)}
+}
+
+// add writes a packet to the TUN device, TCP segments are held back until
+// the next packet does not continue them or flush is called
+func (g *groBuffer) add(b []byte) {
+	tcpOff, hdrLen, ok := coalescible(b)
+	if ok && g.continues(b, tcpOff, hdrLen) {
+		g.buf = append(g.buf, b[hdrLen:]...)
+		g.segments++
+		g.nextSeq += uint32(len(b) - hdrLen)
+		flags := b[tcpOff+13]
+		if len(b)-hdrLen < g.gsoSize || flags&tcpFlagPSH != 0 {
+			g.buf[vnetHdrLen+tcpOff+13] |= flags & tcpFlagPSH
+			g.closed = true
+		}
+		return
+	}
+	g.flush()
+	if !ok {
+		g.q.Write(b)
+		return
+	}
+	g.buf = append(g.buf, b...)
+	g.segments = 1
+	g.gsoSize = len(b) - hdrLen
+	g.tcpOff = tcpOff
+	g.hdrLen = hdrLen
+	g.nextSeq = binary.BigEndian.Uint32(b[tcpOff+4:]) + uint32(g.gsoSize)
+	g.closed = b[tcpOff+13]&tcpFlagPSH != 0
+}
+
+// coalescible reports whether b is a TCP segment with payload and without
+// flags other than ACK and PSH, IP options or IPv6 extension headers
+func coalescible(b []byte) (tcpOff int, hdrLen int, ok bool) {
+	switch {
+	case len(b) >= 40 && b[0] == 0x45:
+		// No fragments
+		if b[9] != 6 || binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+			return 0, 0, false
+		}
+		tcpOff = 20
+	case len(b) >= 60 && b[0]>>4 == 6:
+		if b[6] != 6 {
+			return 0, 0, false
+		}
+		tcpOff = 40
+	default:
+		return 0, 0, false
+	}
+	hdrLen = tcpOff + int(b[tcpOff+12]>>4)*4
+	flags := b[tcpOff+13]
+	ok = hdrLen >= tcpOff+20 && len(b) > hdrLen && flags&tcpFlagACK != 0 && flags&^(tcpFlagACK|tcpFlagPSH) == 0
+	return tcpOff, hdrLen, ok
+}
+
+// continues reports whether the segment b directly follows the held ones,
+// its headers must match except for lengths, IDs, sequence number, PSH and
+// checksums
+func (g *groBuffer) continues(b []byte, tcpOff int, hdrLen int) bool {
+	if g.segments == 0 || g.closed || tcpOff != g.tcpOff || hdrLen != g.hdrLen {
+		return false
+	}
+	if len(b)-hdrLen > g.gsoSize || len(g.buf)+len(b)-hdrLen > cap(g.buf) {
+		return false
+	}
+	held := g.buf[vnetHdrLen:]
+	if tcpOff == 20 {
+		// Version, TOS, flags, TTL, protocol and addresses
+		if held[1] != b[1] || held[6] != b[6] || !bytes.Equal(held[8:10], b[8:10]) || !bytes.Equal(held[12:20], b[12:20]) {
+			return false
+		}
+	} else if !bytes.Equal(held[:4], b[:4]) || !bytes.Equal(held[6:40], b[6:40]) {
+		return false
+	}
+	h, t := held[tcpOff:hdrLen], b[tcpOff:hdrLen]
+	// Ports, acknowledgement, data offset, window and options
+	return bytes.Equal(h[:4], t[:4]) && bytes.Equal(h[8:13], t[8:13]) && bytes.Equal(h[14:16], t[14:16]) &&
+		bytes.Equal(h[18:], t[18:]) && binary.BigEndian.Uint32(t[4:]) == g.nextSeq
+}
+
+// flush writes the held segments as one packet
+func (g *groBuffer) flush() {
+	if g.segments == 0 {
+		return
+	}
+	packet := g.buf[vnetHdrLen:]
+	hdr := vnetHdr{}
+	if g.segments > 1 {
+		if packet[0]>>4 == 4 {
+			hdr.gsoType = vnetGSOTCPv4
+			binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+			packet[10], packet[11] = 0, 0
+			binary.BigEndian.PutUint16(packet[10:], checksum(packet[:g.tcpOff], 0))
+		} else {
+			hdr.gsoType = vnetGSOTCPv6
+			binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)-40))
+		}
+		hdr.flags = vnetFlagNeedCsum
+		hdr.hdrLen = uint16(g.hdrLen)
+		hdr.gsoSize = uint16(g.gsoSize)
+		hdr.csumStart = uint16(g.tcpOff)
+		hdr.csumOffset = 16
+		// The kernel completes the checksum from the pseudo header sum
+		tcpLen := len(packet) - g.tcpOff
+		binary.BigEndian.PutUint16(packet[g.tcpOff+16:], ^checksum(nil, pseudoHeaderSum(packet, tcpLen)))
+	}
+	hdr.encode(g.buf)
+	g.q.rw.Write(g.buf)
+	g.buf = g.buf[:vnetHdrLen]
+	g.segments = 0
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// testSegment returns a TCP segment with timestamps and valid checksums, id
+// is the identification of IPv4 packets
+func testSegment(v4 bool, id uint16, seq uint32, flags byte, payload []byte) []byte {
+	tcpOff := 40
+	if v4 {
+		tcpOff = 20
+	}
+	b := make([]byte, tcpOff+32+len(payload))
+	if v4 {
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint16(b[4:], id)
+		b[6] = 0x40
+		b[8] = 64
+		b[9] = 6
+		copy(b[12:16], net.ParseIP("192.0.2.1").To4())
+		copy(b[16:20], net.ParseIP("10.0.10.2").To4())
+		binary.BigEndian.PutUint16(b[10:], checksum(b[:20], 0))
+	} else {
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:], uint16(len(b)-40))
+		b[6] = 6
+		b[7] = 64
+		copy(b[8:24], net.ParseIP("2001:db8::1"))
+		copy(b[24:40], net.ParseIP("fd00::2"))
+	}
+	tcp := b[tcpOff:]
+	binary.BigEndian.PutUint16(tcp[0:], 443)
+	binary.BigEndian.PutUint16(tcp[2:], 40000)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 1)
+	tcp[12] = 8 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	// NOP, NOP, timestamps
+	copy(tcp[20:], []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2})
+	copy(tcp[32:], payload)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudoHeaderSum(b, len(tcp))))
+	return b
+}
+
+// checkSegment fails unless the checksums of an IPv4 or IPv6 TCP segment
+// are valid
+func checkSegment(t *testing.T, seg []byte) {
+	t.Helper()
+	tcpOff := 40
+	if seg[0]>>4 == 4 {
+		tcpOff = 20
+		if checksum(seg[:20], 0) != 0 {
+			t.Fatal("invalid IPv4 header checksum")
+		}
+	}
+	if checksum(seg[tcpOff:], pseudoHeaderSum(seg, len(seg)-tcpOff)) != 0 {
+		t.Fatal("invalid TCP checksum")
+	}
+}
+
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// gsoPacket returns a super-packet of payload as read from the TUN device
+func gsoPacket(v4 bool, flags byte, payload []byte, gsoSize int) (vnetHdr, []byte) {
+	packet := testSegment(v4, 0x1000, 1000, flags, payload)
+	hdr := vnetHdr{flags: vnetFlagNeedCsum, gsoType: vnetGSOTCPv6, hdrLen: 40 + 32, gsoSize: uint16(gsoSize), csumStart: 40, csumOffset: 16}
+	if v4 {
+		hdr.gsoType, hdr.hdrLen, hdr.csumStart = vnetGSOTCPv4, 20+32, 20
+	}
+	// The kernel leaves the sum of the pseudo header in the checksum
+	tcp := packet[hdr.csumStart:]
+	binary.BigEndian.PutUint16(tcp[16:], ^checksum(nil, pseudoHeaderSum(packet, len(tcp))))
+	return hdr, packet
+}
+
+// splitAll returns copies of the packets of a super-packet
+func splitAll(t *testing.T, hdr vnetHdr, packet []byte) [][]byte {
+	t.Helper()
+	var segments [][]byte
+	err := splitOffload(hdr, packet, make([]byte, maxSuperPacket), func(b []byte) {
+		segments = append(segments, bytes.Clone(b))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+func TestSplitOffload(t *testing.T) {
+	for _, c := range []struct {
+		v4      bool
+		size    int
+		gsoSize int
+	}{
+		{true, 5000, 1448},
+		{true, 1448 * 3, 1448},
+		{true, 100, 1448},
+		{false, 5000, 1428},
+		{false, 64000, 1428},
+	} {
+		t.Run(fmt.Sprintf("v4=%v/%d/%d", c.v4, c.size, c.gsoSize), func(t *testing.T) {
+			payload := testPayload(c.size)
+			hdr, packet := gsoPacket(c.v4, tcpFlagACK|tcpFlagPSH|tcpFlagFIN|tcpFlagCWR, payload, c.gsoSize)
+			hdr.gsoType |= vnetGSOECN
+			segments := splitAll(t, hdr, packet)
+			if len(segments) != (c.size+c.gsoSize-1)/c.gsoSize {
+				t.Fatalf("%d segments", len(segments))
+			}
+			tcpOff := int(hdr.csumStart)
+			var joined []byte
+			for i, seg := range segments {
+				checkSegment(t, seg)
+				n := min(c.gsoSize, c.size-i*c.gsoSize)
+				if len(seg) != int(hdr.hdrLen)+n {
+					t.Fatalf("segment %d: %d bytes", i, len(seg))
+				}
+				if c.v4 {
+					if int(binary.BigEndian.Uint16(seg[2:])) != len(seg) || binary.BigEndian.Uint16(seg[4:]) != 0x1000+uint16(i) {
+						t.Fatalf("segment %d: total length %d, ID %#x", i, binary.BigEndian.Uint16(seg[2:]), binary.BigEndian.Uint16(seg[4:]))
+					}
+				} else if int(binary.BigEndian.Uint16(seg[4:])) != len(seg)-40 {
+					t.Fatalf("segment %d: payload length %d", i, binary.BigEndian.Uint16(seg[4:]))
+				}
+				if seq := binary.BigEndian.Uint32(seg[tcpOff+4:]); seq != 1000+uint32(i*c.gsoSize) {
+					t.Fatalf("segment %d: sequence number %d", i, seq)
+				}
+				flags := seg[tcpOff+13]
+				last := i == len(segments)-1
+				if (flags&tcpFlagFIN != 0) != last || (flags&tcpFlagPSH != 0) != last || (flags&tcpFlagCWR != 0) != (i == 0) || flags&tcpFlagACK == 0 {
+					t.Fatalf("segment %d: flags %#x", i, flags)
+				}
+				joined = append(joined, seg[hdr.hdrLen:]...)
+			}
+			if !bytes.Equal(joined, payload) {
+				t.Fatal("payload differs")
+			}
+		})
+	}
+}
+
+func TestSplitOffloadChecksum(t *testing.T) {
+	// A UDP packet whose checksum the kernel left to be completed
+	packet := testPacketTo("192.0.2.1", "10.0.10.2", 17, 53)
+	udp := packet[20:]
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	sum := pseudoHeaderSum(packet, len(udp)) - 6 + 17
+	binary.BigEndian.PutUint16(udp[6:], ^checksum(nil, sum))
+	hdr := vnetHdr{flags: vnetFlagNeedCsum, csumStart: 20, csumOffset: 6}
+	segments := splitAll(t, hdr, packet)
+	if len(segments) != 1 || checksum(segments[0][20:], sum) != 0 {
+		t.Fatal("invalid UDP checksum")
+	}
+
+	// Packets without offload pass unchanged
+	packet = testSegment(true, 1, 1, tcpFlagACK, testPayload(100))
+	segments = splitAll(t, vnetHdr{}, bytes.Clone(packet))
+	if len(segments) != 1 || !bytes.Equal(segments[0], packet) {
+		t.Fatal("packet changed")
+	}
+}
+
+func TestSplitOffloadInvalid(t *testing.T) {
+	hdr, packet := gsoPacket(true, tcpFlagACK, testPayload(3000), 1448)
+	scratch := make([]byte, maxSuperPacket)
+	for name, c := range map[string]struct {
+		hdr    vnetHdr
+		packet []byte
+	}{
+		"no segment size": {vnetHdr{gsoType: vnetGSOTCPv4, csumStart: 20}, packet},
+		"version":         {vnetHdr{gsoType: vnetGSOTCPv6, gsoSize: 1448, csumStart: 40}, packet},
+		"unknown type":    {vnetHdr{gsoType: 3, gsoSize: 1448, csumStart: 20}, packet},
+		"short":           {hdr, packet[:30]},
+		"checksum field":  {vnetHdr{flags: vnetFlagNeedCsum, csumStart: 20, csumOffset: 6000}, packet},
+		"inside header":   {vnetHdr{gsoType: vnetGSOTCPv4, gsoSize: 1448, csumStart: 10}, packet},
+	} {
+		err := splitOffload(c.hdr, c.packet, scratch, func([]byte) {})
+		if err != errOffload {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// testGRO returns a GRO buffer and the packets it writes to the TUN device
+func testGRO() (*groBuffer, *packetRecorder) {
+	tun := &packetRecorder{}
+	return newGROBuffer(&tunQueue{rw: tun, offload: true}), tun
+}
+
+func TestGROCoalesce(t *testing.T) {
+	for _, v4 := range []bool{true, false} {
+		t.Run(fmt.Sprintf("v4=%v", v4), func(t *testing.T) {
+			g, tun := testGRO()
+			payload := testPayload(1448*3 + 500)
+			var segments [][]byte
+			for i, off := 0, 0; off < len(payload); i++ {
+				n := min(1448, len(payload)-off)
+				flags := byte(tcpFlagACK)
+				if off+n == len(payload) {
+					flags |= tcpFlagPSH
+				}
+				segments = append(segments, testSegment(v4, 0x1000+uint16(i), 1000+uint32(off), flags, payload[off:off+n]))
+				off += n
+			}
+			for _, seg := range segments {
+				g.add(seg)
+			}
+			g.flush()
+			if len(tun.packets) != 1 {
+				t.Fatalf("%d packets written", len(tun.packets))
+			}
+			hdr := decodeVnetHdr(tun.packets[0])
+			packet := tun.packets[0][vnetHdrLen:]
+			tcpOff := 40
+			gsoType := uint8(vnetGSOTCPv6)
+			if v4 {
+				tcpOff, gsoType = 20, vnetGSOTCPv4
+				if checksum(packet[:20], 0) != 0 || int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+					t.Fatal("invalid IPv4 header")
+				}
+			}
+			if hdr.gsoType != gsoType || hdr.gsoSize != 1448 || int(hdr.hdrLen) != tcpOff+32 ||
+				int(hdr.csumStart) != tcpOff || hdr.csumOffset != 16 || hdr.flags != vnetFlagNeedCsum {
+				t.Fatalf("header %+v", hdr)
+			}
+			if !bytes.Equal(packet[tcpOff+32:], payload) {
+				t.Fatal("payload differs")
+			}
+			if packet[tcpOff+13]&tcpFlagPSH == 0 {
+				t.Fatal("PSH of the last segment lost")
+			}
+			// The checksum holds the sum of the pseudo header for the kernel
+			partial := binary.BigEndian.Uint16(packet[tcpOff+16:])
+			if partial != ^checksum(nil, pseudoHeaderSum(packet, len(packet)-tcpOff)) {
+				t.Fatalf("partial checksum %#x", partial)
+			}
+
+			// Splitting the coalesced packet restores the segments
+			split := splitAll(t, hdr, bytes.Clone(packet))
+			if len(split) != len(segments) {
+				t.Fatalf("%d segments after splitting", len(split))
+			}
+			for i := range split {
+				if !bytes.Equal(split[i], segments[i]) {
+					t.Fatalf("segment %d differs after the round trip", i)
+				}
+			}
+		})
+	}
+}
+
+func TestGRORefuses(t *testing.T) {
+	first := testSegment(true, 1, 1000, tcpFlagACK, testPayload(1000))
+	ttl := testSegment(true, 2, 2000, tcpFlagACK, testPayload(1000))
+	ttl[8] = 63
+	for name, c := range map[string]struct {
+		next    []byte
+		packets int
+	}{
+		"contiguous": {testSegment(true, 2, 2000, tcpFlagACK, testPayload(1000)), 1},
+		"gap":        {testSegment(true, 2, 2500, tcpFlagACK, testPayload(1000)), 2},
+		"overlap":    {testSegment(true, 2, 1500, tcpFlagACK, testPayload(1000)), 2},
+		"FIN":        {testSegment(true, 2, 2000, tcpFlagACK|tcpFlagFIN, testPayload(1000)), 2},
+		"no ACK":     {testSegment(true, 2, 2000, tcpFlagPSH, testPayload(1000)), 2},
+		"larger":     {testSegment(true, 2, 2000, tcpFlagACK, testPayload(1001)), 2},
+		"TTL":        {ttl, 2},
+		"no payload": {testSegment(true, 2, 2000, tcpFlagACK, nil), 2},
+		"other flow": {testSegment(false, 2, 2000, tcpFlagACK, testPayload(1000)), 2},
+		"not TCP":    {testPacketTo("192.0.2.1", "10.0.10.2", 17, 53), 2},
+	} {
+		g, tun := testGRO()
+		g.add(bytes.Clone(first))
+		g.add(bytes.Clone(c.next))
+		g.flush()
+		if len(tun.packets) != c.packets {
+			t.Errorf("%s: %d packets written, expected %d", name, len(tun.packets), c.packets)
+		}
+	}
+
+	// Nothing is appended to a run ended by PSH or a short segment
+	for name, run := range map[string][][]byte{
+		"PSH": {
+			testSegment(true, 1, 1000, tcpFlagACK|tcpFlagPSH, testPayload(1000)),
+			testSegment(true, 2, 2000, tcpFlagACK, testPayload(1000)),
+		},
+		"short": {
+			testSegment(true, 1, 1000, tcpFlagACK, testPayload(1000)),
+			testSegment(true, 2, 2000, tcpFlagACK, testPayload(500)),
+			testSegment(true, 3, 2500, tcpFlagACK, testPayload(1000)),
+		},
+	} {
+		g, tun := testGRO()
+		for _, seg := range run {
+			g.add(seg)
+		}
+		g.flush()
+		if len(tun.packets) != 2 {
+			t.Errorf("%s: %d packets written, expected 2", name, len(tun.packets))
+		}
+	}
+}
+
+func TestCoalescible(t *testing.T) {
+	options := testSegment(true, 1, 1, tcpFlagACK, testPayload(100))
+	options[0] = 0x46
+	fragment := testSegment(true, 1, 1, tcpFlagACK, testPayload(100))
+	fragment[6] = 0x20
+	for name, c := range map[string]struct {
+		packet []byte
+		ok     bool
+	}{
+		"IPv4":       {testSegment(true, 1, 1, tcpFlagACK, testPayload(100)), true},
+		"IPv6":       {testSegment(false, 1, 1, tcpFlagACK|tcpFlagPSH, testPayload(100)), true},
+		"SYN":        {testSegment(true, 1, 1, tcpFlagACK|0x02, testPayload(100)), false},
+		"RST":        {testSegment(true, 1, 1, tcpFlagACK|0x04, testPayload(100)), false},
+		"no payload": {testSegment(false, 1, 1, tcpFlagACK, nil), false},
+		"IP options": {options, false},
+		"fragment":   {fragment, false},
+		"UDP":        {testPacketTo("192.0.2.1", "10.0.10.2", 17, 53), false},
+	} {
+		if _, _, ok := coalescible(c.packet); ok != c.ok {
+			t.Errorf("%s: coalescible expected %v", name, c.ok)
+		}
+	}
+}
@@ -2,66 +2,233 @@
 package server
 
 import (
+	"errors"
+	"log/slog"
 	"net"
+	"net/netip"
 	"time"
 
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
-	"github.com/golang/snappy"
-	"github.com/net-byte/water"
-	"github.com/xorgal/xtun-core/pkg/cache"
 	"github.com/xorgal/xtun-core/pkg/config"
 	"github.com/xorgal/xtun-core/pkg/counter"
-	"github.com/xorgal/xtun-core/pkg/netutil"
 	"github.com/xorgal/xtund/internal"
 )
 
-// toClient sends data to client
-func toClient(config config.Config, iface *water.Interface) {
+// toClient sends data to client, it reads packets from one queue of the TUN
+// device
+func toClient(config config.Config, iface *tunQueue) {
 	packet := make([]byte, config.BufferSize)
+	var scratch []byte
+	if iface.offload {
+		packet = make([]byte, max(config.BufferSize, vnetHdrLen+maxSuperPacket))
+		scratch = make([]byte, maxSuperPacket)
+	}
+	route := func(b []byte) {
+		if dst, ok := dstAddr(b); ok {
+			if s, ok := clientRoutes.get(dst); ok {
+				deliver(config, iface, s, dst, b)
+			}
+		}
+	}
 	for {
-		n, err := iface.Read(packet)
+		n, err := iface.rw.Read(packet)
 		if err != nil {
 			internal.PrintErr("iface.Read(packet):", err)
 			break
 		}
 		b := packet[:n]
-		if key := netutil.GetDstKey(b); key != "" {
-			if v, ok := cache.GetCache().Get(key); ok {
-				if config.Compress {
-					b = snappy.Encode(nil, b)
-				}
-				err := wsutil.WriteServerBinary(v.(net.Conn), b)
-				if err != nil {
-					cache.GetCache().Delete(key)
-					continue
-				}
-				counter.IncrWrittenBytes(n)
+		if !iface.offload {
+			route(b)
+			continue
+		}
+		if n < vnetHdrLen {
+			continue
+		}
+		err = splitOffload(decodeVnetHdr(b), b[vnetHdrLen:], scratch, route)
+		if err != nil {
+			slog.Debug("failed to split offload packet", "err", err)
+		}
+	}
+}
+
+// deliver queues a packet to the client of session s which is the route for
+// dst, enforcing its quota and download rate limit. Packets above the MTU
+// of the session are fragmented or answered with an ICMP error.
+func deliver(config config.Config, iface *tunQueue, s *session, dst netip.Addr, b []byte) {
+	if len(b) > s.mtu {
+		if !dontFragment(b) {
+			for _, f := range fragmentIPv4(b, s.mtu) {
+				deliver(config, iface, s, dst, f)
 			}
+			return
+		}
+		s.countTooBig()
+		if icmp := tooBig(b, s.mtu, tunnelIP); icmp != nil {
+			iface.Write(icmp)
 		}
+		return
+	}
+	clampMSS(b, s.mtu)
+	n := len(b)
+	limits := s.limits.Load()
+	if limits.blocked {
+		s.countDownloadDropped()
+		return
+	}
+	// Packets are never delayed on the way to a client as that would stall
+	// the sender, packets above the rate limit are dropped instead
+	if !limits.download.allow(n) {
+		s.countDownloadDropped()
+		return
+	}
+	buf := getBuffer(maxFrameSize(n))
+	*buf = s.encodeFrame(*buf, b)
+	err := s.enqueue(buf, n, flowHash(b))
+	if err == errQueueClosed {
+		s.log().Debug("session closed, route removed", "dst", dst)
+		clientRoutes.delete(dst, s)
 	}
 }
 
-// toServer sends data to server
-func toServer(config config.Config, wsconn net.Conn, iface *water.Interface) {
-	defer wsconn.Close()
+// forwardToPeer handles a packet from session s to another client. Allowed
+// packets are passed straight to the session of the destination, packets
+// to clients which are not connected are dropped.
+func forwardToPeer(config config.Config, iface *tunQueue, s *session, b []byte) {
+	addr, _ := dstAddr(b)
+	dst, ok := clientRoutes.get(addr)
+	if !ok {
+		s.countPeerDenied()
+		return
+	}
+	if p := peers.Load(); p != nil && !p.allowed(s.device(), dst.device()) {
+		s.countPeerDenied()
+		s.log().Debug("packet to peer denied", "dst", addr)
+		return
+	}
+	s.countPeerForwarded()
+	deliver(config, iface, dst, addr, b)
+}
+
+// toServer sends data received on link l to server
+func toServer(config config.Config, l *link, iface *tunQueue, allocator *internal.Allocator) {
+	s := l.s
+	// Batches of sessions on queues with offloads are coalesced
+	if iface.offload && s.batched {
+		l.gro = newGROBuffer(iface)
+	}
+	l.touch()
 	for {
-		b, op, err := wsutil.ReadClientData(wsconn)
+		b, op, err := l.reader.next()
 		if err != nil {
-			internal.PrintErr("wsutil.ReadClientData(wsconn)", err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				s.countTimedOut()
+				s.log().Info("connection timed out", "via", l.remote, "lastSeen", time.Unix(s.lastSeen.Load(), 0))
+				break
+			}
+			s.log().Info("connection closed", "via", l.remote, "err", err)
 			break
 		}
+		l.touch()
 		if op == ws.OpText {
-			wsutil.WriteServerMessage(wsconn, op, b)
+			l.writeMessage(op, b)
 		} else if op == ws.OpBinary {
-			if config.Compress {
-				b, _ = snappy.Decode(nil, b)
+			if !s.batched {
+				fromClient(config, l, iface, allocator, b)
+				continue
+			}
+			err = splitBatch(b, func(frame []byte) {
+				fromClient(config, l, iface, allocator, frame)
+			})
+			if err != nil {
+				s.countDecodeFailed()
+				s.log().Debug("failed to split batch", "err", err)
 			}
-			if key := netutil.GetSrcKey(b); key != "" {
-				cache.GetCache().Set(key, wsconn, 24*time.Hour)
-				counter.IncrReadBytes(len(b))
-				iface.Write(b)
+			if l.gro != nil {
+				l.gro.flush()
 			}
 		}
 	}
 }
+
+// fromClient passes a single frame received on link l to its destination
+func fromClient(config config.Config, l *link, iface *tunQueue, allocator *internal.Allocator, frame []byte) {
+	s := l.s
+	b, err := l.decodeFrame(frame)
+	if err != nil {
+		s.countDecodeFailed()
+		s.log().Debug("failed to decode packet", "err", err)
+		return
+	}
+	src, ok := srcAddr(b)
+	if !ok {
+		return
+	}
+	// IPv4 packets are parsed by their header length later on
+	if src.Is4() {
+		if _, ok := ipv4HeaderLen(b); !ok {
+			s.countDecodeFailed()
+			s.log().Debug("malformed IPv4 packet dropped", "src", src)
+			return
+		}
+	}
+	s.identified.Do(func() {
+		if s.bindSource(src, allocator) {
+			s.log().Info("session established")
+		}
+	})
+	// A client may only send from the address it is bound to, it would take
+	// over the routes and policy of other devices otherwise. Unbound
+	// sessions send nothing.
+	if src != s.bound {
+		s.countSpoofed()
+		s.log().Debug("packet with spoofed source dropped", "src", src)
+		return
+	}
+	limits := s.limits.Load()
+	if limits.blocked {
+		s.countUploadDropped()
+		return
+	}
+	if !s.acl.Load().allowed(b) {
+		s.countACLDenied()
+		s.log().Debug("packet denied by ACL", "dst", dstIP(b))
+		return
+	}
+	wait, ok := limits.upload.reserve(len(b), limits.maxDelay)
+	if !ok {
+		s.countUploadDropped()
+		return
+	}
+	if wait > 0 {
+		s.countUploadDelayed()
+		time.Sleep(wait)
+	}
+	// The client exceeded the negotiated MTU
+	if len(b) > s.mtu {
+		s.countTooBig()
+		if icmp := tooBig(b, s.mtu, tunnelIP); icmp != nil {
+			deliver(config, iface, s, src, icmp)
+		}
+		return
+	}
+	clampMSS(b, s.mtu)
+	clientRoutes.set(src, s)
+	counter.IncrReadBytes(len(b))
+	s.countRead(len(b))
+	if peerDestination(b) {
+		forwardToPeer(config, iface, s, b)
+		return
+	}
+	if l.gro != nil {
+		l.gro.add(b)
+		return
+	}
+	iface.Write(b)
+}
+
+// dstIP returns the destination address of a packet for logging
+func dstIP(packet []byte) string {
+	dst, _ := dstAddr(packet)
+	return dst.String()
+}
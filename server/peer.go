@@ -0,0 +1,132 @@
+// File: server/peer.go
+package server
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// peerPolicy is the compiled form of `internal.IPeerConfig`
+type peerPolicy struct {
+	allow       bool
+	rules       []*peerRule
+	defaultHits atomic.Uint64
+}
+
+type peerRule struct {
+	config   internal.IPeerRule
+	allow    bool
+	from, to map[string]bool
+	hits     atomic.Uint64
+}
+
+// peers is the active client-to-client policy
+var peers atomic.Pointer[peerPolicy]
+
+// tunnelNet is the client network, tunnelIP the address of the server in it
+var tunnelNet *net.IPNet
+var tunnelIP net.IP
+
+// tunnelBroadcast is the broadcast address of tunnelNet
+var tunnelBroadcast net.IP
+
+// setTunnelNetwork parses the CIDR of the TUN device
+func setTunnelNetwork(cidr string) error {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	tunnelIP = ip.To4()
+	tunnelNet = network
+	tunnelBroadcast = broadcast(network)
+	return nil
+}
+
+// compilePeers validates the configuration and resolves groups to devices
+func compilePeers(cfg internal.IPeerConfig, groups map[string][]string) (*peerPolicy, error) {
+	err := cfg.Validate(groups)
+	if err != nil {
+		return nil, err
+	}
+	p := &peerPolicy{allow: cfg.Default != internal.ACLDeny}
+	for _, rc := range cfg.Rules {
+		p.rules = append(p.rules, &peerRule{
+			config: rc,
+			allow:  rc.Action == internal.ACLAllow,
+			from:   groupMembers(rc.From, groups),
+			to:     groupMembers(rc.To, groups),
+		})
+	}
+	return p, nil
+}
+
+// groupMembers returns the devices of the groups, nil matches every device
+func groupMembers(names []string, groups map[string][]string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	members := make(map[string]bool)
+	for _, g := range names {
+		for _, d := range groups[g] {
+			members[d] = true
+		}
+	}
+	return members
+}
+
+// allowed evaluates traffic from device src to device dst, unregistered
+// clients only match rules for every client
+func (p *peerPolicy) allowed(src string, dst string) bool {
+	for _, r := range p.rules {
+		if matchMember(r.from, src) && matchMember(r.to, dst) {
+			r.hits.Add(1)
+			return r.allow
+		}
+	}
+	p.defaultHits.Add(1)
+	return p.allow
+}
+
+func matchMember(members map[string]bool, id string) bool {
+	return members == nil || (id != "" && members[id])
+}
+
+// peerDestination returns whether the packet is addressed to another client
+// of the tunnel network, as opposed to the server or anything behind it
+func peerDestination(packet []byte) bool {
+	if tunnelNet == nil || len(packet) < 20 || packet[0]>>4 != 4 {
+		return false
+	}
+	dst := net.IP(packet[16:20])
+	return tunnelNet.Contains(dst) && !dst.Equal(tunnelIP) && !dst.Equal(tunnelBroadcast)
+}
+
+func broadcast(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		ip[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return ip
+}
+
+// peersResponse returns the active peer rules and their hit counters
+func peersResponse() PeersResponse {
+	p := peers.Load()
+	if p == nil {
+		return PeersResponse{Default: internal.ACLAllow, Rules: []PeerRuleResponse{}}
+	}
+	r := PeersResponse{
+		Default:     internal.ACLDeny,
+		DefaultHits: p.defaultHits.Load(),
+		Rules:       make([]PeerRuleResponse, 0, len(p.rules)),
+	}
+	if p.allow {
+		r.Default = internal.ACLAllow
+	}
+	for _, rule := range p.rules {
+		r.Rules = append(r.Rules, PeerRuleResponse{IPeerRule: rule.config, Hits: rule.hits.Load()})
+	}
+	return r
+}
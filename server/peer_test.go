@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+func TestPeersAllowed(t *testing.T) {
+	groups := map[string][]string{
+		"admins":  {"laptop"},
+		"servers": {"nas", "printer"},
+	}
+	p, err := compilePeers(internal.IPeerConfig{
+		Default: internal.ACLDeny,
+		Rules: []internal.IPeerRule{
+			{Action: internal.ACLAllow, From: []string{"admins"}},
+			{Action: internal.ACLDeny, To: []string{"admins"}},
+			{Action: internal.ACLAllow, To: []string{"servers"}},
+		},
+	}, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		src, dst string
+		allow    bool
+	}{
+		{"laptop", "phone", true},
+		{"phone", "laptop", false},
+		{"phone", "nas", true},
+		{"", "nas", true},
+		{"phone", "tablet", false},
+		{"", "laptop", false},
+	} {
+		if p.allowed(c.src, c.dst) != c.allow {
+			t.Errorf("%q to %q: allowed expected %v", c.src, c.dst, c.allow)
+		}
+	}
+	if p.defaultHits.Load() != 1 {
+		t.Fatalf("default hits %d", p.defaultHits.Load())
+	}
+}
+
+func TestCompilePeersUnknownGroup(t *testing.T) {
+	_, err := compilePeers(internal.IPeerConfig{
+		Rules: []internal.IPeerRule{{Action: internal.ACLAllow, From: []string{"missing"}}},
+	}, nil)
+	if err == nil {
+		t.Fatal("unknown group accepted")
+	}
+}
+
+func TestPeerDestination(t *testing.T) {
+	network, ip, bcast := tunnelNet, tunnelIP, tunnelBroadcast
+	t.Cleanup(func() { tunnelNet, tunnelIP, tunnelBroadcast = network, ip, bcast })
+	err := setTunnelNetwork("10.0.10.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		dst  string
+		peer bool
+	}{
+		{"10.0.10.3", true},
+		{"10.0.10.1", false},
+		{"10.0.10.255", false},
+		{"192.0.2.1", false},
+	} {
+		if peerDestination(testPacketTo("10.0.10.2", c.dst, internal.ProtocolUDP, 53)) != c.peer {
+			t.Errorf("%s: peer expected %v", c.dst, c.peer)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// File: server/queue.go
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xorgal/xtun-core/pkg/counter"
+	"github.com/xorgal/xtund/internal"
+)
+
+// queueSettings apply to new sessions, they are updated on configuration
+// reload
+var queueSettings atomic.Pointer[internal.IQueueConfig]
+
+// The built-in settings apply until `Run` stores the configured ones
+func init() {
+	queue := internal.DaemonConfig.Queue
+	queueSettings.Store(&queue)
+}
+
+// smallPacket is the size up to which packets are considered interactive,
+// e.g. TCP acknowledgements, DNS queries or keystrokes of a remote shell
+const smallPacket = 256
+
+var errQueueFull = errors.New("write queue is full")
+var errQueueClosed = errors.New("session is closed")
+
+// queuedFrame is an encoded frame in a pooled buffer, n is the size of the
+// packet it holds
+type queuedFrame struct {
+	buf *[]byte
+	n   int
+}
+
+// writeQueue holds frames to a client until the writer goroutine of a link
+// sends them, so a slow client only delays its own traffic. The backlog of
+// a session holds frames while a resumable session has no connection and
+// frames of lost links. Frames are dropped once the bytes of the queue are
+// used up. With the priority policy small packets have a queue of their own
+// which is served first.
+type writeQueue struct {
+	frames   chan queuedFrame
+	priority chan queuedFrame
+	// closed is set under mu, pushes hold it for reading so none is in
+	// progress once close returns and drain takes every frame pushed
+	mu       sync.RWMutex
+	closed   bool
+	maxDepth atomic.Int64
+	// bytes are the frame bytes waiting, at most maxBytes
+	bytes    atomic.Int64
+	maxBytes int64
+}
+
+// newWriteQueue returns a queue for a session of the MTU
+func newWriteQueue(cfg internal.IQueueConfig, mtu int) *writeQueue {
+	q := &writeQueue{
+		frames:   make(chan queuedFrame, cfg.Size*internal.QueueSlots),
+		maxBytes: int64(queueBytes(cfg, mtu)),
+	}
+	if cfg.Policy == internal.QueuePolicyPriority {
+		q.priority = make(chan queuedFrame, cfg.Size*internal.QueueSlots)
+	}
+	return q
+}
+
+// queueBytes returns the number of frame bytes a queue of a session of the
+// MTU holds
+func queueBytes(cfg internal.IQueueConfig, mtu int) int {
+	if cfg.Bytes > 0 {
+		return cfg.Bytes
+	}
+	return cfg.Size * mtu
+}
+
+// push queues a frame without blocking, it fails once the queue is closed
+func (q *writeQueue) push(f queuedFrame) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	size := int64(len(*f.buf))
+	if q.bytes.Add(size) > q.maxBytes {
+		q.bytes.Add(-size)
+		return errQueueFull
+	}
+	ch := q.frames
+	if q.priority != nil && f.n <= smallPacket {
+		ch = q.priority
+	}
+	select {
+	case ch <- f:
+	default:
+		q.bytes.Add(-size)
+		return errQueueFull
+	}
+	depth := int64(q.depth())
+	for {
+		prev := q.maxDepth.Load()
+		if depth <= prev || q.maxDepth.CompareAndSwap(prev, depth) {
+			return nil
+		}
+	}
+}
+
+// pop waits for the next frame, small packets first. Frames of the backlog
+// are older and taken before those of q. It returns false once done is
+// closed.
+func (q *writeQueue) pop(backlog *writeQueue, done <-chan struct{}) (queuedFrame, bool) {
+	select {
+	case f := <-backlog.priority:
+		return backlog.taken(f), true
+	case f := <-backlog.frames:
+		return backlog.taken(f), true
+	default:
+	}
+	select {
+	case f := <-q.priority:
+		return q.taken(f), true
+	default:
+	}
+	select {
+	case f := <-q.priority:
+		return q.taken(f), true
+	case f := <-q.frames:
+		return q.taken(f), true
+	case f := <-backlog.priority:
+		return backlog.taken(f), true
+	case f := <-backlog.frames:
+		return backlog.taken(f), true
+	case <-done:
+		return queuedFrame{}, false
+	}
+}
+
+// taken releases the bytes of a frame taken from the queue
+func (q *writeQueue) taken(f queuedFrame) queuedFrame {
+	q.bytes.Add(-int64(len(*f.buf)))
+	return f
+}
+
+// drain passes the frames left in the queue to fn
+func (q *writeQueue) drain(fn func(f queuedFrame)) {
+	for {
+		select {
+		case f := <-q.priority:
+			fn(q.taken(f))
+		case f := <-q.frames:
+			fn(q.taken(f))
+		default:
+			return
+		}
+	}
+}
+
+// depth is the number of frames waiting
+func (q *writeQueue) depth() int {
+	return len(q.frames) + len(q.priority)
+}
+
+// queuedBytes is the number of frame bytes waiting
+func (q *writeQueue) queuedBytes() int {
+	return int(q.bytes.Load())
+}
+
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+}
+
+// writeLoop sends frames queued on the link and the backlog of its session
+// to the client until the link is detached. The connection is closed on the
+// first failed write, which ends serving it.
+func (l *link) writeLoop() {
+	defer l.serving.Done()
+	s := l.s
+	for {
+		f, ok := l.queue.pop(s.backlog, l.done)
+		if !ok {
+			return
+		}
+		err := l.send(*f.buf)
+		putBuffer(f.buf)
+		if err != nil {
+			s.log().Debug("failed to write to client", "err", err, "via", l.remote)
+			l.closeConn()
+			return
+		}
+		counter.IncrWrittenBytes(f.n)
+		s.countWritten(f.n)
+		l.writtenBytes.Add(uint64(f.n))
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+func testFrame(size int) queuedFrame {
+	b := make([]byte, size)
+	return queuedFrame{buf: &b, n: size}
+}
+
+func TestWriteQueueBytes(t *testing.T) {
+	cfg := internal.IQueueConfig{Size: 2, Policy: internal.QueuePolicyTail}
+	q := newWriteQueue(cfg, 1000)
+	backlog := newWriteQueue(cfg, 1000)
+	// Smaller packets than the MTU fit beyond the size of the queue
+	for i := 0; i < 3; i++ {
+		if err := q.push(testFrame(600)); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := q.push(testFrame(600)); err != errQueueFull {
+		t.Fatalf("frame over the byte bound: %v", err)
+	}
+	if q.queuedBytes() != 1800 || q.depth() != 3 {
+		t.Fatalf("%d bytes in %d frames queued", q.queuedBytes(), q.depth())
+	}
+	if err := q.push(testFrame(200)); err != nil {
+		t.Fatalf("frame within the byte bound: %v", err)
+	}
+	f, ok := q.pop(backlog, nil)
+	if !ok || len(*f.buf) != 600 || q.queuedBytes() != 1400 {
+		t.Fatalf("popped %d bytes, %d bytes left", len(*f.buf), q.queuedBytes())
+	}
+	var drained int
+	q.drain(func(f queuedFrame) { drained += len(*f.buf) })
+	if drained != 1400 || q.queuedBytes() != 0 {
+		t.Fatalf("drained %d bytes, %d bytes left", drained, q.queuedBytes())
+	}
+}
+
+func TestWriteQueueSlots(t *testing.T) {
+	cfg := internal.IQueueConfig{Size: 2, Bytes: 1 << 20, Policy: internal.QueuePolicyPriority}
+	q := newWriteQueue(cfg, 1500)
+	// The number of frames is bounded as well, small packets take a queue
+	// of their own
+	for i := 0; i < cfg.Size*internal.QueueSlots; i++ {
+		if err := q.push(testFrame(64)); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := q.push(testFrame(64)); err != errQueueFull {
+		t.Fatalf("frame over the slots: %v", err)
+	}
+	if q.queuedBytes() != 64*cfg.Size*internal.QueueSlots {
+		t.Fatalf("%d bytes queued, rejected frames must not count", q.queuedBytes())
+	}
+	if err := q.push(testFrame(1500)); err != nil {
+		t.Fatalf("large frame: %v", err)
+	}
+}
+
+func TestWriteQueuePushClose(t *testing.T) {
+	cfg := internal.IQueueConfig{Size: 1024, Bytes: 1 << 30, Policy: internal.QueuePolicyPriority}
+	for round := 0; round < 50; round++ {
+		q := newWriteQueue(cfg, 1500)
+		var pushed atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(size int) {
+				defer wg.Done()
+				for {
+					err := q.push(testFrame(size))
+					switch err {
+					case nil:
+						pushed.Add(1)
+					case errQueueFull:
+						runtime.Gosched()
+					case errQueueClosed:
+						return
+					default:
+						t.Error(err)
+						return
+					}
+				}
+			}(64 + i*200)
+		}
+		runtime.Gosched()
+		q.close()
+		// No frame is pushed once close returned, drain takes all of them
+		var drained int64
+		q.drain(func(queuedFrame) { drained++ })
+		wg.Wait()
+		if q.depth() != 0 || drained != pushed.Load() {
+			t.Fatalf("round %d: %d of %d frames drained, %d left", round, drained, pushed.Load(), q.depth())
+		}
+		if err := q.push(testFrame(64)); err != errQueueClosed {
+			t.Fatalf("push to a closed queue: %v", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// File: server/quota.go
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// quotaFlushInterval is how often the traffic of open sessions is added to
+// the device usage in the allocator database and quotas are checked
+const quotaFlushInterval = 30 * time.Second
+
+// defaultQuota is the quota configuration, it is updated on configuration reload
+var defaultQuota atomic.Pointer[internal.IQuotaConfig]
+
+// flushMu serializes usage updates, so pending traffic is never added twice
+var flushMu sync.Mutex
+
+func currentQuota() internal.IQuotaConfig {
+	if q := defaultQuota.Load(); q != nil {
+		return *q
+	}
+	return internal.IQuotaConfig{}
+}
+
+// currentPeriod returns the start of the running quota period
+func currentPeriod() time.Time {
+	return currentQuota().PeriodStart(time.Now())
+}
+
+// quotaExceeded reports whether the device used up its quota in the
+// running period
+func quotaExceeded(record internal.DeviceRecord) bool {
+	limit := record.QuotaLimit(currentQuota().Limit)
+	return limit > 0 && record.UsageIn(currentPeriod()).Total() >= uint64(limit)
+}
+
+// watchQuota flushes usage periodically until ctx is done
+func watchQuota(ctx context.Context, allocator *internal.Allocator) {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			flushUsage(allocator, sessions.all())
+		}
+	}
+}
+
+// flushUsage adds pending traffic of the sessions to the usage of their
+// devices and blocks, throttles or releases the sessions accordingly.
+// Devices over quota are checked even without traffic, as their usage is
+// reset at the start of a new period.
+func flushUsage(allocator *internal.Allocator, list []*session) {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+	byDevice := make(map[string][]*session)
+	for _, s := range list {
+		if id := s.device(); id != "" {
+			byDevice[id] = append(byDevice[id], s)
+		}
+	}
+	period := currentPeriod()
+	for id, list := range byDevice {
+		var upload, download uint64
+		exceeded := false
+		for _, s := range list {
+			upload += s.pending.upload.Swap(0)
+			download += s.pending.download.Swap(0)
+			exceeded = exceeded || s.overQuota.Load()
+		}
+		if upload == 0 && download == 0 && !exceeded {
+			continue
+		}
+		record, err := allocator.AddDeviceUsage(id, period, upload, download)
+		if err != nil {
+			slog.Error("failed to update device usage", "device", id, "err", err)
+			continue
+		}
+		applyQuota(id, record, list)
+	}
+}
+
+// applyQuota updates the quota state of the sessions of a device
+func applyQuota(id string, record internal.DeviceRecord, list []*session) {
+	exceeded := quotaExceeded(record)
+	var changed []*session
+	for _, s := range list {
+		if s.overQuota.Swap(exceeded) != exceeded {
+			s.refreshLimits()
+			changed = append(changed, s)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	usage := record.UsageIn(currentPeriod())
+	limit := record.QuotaLimit(currentQuota().Limit)
+	if exceeded {
+		internal.Audit(internal.AuditQuotaExceeded, "", "device", id, "usage", usage.Total(), "quota", limit)
+		// Blocked sessions stay connected but are cut off from the network
+		if currentQuota().Action != internal.QuotaActionThrottle {
+			for _, s := range changed {
+				internal.Audit(internal.AuditSessionKicked, s.remoteAddr(), "device", id, "ip", s.addr(), "reason", "quota")
+			}
+		}
+		slog.Warn("device exceeded its quota", "device", id, "usage", usage.Total(), "quota", limit, "action", currentQuota().Action)
+	} else {
+		slog.Info("device is within its quota again", "device", id, "usage", usage.Total(), "quota", limit)
+	}
+}
+
+// usageResponse returns the usage of a device in the running period
+func usageResponse(id string, record internal.DeviceRecord) DeviceUsageResponse {
+	usage := record.UsageIn(currentPeriod())
+	return DeviceUsageResponse{
+		DeviceId: id,
+		Period:   usage.Period,
+		Upload:   usage.Upload,
+		Download: usage.Download,
+		Quota:    record.QuotaLimit(currentQuota().Limit),
+		Exceeded: quotaExceeded(record),
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// setQuota uses c for the duration of the test
+func setQuota(t *testing.T, c internal.IQuotaConfig) {
+	prev := defaultQuota.Load()
+	t.Cleanup(func() { defaultQuota.Store(prev) })
+	defaultQuota.Store(&c)
+}
+
+// deviceSession returns a session identified as the device id, which is
+// registered if needed
+func deviceSession(t *testing.T, allocator *internal.Allocator, id string) *session {
+	cidr, _, err := allocator.RegisterDevice(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(internal.CodecNone)
+	t.Cleanup(s.close)
+	s.identified.Do(func() { s.identify(netip.MustParsePrefix(cidr).Addr(), allocator) })
+	return s
+}
+
+func deviceUsage(t *testing.T, allocator *internal.Allocator, id string) internal.DeviceUsage {
+	record, err := allocator.GetDevice(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record.UsageIn(currentPeriod())
+}
+
+func TestFlushUsage(t *testing.T) {
+	setQuota(t, internal.IQuotaConfig{ResetDay: 1})
+	allocator := newTestAllocator(t)
+	laptop := deviceSession(t, allocator, "laptop")
+	joined := deviceSession(t, allocator, "laptop")
+	unknown := newTestSession(internal.CodecNone)
+	t.Cleanup(unknown.close)
+	laptop.countRead(100)
+	laptop.countWritten(1000)
+	joined.countRead(20)
+	unknown.countRead(5)
+
+	flushUsage(allocator, []*session{laptop, joined, unknown})
+	usage := deviceUsage(t, allocator, "laptop")
+	if usage.Upload != 120 || usage.Download != 1000 {
+		t.Fatalf("usage %+v", usage)
+	}
+	if laptop.pending.upload.Load() != 0 || laptop.pending.download.Load() != 0 || joined.pending.upload.Load() != 0 {
+		t.Fatal("pending traffic left")
+	}
+	// Sessions without a device are not accounted
+	if unknown.pending.upload.Load() != 5 {
+		t.Fatalf("pending traffic of an unknown device %d", unknown.pending.upload.Load())
+	}
+	// Traffic is added once
+	flushUsage(allocator, []*session{laptop, joined})
+	laptop.countRead(1)
+	flushUsage(allocator, []*session{laptop, joined})
+	if usage := deviceUsage(t, allocator, "laptop"); usage.Upload != 121 || usage.Download != 1000 {
+		t.Fatalf("usage %+v after another flush", usage)
+	}
+}
+
+func TestApplyQuotaBlock(t *testing.T) {
+	setQuota(t, internal.IQuotaConfig{Limit: 1000, Action: internal.QuotaActionBlock, ResetDay: 1})
+	allocator := newTestAllocator(t)
+	s := deviceSession(t, allocator, "laptop")
+	s.countRead(600)
+	flushUsage(allocator, []*session{s})
+	if s.overQuota.Load() || s.limits.Load().blocked {
+		t.Fatal("blocked within the quota")
+	}
+	s.countWritten(400)
+	flushUsage(allocator, []*session{s})
+	if !s.overQuota.Load() || !s.limits.Load().blocked {
+		t.Fatal("not blocked over the quota")
+	}
+
+	// A larger quota of the device releases the session
+	quota := int64(2000)
+	record, err := allocator.UpdateDevice("laptop", func(r *internal.DeviceRecord) { r.Quota = &quota })
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyQuota("laptop", record, []*session{s})
+	if s.overQuota.Load() || s.limits.Load().blocked {
+		t.Fatal("still blocked within the quota of the device")
+	}
+}
+
+func TestApplyQuotaThrottle(t *testing.T) {
+	setQuota(t, internal.IQuotaConfig{Limit: 1000, Action: internal.QuotaActionThrottle, ThrottleRate: 5000, ResetDay: 1})
+	allocator := newTestAllocator(t)
+	fast := deviceSession(t, allocator, "laptop")
+	slow := deviceSession(t, allocator, "laptop")
+	slow.setRateLimit(&internal.IRateLimit{Upload: 2000})
+	fast.countRead(1000)
+	flushUsage(allocator, []*session{fast, slow})
+
+	for _, c := range []struct {
+		s                *session
+		upload, download int64
+	}{
+		{fast, 5000, 5000},
+		// Lower rates of the device are kept
+		{slow, 2000, 5000},
+	} {
+		l := c.s.limits.Load()
+		if !c.s.overQuota.Load() || l.blocked {
+			t.Fatalf("over quota %v, blocked %v", c.s.overQuota.Load(), l.blocked)
+		}
+		if l.rate.Upload != c.upload || l.rate.Download != c.download || l.upload == nil || l.download == nil {
+			t.Fatalf("throttled to %+v, expected %d/%d", l.rate, c.upload, c.download)
+		}
+	}
+	if slow.limits.Load().override == nil {
+		t.Fatal("rate limit of the device lost")
+	}
+}
+
+func TestFlushUsageNewPeriod(t *testing.T) {
+	setQuota(t, internal.IQuotaConfig{Limit: 1000, Action: internal.QuotaActionBlock, ResetDay: 1})
+	allocator := newTestAllocator(t)
+	s := deviceSession(t, allocator, "laptop")
+	last := currentPeriod().AddDate(0, -1, 0)
+	_, err := allocator.UpdateDevice("laptop", func(r *internal.DeviceRecord) {
+		r.Usage = internal.DeviceUsage{Period: last, Upload: 5000}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.overQuota.Store(true)
+	s.refreshLimits()
+
+	// A blocked device is checked without traffic, its usage is reset
+	flushUsage(allocator, []*session{s})
+	if s.overQuota.Load() || s.limits.Load().blocked {
+		t.Fatal("still blocked in a new period")
+	}
+	record, err := allocator.GetDevice("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Usage.Period.Equal(currentPeriod()) || record.Usage.Total() != 0 {
+		t.Fatalf("usage %+v", record.Usage)
+	}
+}
@@ -0,0 +1,85 @@
+// File: server/ratelimit.go
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// minBurst allows at least a full buffer worth of data through an idle
+// bucket, whatever its rate
+const minBurst = 64 * 1024
+
+// tokenBucket limits throughput to rate bytes per second. Tokens may go
+// negative, the debt is paid back before anything else passes, so packets
+// of any size are accepted at the configured average rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket limited to rate bytes per second, or nil
+// which means unlimited when rate is not positive
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes worth of tokens and returns how long the caller has to
+// wait before sending them. If that would exceed maxWait nothing is taken and
+// ok is false, the packet should be dropped.
+func (b *tokenBucket) reserve(n int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	tokens := b.tokens - float64(n)
+	if tokens < 0 {
+		wait = time.Duration(-tokens / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens = tokens
+	return wait, true
+}
+
+// allow takes n bytes worth of tokens if there is no debt, it never waits
+func (b *tokenBucket) allow(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
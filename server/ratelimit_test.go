@@ -0,0 +1,95 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// elapse moves the last refill of the bucket back by d
+func (b *tokenBucket) elapse(d time.Duration) {
+	b.mu.Lock()
+	b.last = b.last.Add(-d)
+	b.mu.Unlock()
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		b := newTokenBucket(rate)
+		if b != nil {
+			t.Fatalf("rate %d: bucket created", rate)
+		}
+		if wait, ok := b.reserve(1<<20, 0); !ok || wait != 0 {
+			t.Fatalf("rate %d: wait %v", rate, wait)
+		}
+		if !b.allow(1 << 20) {
+			t.Fatalf("rate %d: denied", rate)
+		}
+	}
+	if b := newTokenBucket(1000); b.burst != minBurst {
+		t.Fatalf("burst %v of a slow bucket", b.burst)
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	const rate = 100000
+	b := newTokenBucket(rate)
+	if wait, ok := b.reserve(rate, 0); !ok || wait != 0 {
+		t.Fatalf("full burst: wait %v, ok %v", wait, ok)
+	}
+	// Half a second of debt
+	wait, ok := b.reserve(rate/2, time.Second)
+	if !ok || wait < 490*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("debt: wait %v, ok %v", wait, ok)
+	}
+	// Another second and a half exceeds the maximum wait, nothing is taken
+	if _, ok := b.reserve(rate, time.Second); ok {
+		t.Fatal("reservation beyond the maximum wait")
+	}
+	wait, ok = b.reserve(rate/10, time.Second)
+	if !ok || wait < 590*time.Millisecond || wait > 600*time.Millisecond {
+		t.Fatalf("after a refused reservation: wait %v, ok %v", wait, ok)
+	}
+	// The debt is paid off over time, tokens never exceed the burst
+	b.elapse(time.Hour)
+	if wait, ok := b.reserve(rate, 0); !ok || wait != 0 {
+		t.Fatalf("after refill: wait %v, ok %v", wait, ok)
+	}
+	if _, ok := b.reserve(1000, 0); ok {
+		t.Fatal("tokens above the burst")
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	const rate = 100000
+	b := newTokenBucket(rate)
+	// Packets larger than the remaining tokens pass while there is no debt
+	if !b.allow(rate-1) || !b.allow(10000) {
+		t.Fatal("denied without debt")
+	}
+	if b.allow(1) {
+		t.Fatal("allowed with debt")
+	}
+	b.elapse(100 * time.Millisecond)
+	if !b.allow(1) {
+		t.Fatal("denied once the debt is paid off")
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	for _, c := range []struct {
+		config internal.IRateLimitConfig
+		valid  bool
+	}{
+		{internal.IRateLimitConfig{}, true},
+		{internal.IRateLimitConfig{IRateLimit: internal.IRateLimit{Upload: 1000, Download: 2000}, MaxDelay: 100}, true},
+		{internal.IRateLimitConfig{IRateLimit: internal.IRateLimit{Upload: -1}}, false},
+		{internal.IRateLimitConfig{IRateLimit: internal.IRateLimit{Download: -1}}, false},
+		{internal.IRateLimitConfig{MaxDelay: -1}, false},
+	} {
+		if err := c.config.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: %v", c.config, err)
+		}
+	}
+}
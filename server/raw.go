@@ -0,0 +1,241 @@
+// File: server/raw.go
+//
+// The raw transport carries the messages of a link on TCP or TLS without
+// HTTP and WebSocket. Every message in either direction is framed as
+//
+//	| length uint32 | opcode uint8 | payload |
+//
+// with the big-endian length of the payload and a WebSocket opcode, frames
+// are not masked. The first message of the client is a text message with
+// its handshake headers in MIME format ended by an empty line, the same
+// headers including the key as in the WebSocket upgrade request. The server
+// answers with a text message of a status line, e.g. "200 OK", followed by
+// the response headers in the same format. Any status but 200 rejects the
+// client and closes the connection.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/xorgal/xtund/internal"
+)
+
+// rawHeaderSize is the size of the length and opcode of a raw frame
+const rawHeaderSize = 5
+
+// rawHandshakeTimeout bounds the TLS handshake and the exchange of headers
+const rawHandshakeTimeout = 10 * time.Second
+
+var errRawOpcode = errors.New("unknown opcode")
+var errRawHandshake = errors.New("handshake must be a text message")
+
+// rawTransport frames the messages of a link with a length prefix, r is the
+// buffered reader of the connection which already read the handshake
+type rawTransport struct {
+	transport string
+	r         *bufio.Reader
+}
+
+func (t *rawTransport) name() string {
+	return t.transport
+}
+
+func (t *rawTransport) reader(control func(op ws.OpCode, payload []byte) error) messageReader {
+	return &rawReader{r: t.r, control: control}
+}
+
+func (t *rawTransport) appendMessage(dst []byte, op ws.OpCode, payload []byte) []byte {
+	return appendRawFrame(dst, op, payload)
+}
+
+// rawReader reads raw frames of a client into a buffer which is reused for
+// every message
+type rawReader struct {
+	r      *bufio.Reader
+	header [rawHeaderSize]byte
+	buf    []byte
+	// control answers ping and close messages, they are skipped if it is nil
+	control func(op ws.OpCode, payload []byte) error
+}
+
+// next returns the next text or binary message, it is valid until the
+// following call. Control messages are handled in between, a close message
+// ends reading with io.EOF.
+func (rr *rawReader) next() ([]byte, ws.OpCode, error) {
+	for {
+		_, err := io.ReadFull(rr.r, rr.header[:])
+		if err != nil {
+			return nil, 0, err
+		}
+		length := binary.BigEndian.Uint32(rr.header[:])
+		op := ws.OpCode(rr.header[4])
+		if length > maxMessageSize {
+			return nil, 0, errMessageSize
+		}
+		if op.IsControl() && length > 125 {
+			return nil, 0, ws.ErrProtocolControlPayloadOverflow
+		}
+		rr.buf = grow(rr.buf[:0], int(length))[:length]
+		_, err = io.ReadFull(rr.r, rr.buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch op {
+		case ws.OpText, ws.OpBinary:
+			return rr.buf, op, nil
+		case ws.OpPing, ws.OpPong, ws.OpClose:
+			if rr.control != nil {
+				err = rr.control(op, rr.buf)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			if op == ws.OpClose {
+				return nil, 0, io.EOF
+			}
+		default:
+			return nil, 0, errRawOpcode
+		}
+	}
+}
+
+// appendRawFrame appends a message framed for the raw transport
+func appendRawFrame(dst []byte, op ws.OpCode, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = append(dst, byte(op))
+	return append(dst, payload...)
+}
+
+// listenRaw accepts clients of the raw transport on the listeners until ctx
+// is done
+func (t *tunnelServer) listenRaw(ctx context.Context, listeners []internal.IListenerConfig) error {
+	err := internal.ValidateListeners(listeners)
+	if err != nil {
+		return err
+	}
+	var opened []net.Listener
+	for _, c := range listeners {
+		ln, err := listen(c)
+		if err != nil {
+			for _, ln := range opened {
+				ln.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %v", c.Addr, err)
+		}
+		opened = append(opened, ln)
+	}
+	for i, ln := range opened {
+		go func(ln net.Listener) {
+			<-ctx.Done()
+			ln.Close()
+		}(ln)
+		go t.acceptRaw(ln, listeners[i].Transport)
+		slog.Info("Listening for raw tunnels", "addr", ln.Addr().String(), "transport", listeners[i].Transport)
+	}
+	return nil
+}
+
+// listen opens the listener of c, TLS listeners load their certificate
+func listen(c internal.IListenerConfig) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if c.Transport == internal.TransportTLS {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
+
+func (t *tunnelServer) acceptRaw(ln net.Listener, transport string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("failed to accept raw tunnel", "err", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go t.serveRaw(conn, transport)
+	}
+}
+
+// serveRaw exchanges the handshake with a client of the raw transport and
+// serves its link
+func (t *tunnelServer) serveRaw(conn net.Conn, transport string) {
+	remote := conn.RemoteAddr().String()
+	fail := func(err error) {
+		internal.Audit(internal.AuditHandshakeFailed, remote, "transport", transport, "err", err)
+		slog.Warn("raw handshake failed", "remote", remote, "transport", transport, "err", err)
+		conn.Close()
+	}
+	conn.SetDeadline(time.Now().Add(rawHandshakeTimeout))
+	br := bufio.NewReaderSize(conn, 64*1024)
+	msg, op, err := (&rawReader{r: br}).next()
+	if err == nil && op != ws.OpText {
+		err = errRawHandshake
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	request, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg))).ReadMIMEHeader()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if !authenticate(t.config, http.Header(request), remote, transport) {
+		writeRawHandshake(conn, http.StatusForbidden, nil)
+		conn.Close()
+		return
+	}
+	h, status, err := t.negotiate(remote, http.Header(request))
+	if err != nil {
+		slog.Info("raw tunnel rejected", "remote", remote, "transport", transport, "err", err)
+		writeRawHandshake(conn, status, nil)
+		conn.Close()
+		return
+	}
+	err = writeRawHandshake(conn, http.StatusOK, h.reply)
+	if err != nil {
+		t.abort(h)
+		fail(err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	t.serve(h, conn, &rawTransport{transport: transport, r: br})
+}
+
+// writeRawHandshake answers the handshake of a client with status and the
+// headers of the server
+func writeRawHandshake(conn net.Conn, status int, header http.Header) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d %s\r\n", status, http.StatusText(status))
+	header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := conn.Write(appendRawFrame(nil, ws.OpText, b.Bytes()))
+	return err
+}
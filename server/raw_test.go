@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// newRawReader reads raw frames from b, control messages are passed to
+// control
+func newRawReader(b []byte, control func(op ws.OpCode, payload []byte) error) messageReader {
+	t := &rawTransport{r: bufio.NewReader(bytes.NewReader(b))}
+	return t.reader(control)
+}
+
+func TestRawFrameLayout(t *testing.T) {
+	b := appendRawFrame([]byte{0xff}, ws.OpBinary, []byte{1, 2, 3})
+	if !bytes.Equal(b, []byte{0xff, 0, 0, 0, 3, byte(ws.OpBinary), 1, 2, 3}) {
+		t.Fatalf("frame %v", b)
+	}
+	if b := appendRawFrame(nil, ws.OpText, nil); !bytes.Equal(b, []byte{0, 0, 0, 0, byte(ws.OpText)}) {
+		t.Fatalf("empty frame %v", b)
+	}
+}
+
+func TestRawRoundTrip(t *testing.T) {
+	messages := []struct {
+		op      ws.OpCode
+		payload []byte
+	}{
+		{ws.OpText, []byte("hello")},
+		{ws.OpBinary, testPacket(1400)},
+		{ws.OpBinary, nil},
+		{ws.OpBinary, testPacket(maxMessageSize)},
+		{ws.OpBinary, testPacket(64)},
+	}
+	var stream []byte
+	for _, m := range messages {
+		stream = appendRawFrame(stream, m.op, m.payload)
+	}
+	r := newRawReader(stream, nil)
+	for i, m := range messages {
+		b, op, err := r.next()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if op != m.op || !bytes.Equal(b, m.payload) {
+			t.Fatalf("message %d: %d bytes of opcode %v", i, len(b), op)
+		}
+	}
+	if _, _, err := r.next(); err != io.EOF {
+		t.Fatalf("end of stream: %v", err)
+	}
+}
+
+func TestRawControl(t *testing.T) {
+	var stream []byte
+	stream = appendRawFrame(stream, ws.OpPing, []byte("ping"))
+	stream = appendRawFrame(stream, ws.OpBinary, []byte{1})
+	stream = appendRawFrame(stream, ws.OpPong, []byte("pong"))
+	stream = appendRawFrame(stream, ws.OpClose, []byte{3, 232})
+	stream = appendRawFrame(stream, ws.OpBinary, []byte{2})
+
+	var control []string
+	r := newRawReader(stream, func(op ws.OpCode, payload []byte) error {
+		control = append(control, string(payload))
+		return nil
+	})
+	b, _, err := r.next()
+	if err != nil || !bytes.Equal(b, []byte{1}) {
+		t.Fatalf("message after ping: %v %v", b, err)
+	}
+	// Messages after a close message are not read
+	if _, _, err := r.next(); err != io.EOF {
+		t.Fatalf("close: %v", err)
+	}
+	if len(control) != 3 || control[0] != "ping" || control[1] != "pong" {
+		t.Fatalf("control messages %q", control)
+	}
+
+	// Without a handler control messages are skipped
+	b, _, err = newRawReader(stream, nil).next()
+	if err != nil || !bytes.Equal(b, []byte{1}) {
+		t.Fatalf("message after ping: %v %v", b, err)
+	}
+}
+
+func TestRawReaderRejects(t *testing.T) {
+	header := func(length uint32, op ws.OpCode) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, length), byte(op))
+	}
+	for _, c := range []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		// Only the header is sent, the length is rejected before reading
+		// or allocating the payload
+		{"oversized", header(maxMessageSize+1, ws.OpBinary), errMessageSize},
+		{"largest length", header(1<<32-1, ws.OpBinary), errMessageSize},
+		{"oversized control", appendRawFrame(nil, ws.OpPing, make([]byte, 126)), ws.ErrProtocolControlPayloadOverflow},
+		{"unknown opcode", appendRawFrame(nil, ws.OpContinuation, []byte{1}), errRawOpcode},
+		{"reserved opcode", appendRawFrame(nil, 0x3, []byte{1}), errRawOpcode},
+		{"truncated payload", append(header(10, ws.OpBinary), 1, 2, 3), io.ErrUnexpectedEOF},
+		{"truncated header", []byte{0, 0, 0}, io.ErrUnexpectedEOF},
+	} {
+		r := newRawReader(c.stream, nil)
+		if _, _, err := r.next(); err != c.err {
+			t.Errorf("%s: %v, expected %v", c.name, err, c.err)
+		}
+		if rr := r.(*rawReader); cap(rr.buf) > 1<<10 {
+			t.Errorf("%s: %d bytes allocated", c.name, cap(rr.buf))
+		}
+	}
+}
+
+func TestServeRawRejectsHandshake(t *testing.T) {
+	for _, first := range [][]byte{
+		appendRawFrame(nil, ws.OpBinary, []byte("Key: x\r\n\r\n")),
+		append(binary.BigEndian.AppendUint32(nil, maxMessageSize+1), byte(ws.OpText)),
+	} {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			(&tunnelServer{}).serveRaw(server, "tcp")
+			close(done)
+		}()
+		client.Write(first)
+		// The connection is closed without an answer
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%d bytes answered: %v", n, err)
+		}
+		<-done
+		client.Close()
+	}
+}
+
+func TestWriteRawHandshake(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		writeRawHandshake(server, 200, map[string][]string{"X-Xtun-Mtu": {"1400"}})
+		server.Close()
+	}()
+	b, op, err := (&rawReader{r: bufio.NewReader(client)}).next()
+	if err != nil || op != ws.OpText {
+		t.Fatalf("opcode %v: %v", op, err)
+	}
+	if string(b) != "200 OK\r\nX-Xtun-Mtu: 1400\r\n\r\n" {
+		t.Fatalf("handshake %q", b)
+	}
+}
@@ -0,0 +1,181 @@
+// File: server/reload.go
+package server
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+// reloadHooks are called with the freshly loaded configuration every time the
+// daemon receives SIGHUP (`systemctl reload`). Settings which are not covered
+// by a hook take effect on restart only. Hooks publish settings through
+// atomic pointers, connections never read `internal.DaemonConfig` as it is
+// rewritten on reload.
+var reloadHooks = []func(config config.Config){
+	func(config.Config) {
+		err := internal.SetLogLevel(internal.DaemonConfig.Log.Level)
+		if err != nil {
+			slog.Error("failed to change log level", "err", err)
+		}
+	},
+	func(config.Config) {
+		rl := internal.DaemonConfig.RateLimit
+		err := rl.Validate()
+		if err != nil {
+			slog.Error("failed to reload rate limit", "err", err)
+			return
+		}
+		defaultRateLimit.Store(&rl)
+		for _, s := range sessions.all() {
+			s.refreshLimits()
+		}
+	},
+	// A changed quota limit is checked on the next flush of usage
+	func(config.Config) {
+		quota := internal.DaemonConfig.Quota
+		err := quota.Validate()
+		if err != nil {
+			slog.Error("failed to reload quota settings", "err", err)
+			return
+		}
+		defaultQuota.Store(&quota)
+		for _, s := range sessions.all() {
+			s.refreshLimits()
+		}
+	},
+	// An invalid ACL keeps the previous one active
+	func(config.Config) {
+		policy, err := compileACL(internal.DaemonConfig.ACL)
+		if err != nil {
+			slog.Error("failed to reload ACL", "err", err)
+			return
+		}
+		setACL(policy)
+	},
+	func(config.Config) {
+		policy, err := compilePeers(internal.DaemonConfig.Peers, internal.DaemonConfig.ACL.Groups)
+		if err != nil {
+			slog.Error("failed to reload peer policy", "err", err)
+			return
+		}
+		peers.Store(policy)
+	},
+	func(config.Config) {
+		routes := internal.DaemonConfig.Routes
+		err := routes.Validate()
+		if err != nil {
+			slog.Error("failed to reload routes", "err", err)
+			return
+		}
+		pushedRoutes.Store(&routes)
+	},
+	// Open sessions keep their codec
+	func(config.Config) {
+		codecs := internal.DaemonConfig.Codecs
+		err := internal.ValidateCodecs(codecs)
+		if err != nil {
+			slog.Error("failed to reload codecs", "err", err)
+			return
+		}
+		offeredCodecs.Store(&codecs)
+	},
+	func(config.Config) {
+		batch := internal.DaemonConfig.Batch
+		err := batch.Validate()
+		if err != nil {
+			slog.Error("failed to reload batch settings", "err", err)
+			return
+		}
+		batchSettings.Store(&batch)
+	},
+	// Open sessions keep their queue
+	func(config.Config) {
+		queue := internal.DaemonConfig.Queue
+		err := queue.Validate()
+		if err != nil {
+			slog.Error("failed to reload queue settings", "err", err)
+			return
+		}
+		queueSettings.Store(&queue)
+	},
+	// Open sessions keep their ping interval and timeout
+	func(config.Config) {
+		keepalive := internal.DaemonConfig.Keepalive
+		err := keepalive.Validate()
+		if err != nil {
+			slog.Error("failed to reload keepalive settings", "err", err)
+			return
+		}
+		keepaliveSettings.Store(&keepalive)
+	},
+	// Parked sessions keep their grace period
+	func(config.Config) {
+		resume := internal.DaemonConfig.Resume
+		err := resume.Validate()
+		if err != nil {
+			slog.Error("failed to reload resume settings", "err", err)
+			return
+		}
+		resumeSettings.Store(&resume)
+	},
+	// Sessions keep connections above a lowered maximum
+	func(config.Config) {
+		links := internal.DaemonConfig.Links
+		err := links.Validate()
+		if err != nil {
+			slog.Error("failed to reload link settings", "err", err)
+			return
+		}
+		linkSettings.Store(&links)
+	},
+	// An admin key equal to the client key keeps the previous one active
+	func(config config.Config) {
+		key := internal.DaemonConfig.AdminKey
+		err := internal.ValidateAdminKey(key, config.Key)
+		if err != nil {
+			slog.Error("failed to reload admin key", "err", err)
+			return
+		}
+		adminKey.Store(&key)
+	},
+	// The forwarder is started or stopped on restart only
+	func(config.Config) {
+		dns := internal.DaemonConfig.DNS
+		err := dns.Validate()
+		if err != nil {
+			slog.Error("failed to reload DNS settings", "err", err)
+			return
+		}
+		dns.Forwarder = dnsSettings.Load().Forwarder
+		dnsSettings.Store(&dns)
+	},
+}
+
+// LoadConfig loads the configuration on SIGHUP. `run --foreground` replaces it
+// to keep its flag and environment overrides.
+var LoadConfig = internal.LoadConfigFile
+
+// watchReload reloads the configuration file on SIGHUP. Without a handler the
+// signal would terminate the daemon.
+func watchReload() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		err := LoadConfig()
+		if err != nil {
+			internal.Audit(internal.AuditConfigReloaded, "signal", "err", err)
+			slog.Error("failed to reload configuration", "err", err)
+			continue
+		}
+		for _, hook := range reloadHooks {
+			hook(config.AppConfig)
+		}
+		internal.Audit(internal.AuditConfigReloaded, "signal")
+		slog.Info("Configuration reloaded")
+	}
+}
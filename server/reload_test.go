@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+func TestReloadWhileConnecting(t *testing.T) {
+	daemon := internal.DaemonConfig
+	t.Cleanup(func() { internal.DaemonConfig = daemon })
+	stop := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	// The configuration is rewritten like LoadConfig does on SIGHUP
+	go func() {
+		defer reloads.Done()
+		c := daemon
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.Queue.Size = 256 + i%2*256
+			c.Keepalive.Timeout = 30 + i%2
+			internal.DaemonConfig = c
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s := newTestSession(internal.CodecNone)
+		server, client := net.Pipe()
+		if _, err := s.attach(server, &rawTransport{}, "pipe", false); err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+		client.Close()
+	}
+	close(stop)
+	reloads.Wait()
+}
@@ -0,0 +1,106 @@
+// File: server/resume.go
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// resumeSettings apply to sessions parked from then on, they are updated on
+// configuration reload
+var resumeSettings atomic.Pointer[internal.IResumeConfig]
+
+// resumeRegistry holds sessions whose client disconnected until it resumes
+// them with their ticket or the grace period expires. Their routes stay in
+// place, so packets to the client are queued meanwhile.
+type resumeRegistry struct {
+	mu     sync.Mutex
+	parked map[string]*parkedSession
+}
+
+type parkedSession struct {
+	s     *session
+	timer *time.Timer
+}
+
+var resumptions = resumeRegistry{parked: make(map[string]*parkedSession)}
+
+// newTicket returns a random resumption ticket
+func newTicket() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// resumeGrace returns the time a session is kept for its client, zero if
+// resumption is disabled
+func resumeGrace() time.Duration {
+	if p := resumeSettings.Load(); p != nil {
+		return time.Duration(p.Grace) * time.Second
+	}
+	return 0
+}
+
+// park keeps s for the grace period, expire is called if it is not resumed
+// by then. Sessions without a ticket are not parked.
+func (r *resumeRegistry) park(s *session, expire func(s *session)) bool {
+	grace := resumeGrace()
+	ticket := s.resumeTicket()
+	if ticket == "" || grace <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := &parkedSession{s: s}
+	p.timer = time.AfterFunc(grace, func() {
+		r.mu.Lock()
+		current, ok := r.parked[ticket]
+		if ok && current == p {
+			delete(r.parked, ticket)
+		}
+		r.mu.Unlock()
+		if ok && current == p {
+			expire(s)
+		}
+	})
+	r.parked[ticket] = p
+	return true
+}
+
+// take removes the session of ticket from the registry, nil if there is none
+func (r *resumeRegistry) take(ticket string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.parked[ticket]
+	if !ok {
+		return nil
+	}
+	p.timer.Stop()
+	delete(r.parked, ticket)
+	return p.s
+}
+
+// isParked reports whether s waits for its client
+func (r *resumeRegistry) isParked(s *session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.parked[s.resumeTicket()]
+	return ok && p.s == s
+}
+
+func (s *session) resumeTicket() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ticket
+}
+
+func (s *session) setTicket(ticket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ticket = ticket
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// setResumeGrace uses a grace period of seconds for the duration of the test
+func setResumeGrace(t *testing.T, seconds int) {
+	prev := resumeSettings.Load()
+	t.Cleanup(func() { resumeSettings.Store(prev) })
+	resumeSettings.Store(&internal.IResumeConfig{Grace: seconds})
+}
+
+func newTicketSession(ticket string) *session {
+	s := newTestSession(internal.CodecNone)
+	s.setTicket(ticket)
+	return s
+}
+
+func TestNewTicket(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ticket := newTicket()
+		if len(ticket) != 32 || seen[ticket] {
+			t.Fatalf("ticket %q", ticket)
+		}
+		seen[ticket] = true
+	}
+}
+
+func TestResumeNotParked(t *testing.T) {
+	r := resumeRegistry{parked: make(map[string]*parkedSession)}
+	expire := func(*session) { t.Error("session expired") }
+	setResumeGrace(t, 0)
+	if r.park(newTicketSession(newTicket()), expire) {
+		t.Fatal("parked with resumption disabled")
+	}
+	setResumeGrace(t, 30)
+	if r.park(newTicketSession(""), expire) {
+		t.Fatal("parked without a ticket")
+	}
+	if r.take("") != nil || r.take(newTicket()) != nil {
+		t.Fatal("unknown ticket taken")
+	}
+}
+
+func TestResumeTake(t *testing.T) {
+	r := resumeRegistry{parked: make(map[string]*parkedSession)}
+	setResumeGrace(t, 1)
+	s := newTicketSession(newTicket())
+	if !r.park(s, func(*session) { t.Error("resumed session expired") }) {
+		t.Fatal("not parked")
+	}
+	if !r.isParked(s) {
+		t.Fatal("parked session not found")
+	}
+	if r.take(s.resumeTicket()) != s {
+		t.Fatal("session not taken")
+	}
+	// A ticket resumes its session once
+	if r.take(s.resumeTicket()) != nil || r.isParked(s) {
+		t.Fatal("session taken twice")
+	}
+	// The grace period of a resumed session is stopped
+	time.Sleep(1200 * time.Millisecond)
+}
+
+func TestResumeGrace(t *testing.T) {
+	r := resumeRegistry{parked: make(map[string]*parkedSession)}
+	setResumeGrace(t, 1)
+	expired := make(chan *session, 4)
+	expire := func(s *session) { expired <- s }
+
+	s := newTicketSession(newTicket())
+	parked := time.Now()
+	r.park(s, expire)
+	// Parking the session again replaces the pending grace period
+	time.Sleep(500 * time.Millisecond)
+	r.park(s, expire)
+	select {
+	case e := <-expired:
+		if e != s {
+			t.Fatal("other session expired")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not expired")
+	}
+	if elapsed := time.Since(parked); elapsed < 1500*time.Millisecond {
+		t.Fatalf("expired after %v with the first grace period", elapsed)
+	}
+	if r.isParked(s) || r.take(s.resumeTicket()) != nil {
+		t.Fatal("expired session still parked")
+	}
+	select {
+	case <-expired:
+		t.Fatal("session expired twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
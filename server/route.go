@@ -0,0 +1,89 @@
+// File: server/route.go
+package server
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// routeTable maps tunnel addresses of clients to their session. Routes are
+// learned from the source address of packets and removed with the session.
+type routeTable struct {
+	mu     sync.RWMutex
+	routes map[netip.Addr]*session
+}
+
+var clientRoutes = routeTable{routes: make(map[netip.Addr]*session)}
+
+func (t *routeTable) get(addr netip.Addr) (*session, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s, ok := t.routes[addr]
+	return s, ok
+}
+
+// set routes addr to s, the write lock is only taken if the route changed
+func (t *routeTable) set(addr netip.Addr, s *session) {
+	t.mu.RLock()
+	current := t.routes[addr]
+	t.mu.RUnlock()
+	if current == s {
+		return
+	}
+	t.mu.Lock()
+	t.routes[addr] = s
+	t.mu.Unlock()
+}
+
+// claim routes addr to s unless it is the route of another session
+func (t *routeTable) claim(addr netip.Addr, s *session) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if current, ok := t.routes[addr]; ok && current != s {
+		return false
+	}
+	t.routes[addr] = s
+	return true
+}
+
+// delete removes the route of addr if it still points to s
+func (t *routeTable) delete(addr netip.Addr, s *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.routes[addr] == s {
+		delete(t.routes, addr)
+	}
+}
+
+// removeSession removes every route of s
+func (t *routeTable) removeSession(s *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, v := range t.routes {
+		if v == s {
+			delete(t.routes, addr)
+		}
+	}
+}
+
+// srcAddr returns the source address of an IPv4 or IPv6 packet
+func srcAddr(packet []byte) (netip.Addr, bool) {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(packet[12:16])), true
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(packet[8:24])), true
+	}
+	return netip.Addr{}, false
+}
+
+// dstAddr returns the destination address of an IPv4 or IPv6 packet
+func dstAddr(packet []byte) (netip.Addr, bool) {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(packet[16:20])), true
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(packet[24:40])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,28 @@
+// File: server/routes.go
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// pushedRoutes are the routes sent to clients, they are updated on
+// configuration reload and picked up by clients on their next request
+var pushedRoutes atomic.Pointer[internal.IRoutesConfig]
+
+// routesResponse returns the routes of a device, an empty ID returns the
+// routes of the pool
+func routesResponse(id string) RoutesResponse {
+	var set internal.IRouteSet
+	if c := pushedRoutes.Load(); c != nil {
+		set = c.RoutesFor(id)
+	} else {
+		set = internal.IRoutesConfig{}.RoutesFor(id)
+	}
+	return RoutesResponse{
+		Routes:         set.Routes,
+		ExcludedRoutes: set.Exclude,
+		FullTunnel:     set.FullTunnel,
+	}
+}
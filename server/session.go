@@ -0,0 +1,462 @@
+// File: server/session.go
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
+// session is the tunnel of a single client device, it is served on one or
+// more links. Resumable sessions outlive their links for a grace period, see
+// `resumeRegistry`.
+type session struct {
+	created time.Time
+	// mtu is negotiated with the client on connection
+	mtu int
+	// codec compresses packets, nil if compression is off. Framed sessions
+	// flag every frame as compressed or raw.
+	codecName string
+	codec     codec
+	framed    bool
+	// batched sessions coalesce frames in both directions
+	batched bool
+	// identified is done once the session is bound to the address of the
+	// client, see `identify`. bound is not modified afterwards.
+	identified sync.Once
+	bound      netip.Addr
+
+	// links is replaced under linksMu, the data path only loads it
+	links   atomic.Pointer[[]*link]
+	linksMu sync.Mutex
+	// backlog holds frames while the session has no link and frames of lost
+	// links, every link sends from it
+	backlog      *writeQueue
+	queueConfig  internal.IQueueConfig
+	writeTimeout time.Duration
+	// joinToken joins further links to the session, it is empty if the
+	// client did not ask for it. It is set before the session is registered.
+	joinToken string
+
+	mu       sync.Mutex
+	logger   *slog.Logger
+	remote   string
+	deviceId string
+	ip       net.IP
+	// ticket resumes the session, it is empty if the client did not ask
+	// for resumption
+	ticket string
+
+	limits atomic.Pointer[sessionLimits]
+	acl    atomic.Pointer[sessionACL]
+	stats  sessionStats
+	// pending is traffic not yet added to the device usage
+	pending   sessionUsage
+	overQuota atomic.Bool
+	// rtt is the round-trip time of the last ping of any link in nanoseconds
+	rtt      atomic.Int64
+	lastSeen atomic.Int64
+}
+
+// sessionParams are negotiated with the client during the handshake
+type sessionParams struct {
+	mtu     int
+	codec   string
+	framed  bool
+	batched bool
+}
+
+// sessionLimits are the token buckets enforcing the rate limit of a session
+type sessionLimits struct {
+	rate     internal.IRateLimit
+	override *internal.IRateLimit
+	// blocked drops all traffic of a device over its quota
+	blocked  bool
+	maxDelay time.Duration
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+type sessionStats struct {
+	readBytes       atomic.Uint64
+	writtenBytes    atomic.Uint64
+	uploadDelayed   atomic.Uint64
+	uploadDropped   atomic.Uint64
+	downloadDropped atomic.Uint64
+	aclDenied       atomic.Uint64
+	peerForwarded   atomic.Uint64
+	peerDenied      atomic.Uint64
+	tooBig          atomic.Uint64
+	decodeFailed    atomic.Uint64
+	spoofed         atomic.Uint64
+	queueDropped    atomic.Uint64
+	timedOut        atomic.Uint64
+}
+
+type sessionUsage struct {
+	upload   atomic.Uint64
+	download atomic.Uint64
+}
+
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[*session]struct{}
+	// joinable holds sessions by their join token
+	joinable map[string]*session
+}
+
+// sessions holds every open session
+var sessions = sessionRegistry{sessions: make(map[*session]struct{}), joinable: make(map[string]*session)}
+
+// totals accumulates stats of all sessions, including closed ones
+var totals sessionStats
+
+// defaultRateLimit is the rate limit of devices without an override, it is
+// updated on configuration reload
+var defaultRateLimit atomic.Pointer[internal.IRateLimitConfig]
+
+func newSession(remote string, params sessionParams, logger *slog.Logger) *session {
+	s := &session{
+		remote:    remote,
+		created:   time.Now(),
+		mtu:       params.mtu,
+		codecName: params.codec,
+		codec:     newCodec(params.codec),
+		framed:    params.framed,
+		batched:   params.batched,
+		logger:    logger,
+	}
+	s.lastSeen.Store(s.created.Unix())
+	s.links.Store(&[]*link{})
+	queue := queueSettings.Load()
+	s.queueConfig = *queue
+	s.backlog = newWriteQueue(*queue, s.mtu)
+	s.writeTimeout = time.Duration(queue.WriteTimeout) * time.Millisecond
+	s.setRateLimit(nil)
+	s.refreshACL()
+	return s
+}
+
+// params returns the parameters negotiated with the client
+func (s *session) params() sessionParams {
+	return sessionParams{mtu: s.mtu, codec: s.codecName, framed: s.framed, batched: s.batched}
+}
+
+// identify binds the session to the tunnel IP of the client, the address of
+// its device or the source of its first packet (see `bindSource`), and
+// attaches the device if the IP is registered. Device settings are applied from then on. It must be
+// called through `identified`.
+func (s *session) identify(addr netip.Addr, allocator *internal.Allocator) {
+	s.bound = addr
+	src := net.IP(addr.AsSlice())
+	id, registered := allocator.LookupDevice(src)
+
+	s.mu.Lock()
+	s.ip = src
+	s.logger = s.logger.With("ip", addr.String())
+	if registered {
+		s.deviceId = id
+		s.logger = s.logger.With("device", id)
+	}
+	s.mu.Unlock()
+	s.refreshACL()
+
+	if registered {
+		record, err := allocator.GetDevice(id)
+		if err != nil {
+			s.log().Error("failed to load device settings", "err", err)
+		}
+		s.overQuota.Store(quotaExceeded(record))
+		s.setRateLimit(record.RateLimit)
+	}
+}
+
+// bindSource identifies a session whose client did not name its device by
+// the source of its first packet. Addresses of registered devices and of
+// other sessions are refused, the session stays unbound then and all its
+// packets are dropped. It must be called through `identified`.
+func (s *session) bindSource(src netip.Addr, allocator *internal.Allocator) bool {
+	if id, registered := allocator.LookupDevice(src.AsSlice()); registered {
+		s.log().Warn("session refused the address of a registered device", "src", src, "device", id)
+		return false
+	}
+	if !clientRoutes.claim(src, s) {
+		s.log().Warn("session refused the address of another session", "src", src)
+		return false
+	}
+	s.identify(src, allocator)
+	return true
+}
+
+// setRateLimit replaces the token buckets of the session, override is used
+// instead of the default rate limit if not nil. Sessions over quota are
+// blocked or throttled as configured.
+func (s *session) setRateLimit(override *internal.IRateLimit) {
+	defaults := defaultRateLimit.Load()
+	if defaults == nil {
+		defaults = &internal.IRateLimitConfig{}
+	}
+	l := &sessionLimits{
+		rate:     defaults.IRateLimit,
+		override: override,
+		maxDelay: time.Duration(defaults.MaxDelay) * time.Millisecond,
+	}
+	if override != nil {
+		l.rate = *override
+	}
+	if s.overQuota.Load() {
+		quota := currentQuota()
+		if quota.Action == internal.QuotaActionThrottle {
+			l.rate.Upload = throttle(l.rate.Upload, quota.ThrottleRate)
+			l.rate.Download = throttle(l.rate.Download, quota.ThrottleRate)
+		} else {
+			l.blocked = true
+		}
+	}
+	l.upload = newTokenBucket(l.rate.Upload)
+	l.download = newTokenBucket(l.rate.Download)
+	s.limits.Store(l)
+}
+
+// refreshLimits applies changed defaults or quota state to the session
+func (s *session) refreshLimits() {
+	s.setRateLimit(s.limits.Load().override)
+}
+
+// enqueue passes a frame in a pooled buffer to the writer goroutine of the
+// link of flow, which returns the buffer to the pool. Frames wait in the
+// backlog while the session has no link. Frames of full queues are dropped.
+func (s *session) enqueue(buf *[]byte, n int, flow uint32) error {
+	f := queuedFrame{buf: buf, n: n}
+	var err error
+	for {
+		l := s.pick(flow)
+		if l == nil {
+			err = s.backlog.push(f)
+			break
+		}
+		err = l.queue.push(f)
+		// The link was detached meanwhile, pick another one
+		if err != errQueueClosed {
+			break
+		}
+	}
+	if err != nil {
+		putBuffer(buf)
+	}
+	if err == errQueueFull {
+		s.countQueueDropped()
+	}
+	return err
+}
+
+// close releases resources of the session once the client is gone, frames
+// still queued are dropped
+func (s *session) close() {
+	for _, l := range *s.links.Load() {
+		s.detach(l)
+	}
+	s.backlog.close()
+	clientRoutes.removeSession(s)
+}
+
+// refreshACL selects the rules of the active policy for the session's device
+func (s *session) refreshACL() {
+	if p := acl.Load(); p != nil {
+		s.acl.Store(p.forDevice(s.device()))
+	}
+}
+
+// throttle returns the lower of two rates where zero means unlimited
+func throttle(rate int64, max int64) int64 {
+	if max > 0 && (rate <= 0 || rate > max) {
+		return max
+	}
+	return rate
+}
+
+func (s *session) log() *slog.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logger
+}
+
+func (s *session) device() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deviceId
+}
+
+func (s *session) remoteAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+func (s *session) addr() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ip
+}
+
+func (s *session) response() SessionResponse {
+	r := SessionResponse{
+		Device:          s.device(),
+		Remote:          s.remoteAddr(),
+		Since:           s.created.Unix(),
+		ReadBytes:       s.stats.readBytes.Load(),
+		WrittenBytes:    s.stats.writtenBytes.Load(),
+		UploadDelayed:   s.stats.uploadDelayed.Load(),
+		UploadDropped:   s.stats.uploadDropped.Load(),
+		DownloadDropped: s.stats.downloadDropped.Load(),
+		QuotaExceeded:   s.overQuota.Load(),
+		ACLDenied:       s.stats.aclDenied.Load(),
+		PeerForwarded:   s.stats.peerForwarded.Load(),
+		PeerDenied:      s.stats.peerDenied.Load(),
+		MTU:             s.mtu,
+		TooBig:          s.stats.tooBig.Load(),
+		Codec:           s.codecName,
+		DecodeFailed:    s.stats.decodeFailed.Load(),
+		Spoofed:         s.stats.spoofed.Load(),
+		Batched:         s.batched,
+		QueueDepth:      s.backlog.depth(),
+		QueueMaxDepth:   int(s.backlog.maxDepth.Load()),
+		QueueBytes:      s.backlog.queuedBytes(),
+		QueueMaxBytes:   int(s.backlog.maxBytes),
+		QueueDropped:    s.stats.queueDropped.Load(),
+		RTT:             float64(s.rtt.Load()) / float64(time.Millisecond),
+		LastSeen:        s.lastSeen.Load(),
+		Parked:          resumptions.isParked(s),
+	}
+	for _, l := range *s.links.Load() {
+		r.QueueDepth += l.queue.depth()
+		r.QueueMaxDepth = max(r.QueueMaxDepth, int(l.queue.maxDepth.Load()))
+		r.QueueBytes += l.queue.queuedBytes()
+		r.Links = append(r.Links, l.response())
+	}
+	if ip := s.addr(); ip != nil {
+		r.IP = ip.String()
+	}
+	l := s.limits.Load()
+	r.UploadRate = l.rate.Upload
+	r.DownloadRate = l.rate.Download
+	return r
+}
+
+func (s *session) countRead(n int) {
+	s.stats.readBytes.Add(uint64(n))
+	s.pending.upload.Add(uint64(n))
+	totals.readBytes.Add(uint64(n))
+}
+
+func (s *session) countWritten(n int) {
+	s.stats.writtenBytes.Add(uint64(n))
+	s.pending.download.Add(uint64(n))
+	totals.writtenBytes.Add(uint64(n))
+}
+
+func (s *session) countUploadDelayed() {
+	s.stats.uploadDelayed.Add(1)
+	totals.uploadDelayed.Add(1)
+}
+
+func (s *session) countUploadDropped() {
+	s.stats.uploadDropped.Add(1)
+	totals.uploadDropped.Add(1)
+}
+
+func (s *session) countDownloadDropped() {
+	s.stats.downloadDropped.Add(1)
+	totals.downloadDropped.Add(1)
+}
+
+func (s *session) countACLDenied() {
+	s.stats.aclDenied.Add(1)
+	totals.aclDenied.Add(1)
+}
+
+func (s *session) countPeerForwarded() {
+	s.stats.peerForwarded.Add(1)
+	totals.peerForwarded.Add(1)
+}
+
+func (s *session) countPeerDenied() {
+	s.stats.peerDenied.Add(1)
+	totals.peerDenied.Add(1)
+}
+
+func (s *session) countTooBig() {
+	s.stats.tooBig.Add(1)
+	totals.tooBig.Add(1)
+}
+
+func (s *session) countDecodeFailed() {
+	s.stats.decodeFailed.Add(1)
+	totals.decodeFailed.Add(1)
+}
+
+func (s *session) countSpoofed() {
+	s.stats.spoofed.Add(1)
+	totals.spoofed.Add(1)
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s] = struct{}{}
+	if s.joinToken != "" {
+		r.joinable[s.joinToken] = s
+	}
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s)
+	if s.joinToken != "" {
+		delete(r.joinable, s.joinToken)
+	}
+}
+
+// join returns the session of a join token, nil if there is none
+func (r *sessionRegistry) join(token string) *session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.joinable[token]
+}
+
+func (r *sessionRegistry) all() []*session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*session, 0, len(r.sessions))
+	for s := range r.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// byDevice returns open sessions of the device
+func (r *sessionRegistry) byDevice(id string) []*session {
+	var list []*session
+	for _, s := range r.all() {
+		if s.device() == id {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func (s *session) countQueueDropped() {
+	s.stats.queueDropped.Add(1)
+	totals.queueDropped.Add(1)
+}
+
+func (s *session) countTimedOut() {
+	s.stats.timedOut.Add(1)
+	totals.timedOut.Add(1)
+}
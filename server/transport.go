@@ -0,0 +1,245 @@
+// File: server/transport.go
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+var errUnknownSession = errors.New("unknown session")
+var errUnknownDevice = errors.New("unknown device")
+
+// transport frames the messages of a link on its connection. Messages of
+// every transport are typed with WebSocket opcodes.
+type transport interface {
+	// name is reported in the stats of a link
+	name() string
+	// reader returns the reader of messages from the client, control
+	// messages are passed to control
+	reader(control func(op ws.OpCode, payload []byte) error) messageReader
+	// appendMessage appends a message to the client to dst
+	appendMessage(dst []byte, op ws.OpCode, payload []byte) []byte
+}
+
+// messageReader returns the next text or binary message of a client, it is
+// valid until the following call. A close message ends reading with io.EOF.
+type messageReader interface {
+	next() ([]byte, ws.OpCode, error)
+}
+
+// tunnelServer accepts the clients of every transport. Authentication,
+// sessions, routing and stats are shared by all of them.
+type tunnelServer struct {
+	config    config.Config
+	tun       *tunDevice
+	allocator *internal.Allocator
+	// conns are the connections of clients being served, they are hijacked
+	// from or not known to the HTTP server and closed on shutdown
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+// newTunnelServer starts reading packets to clients from every TUN queue
+func newTunnelServer(config config.Config, tun *tunDevice, allocator *internal.Allocator) *tunnelServer {
+	for _, q := range tun.queues {
+		go toClient(config, q)
+	}
+	return &tunnelServer{config: config, tun: tun, allocator: allocator, conns: make(map[net.Conn]struct{})}
+}
+
+// track adds conn to the connections closed on shutdown. It returns false
+// if the server is shutting down already.
+func (t *tunnelServer) track(conn net.Conn) bool {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *tunnelServer) untrack(conn net.Conn) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	delete(t.conns, conn)
+}
+
+// closeConns closes the connections of all clients and refuses new ones
+func (t *tunnelServer) closeConns() {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	clear(t.conns)
+}
+
+// expire ends a session for good
+func (t *tunnelServer) expire(s *session) {
+	s.close()
+	sessions.remove(s)
+	flushUsage(t.allocator, []*session{s})
+}
+
+// handshake is the transport independent part of accepting a client, reply
+// holds the handshake headers of the server
+type handshake struct {
+	remote string
+	logger *slog.Logger
+	reply  http.Header
+	params sessionParams
+	// The connection joins or resumes a session, a new session is created
+	// if both are nil
+	joined    *session
+	resumed   *session
+	ticket    string
+	joinToken string
+	// addr is the address of the device of a new session, it is invalid
+	// if the client did not name its device
+	addr netip.Addr
+}
+
+// negotiate agrees on the session of an authenticated client. A status and
+// error are returned to reject it.
+func (t *tunnelServer) negotiate(remote string, request http.Header) (*handshake, int, error) {
+	h := &handshake{remote: remote, logger: slog.With("remote", remote)}
+	if token := request.Get(headerJoin); token != "" && token != "1" {
+		s := sessions.join(token)
+		if s == nil {
+			return nil, http.StatusNotFound, errUnknownSession
+		}
+		// Sessions without links are resumed with their ticket
+		switch n := len(*s.links.Load()); {
+		case n == 0:
+			return nil, http.StatusConflict, errSessionGone
+		case n >= maxLinks():
+			return nil, http.StatusTooManyRequests, errTooManyLinks
+		}
+		h.joined = s
+		h.reply = handshakeHeader(s.params())
+		h.reply.Set(headerJoin, token)
+		return h, 0, nil
+	}
+	resume := request.Get(headerResume)
+	if resume != "" && resume != "1" {
+		h.resumed = resumptions.take(resume)
+	}
+	if h.resumed != nil {
+		// Queued frames are encoded for the parameters of the session
+		h.params = h.resumed.params()
+	} else {
+		if id := request.Get(headerDevice); id != "" {
+			ip, ok := t.allocator.LookupIP(id)
+			if !ok {
+				return nil, http.StatusForbidden, errUnknownDevice
+			}
+			h.addr, _ = netip.AddrFromSlice(ip.To4())
+		}
+		h.params = sessionParams{mtu: negotiateMTU(t.config.MTU, request.Get(headerMTU))}
+		h.params.codec, h.params.framed = negotiateCodec(t.config, request.Get(headerCompression))
+		h.params.batched = request.Get(headerBatch) == "1" && batchSettings.Load().Enabled
+	}
+	h.reply = handshakeHeader(h.params)
+	if resume != "" && resumeGrace() > 0 {
+		h.ticket = newTicket()
+		h.reply.Set(headerResume, h.ticket)
+	}
+	if h.resumed != nil {
+		h.reply.Set(headerResumed, "1")
+		h.joinToken = h.resumed.joinToken
+	} else if request.Get(headerJoin) == "1" && maxLinks() > 1 {
+		h.joinToken = newTicket()
+	}
+	if h.joinToken != "" {
+		h.reply.Set(headerJoin, h.joinToken)
+	}
+	return h, 0, nil
+}
+
+// abort gives a resumed session back if the connection failed before it
+// was served
+func (t *tunnelServer) abort(h *handshake) {
+	if h.resumed != nil && !resumptions.park(h.resumed, t.expire) {
+		t.expire(h.resumed)
+	}
+}
+
+// serve attaches conn to the session of the handshake and reads from the
+// client until the connection is lost
+func (t *tunnelServer) serve(h *handshake, conn net.Conn, tr transport) {
+	if !t.track(conn) {
+		t.abort(h)
+		conn.Close()
+		return
+	}
+	defer t.untrack(conn)
+	if s := h.joined; s != nil {
+		l, err := s.attach(conn, tr, h.remote, true)
+		if err != nil {
+			s.log().Info("connection not joined", "via", h.remote, "err", err)
+			conn.Write(tr.appendMessage(nil, ws.OpClose, ws.NewCloseFrameBody(ws.StatusPolicyViolation, err.Error())))
+			conn.Close()
+			return
+		}
+		s.log().Info("connection joined", "via", h.remote, "transport", tr.name())
+		t.serveLink(l)
+		return
+	}
+	s := h.resumed
+	if s == nil {
+		s = newSession(h.remote, h.params, h.logger)
+		s.joinToken = h.joinToken
+		if h.addr.IsValid() {
+			s.identified.Do(func() {
+				s.identify(h.addr, t.allocator)
+				s.log().Info("session established", "transport", tr.name())
+			})
+		}
+		sessions.add(s)
+	} else {
+		s.log().Info("session resumed", "via", h.remote, "transport", tr.name())
+	}
+	s.setTicket(h.ticket)
+	// A session without links admits a link at any limit
+	l, _ := s.attach(conn, tr, h.remote, false)
+	t.serveLink(l)
+}
+
+// serveLink reads from the client on l until the connection is lost. The
+// session is parked or expired once it has no link left.
+func (t *tunnelServer) serveLink(l *link) {
+	s := l.s
+	toServer(t.config, l, t.tun.assign(), t.allocator)
+	if s.detach(l) > 0 {
+		return
+	}
+	if resumptions.park(s, t.expire) {
+		s.log().Info("session parked for resumption")
+		return
+	}
+	t.expire(s)
+}
+
+// handshakeHeader returns the response headers for the negotiated params
+func handshakeHeader(params sessionParams) http.Header {
+	header := http.Header{headerMTU: []string{strconv.Itoa(params.mtu)}}
+	if params.framed {
+		header.Set(headerCompression, params.codec)
+	}
+	if params.batched {
+		header.Set(headerBatch, "1")
+	}
+	return header
+}
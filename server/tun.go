@@ -0,0 +1,48 @@
+// File: server/tun.go
+package server
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// tunDevice holds the queues of the TUN device. Every queue is read by a
+// goroutine of its own, sessions write to the queue they were assigned.
+type tunDevice struct {
+	queues []*tunQueue
+	next   atomic.Uint32
+}
+
+// tunQueue is a queue of the TUN device. Packets of queues with offloads
+// start with a virtio-net header.
+type tunQueue struct {
+	rw      io.ReadWriter
+	offload bool
+}
+
+func newTunDevice(queues []io.ReadWriteCloser, offload bool) *tunDevice {
+	t := &tunDevice{}
+	for _, q := range queues {
+		t.queues = append(t.queues, &tunQueue{rw: q, offload: offload})
+	}
+	return t
+}
+
+// assign picks the queue of a new session, sessions are distributed evenly
+func (t *tunDevice) assign() *tunQueue {
+	i := t.next.Add(1) - 1
+	return t.queues[int(i)%len(t.queues)]
+}
+
+// Write writes a single packet to the queue
+func (q *tunQueue) Write(b []byte) (int, error) {
+	if !q.offload {
+		return q.rw.Write(b)
+	}
+	buf := getBuffer(vnetHdrLen + len(b))
+	defer putBuffer(buf)
+	*buf = append(grow((*buf)[:0], vnetHdrLen+len(b))[:vnetHdrLen], b...)
+	clear((*buf)[:vnetHdrLen])
+	n, err := q.rw.Write(*buf)
+	return max(n-vnetHdrLen, 0), err
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xorgal/xtun-core/pkg/config"
+	"github.com/xorgal/xtund/internal"
+)
+
+// loopbackQueue is a TUN queue which answers every packet written to it with
+// the packet itself, source and destination swapped
+type loopbackQueue struct {
+	packets chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newLoopbackQueue() *loopbackQueue {
+	return &loopbackQueue{packets: make(chan []byte, 1024), done: make(chan struct{})}
+}
+
+func (q *loopbackQueue) Write(p []byte) (int, error) {
+	b := append([]byte(nil), p...)
+	copy(b[12:16], p[16:20])
+	copy(b[16:20], p[12:16])
+	select {
+	case q.packets <- b:
+		return len(p), nil
+	case <-q.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (q *loopbackQueue) Read(p []byte) (int, error) {
+	select {
+	case b := <-q.packets:
+		return copy(p, b), nil
+	case <-q.done:
+		return 0, io.EOF
+	}
+}
+
+func (q *loopbackQueue) Close() error {
+	q.once.Do(func() { close(q.done) })
+	return nil
+}
+
+// benchLink attaches a raw link on a loopback TCP connection to s, it returns
+// the link and the client end of the connection
+func benchLink(b *testing.B, ln net.Listener, s *session) (*link, net.Conn) {
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	l, err := s.attach(conn, &rawTransport{transport: "raw", r: bufio.NewReader(conn)}, "bench", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return l, client
+}
+
+// BenchmarkTunQueues passes packets of several sessions through fromClient
+// to loopback TUN queues, which answer them. The answers are read from the
+// queues, delivered to the sessions and received by their clients over
+// loopback links. A single queue is compared with a queue per core.
+func BenchmarkTunQueues(b *testing.B) {
+	const packetSize = 1400
+	const clients = 16
+	// window bounds the packets of a client in flight, so no queue drops
+	const window = 64
+	multi := min(max(runtime.NumCPU(), 2), 8)
+	allocator := newTestAllocator(b)
+	cfg := config.Config{BufferSize: 2048}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skipf("loopback is not available: %v", err)
+	}
+	b.Cleanup(func() { ln.Close() })
+
+	for _, n := range []int{1, multi} {
+		b.Run(fmt.Sprintf("queues=%d", n), func(b *testing.B) {
+			queues := make([]io.ReadWriteCloser, n)
+			for i := range queues {
+				queues[i] = newLoopbackQueue()
+			}
+			tun := newTunDevice(queues, false)
+			var readers sync.WaitGroup
+			for _, q := range tun.queues {
+				readers.Add(1)
+				go func(q *tunQueue) {
+					defer readers.Done()
+					toClient(cfg, q)
+				}(q)
+			}
+
+			var sent, received atomic.Int64
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			sessions := make([]*session, clients)
+			conns := make([]net.Conn, clients)
+			for i := range sessions {
+				s := newTestSession(internal.CodecNone)
+				sessions[i] = s
+				l, client := benchLink(b, ln, s)
+				conns[i] = client
+				iface := tun.assign()
+				packet := testPacket(packetSize)
+				copy(packet[12:16], net.IPv4(10, 0, 10, byte(10+i)).To4())
+				copy(packet[16:20], net.IPv4(192, 0, 2, 1).To4())
+				frame := s.encodeFrame(nil, packet)
+				credit := make(chan struct{}, window)
+				for j := 0; j < window; j++ {
+					credit <- struct{}{}
+				}
+
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					for range credit {
+						if sent.Add(1) > int64(b.N) {
+							return
+						}
+						fromClient(cfg, l, iface, allocator, frame)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					defer close(credit)
+					r := bufio.NewReader(client)
+					header := make([]byte, rawHeaderSize)
+					for {
+						// Every packet received returns a credit, the
+						// channel never fills
+						_, err := io.ReadFull(r, header)
+						if err != nil {
+							return
+						}
+						_, err = r.Discard(int(binary.BigEndian.Uint32(header)))
+						if err != nil {
+							return
+						}
+						if received.Add(1) == int64(b.N) {
+							close(done)
+						}
+						credit <- struct{}{}
+					}
+				}()
+			}
+
+			b.SetBytes(packetSize)
+			b.ResetTimer()
+			<-done
+			b.StopTimer()
+			for i, s := range sessions {
+				s.close()
+				conns[i].Close()
+			}
+			wg.Wait()
+			for _, q := range queues {
+				q.Close()
+			}
+			readers.Wait()
+		})
+	}
+}
@@ -1,6 +1,12 @@
 // File: server/types.go
 package server
 
+import (
+	"time"
+
+	"github.com/xorgal/xtund/internal"
+)
+
 type DefaultResponse struct {
 	Timestamp int64 `json:"timestamp"`
 }
@@ -9,10 +15,27 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
+// RoutesResponse tells the client which networks to route through the tunnel
+type RoutesResponse struct {
+	Routes         []string `json:"routes"`
+	ExcludedRoutes []string `json:"excludedRoutes"`
+	FullTunnel     bool     `json:"fullTunnel"`
+}
+
+// DNSResponse tells the client which DNS servers and search domains to use
+type DNSResponse struct {
+	Servers []string `json:"dnsServers"`
+	Search  []string `json:"searchDomains"`
+}
+
 type ServerConfigurationResponse struct {
 	BufferSize int  `json:"bufferSize"`
 	MTU        int  `json:"mtu"`
 	Compress   bool `json:"compress"`
+	// Codecs may be offered during the handshake, in order of preference
+	Codecs []string `json:"codecs"`
+	RoutesResponse
+	DNSResponse
 }
 
 type RegisterDeviceRequest struct {
@@ -22,4 +45,132 @@ type RegisterDeviceRequest struct {
 type RegisterDeviceResponse struct {
 	Server string `json:"server"`
 	Client string `json:"client"`
+	RoutesResponse
+	DNSResponse
+}
+
+type SessionResponse struct {
+	Device          string  `json:"device,omitempty"`
+	IP              string  `json:"ip,omitempty"`
+	Remote          string  `json:"remote"`
+	Since           int64   `json:"since"`
+	ReadBytes       uint64  `json:"readBytes"`
+	WrittenBytes    uint64  `json:"writtenBytes"`
+	UploadRate      int64   `json:"uploadRate"`
+	DownloadRate    int64   `json:"downloadRate"`
+	UploadDelayed   uint64  `json:"uploadDelayed"`
+	UploadDropped   uint64  `json:"uploadDropped"`
+	DownloadDropped uint64  `json:"downloadDropped"`
+	QuotaExceeded   bool    `json:"quotaExceeded"`
+	ACLDenied       uint64  `json:"aclDenied"`
+	PeerForwarded   uint64  `json:"peerForwarded"`
+	PeerDenied      uint64  `json:"peerDenied"`
+	MTU             int     `json:"mtu"`
+	TooBig          uint64  `json:"tooBig"`
+	Codec           string  `json:"codec"`
+	DecodeFailed    uint64  `json:"decodeFailed"`
+	Spoofed         uint64  `json:"spoofed"`
+	Batched         bool    `json:"batched"`
+	QueueDepth      int     `json:"queueDepth"`
+	QueueMaxDepth   int     `json:"queueMaxDepth"`
+	QueueBytes      int     `json:"queueBytes"`
+	QueueMaxBytes   int     `json:"queueMaxBytes"`
+	QueueDropped    uint64  `json:"queueDropped"`
+	RTT             float64 `json:"rttMs"`
+	LastSeen        int64   `json:"lastSeen"`
+	// Parked sessions wait for their client to resume them
+	Parked bool `json:"parked"`
+	// Links are the connections of the session
+	Links []LinkResponse `json:"links"`
+}
+
+// LinkResponse describes one connection of a session
+type LinkResponse struct {
+	Remote       string  `json:"remote"`
+	Transport    string  `json:"transport"`
+	Since        int64   `json:"since"`
+	WrittenBytes uint64  `json:"writtenBytes"`
+	QueueDepth   int     `json:"queueDepth"`
+	QueueBytes   int     `json:"queueBytes"`
+	RTT          float64 `json:"rttMs"`
+}
+
+type SessionTotalsResponse struct {
+	ReadBytes       uint64 `json:"readBytes"`
+	WrittenBytes    uint64 `json:"writtenBytes"`
+	UploadDelayed   uint64 `json:"uploadDelayed"`
+	UploadDropped   uint64 `json:"uploadDropped"`
+	DownloadDropped uint64 `json:"downloadDropped"`
+	ACLDenied       uint64 `json:"aclDenied"`
+	PeerForwarded   uint64 `json:"peerForwarded"`
+	PeerDenied      uint64 `json:"peerDenied"`
+	TooBig          uint64 `json:"tooBig"`
+	DecodeFailed    uint64 `json:"decodeFailed"`
+	Spoofed         uint64 `json:"spoofed"`
+	QueueDropped    uint64 `json:"queueDropped"`
+	TimedOut        uint64 `json:"timedOut"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+	// Totals include sessions which are already closed
+	Totals SessionTotalsResponse `json:"totals"`
+}
+
+type RateLimitRequest struct {
+	DeviceId string `json:"id"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+	// Reset removes the override, the device falls back to the default rate limit
+	Reset bool `json:"reset"`
+}
+
+type DeviceResponse struct {
+	DeviceId string `json:"id"`
+	internal.DeviceRecord
+}
+
+type QuotaRequest struct {
+	DeviceId string `json:"id"`
+	// Quota in bytes per period overrides the default quota if set, zero
+	// means unlimited
+	Quota *int64 `json:"quota,omitempty"`
+	// Reset removes the override, the device falls back to the default quota
+	Reset bool `json:"reset"`
+	// ResetUsage discards the usage of the current period
+	ResetUsage bool `json:"resetUsage"`
+}
+
+type DeviceUsageResponse struct {
+	DeviceId string    `json:"id"`
+	Period   time.Time `json:"period"`
+	Upload   uint64    `json:"upload"`
+	Download uint64    `json:"download"`
+	// Quota in bytes per period, zero means unlimited
+	Quota    int64 `json:"quota"`
+	Exceeded bool  `json:"exceeded"`
+}
+
+type ACLRuleResponse struct {
+	internal.IACLRule
+	Hits uint64 `json:"hits"`
+}
+
+type ACLResponse struct {
+	Default string `json:"default"`
+	// DefaultHits counts packets no rule matched
+	DefaultHits uint64            `json:"defaultHits"`
+	Rules       []ACLRuleResponse `json:"rules"`
+	Peers       PeersResponse     `json:"peers"`
+}
+
+type PeerRuleResponse struct {
+	internal.IPeerRule
+	Hits uint64 `json:"hits"`
+}
+
+type PeersResponse struct {
+	Default     string             `json:"default"`
+	DefaultHits uint64             `json:"defaultHits"`
+	Rules       []PeerRuleResponse `json:"rules"`
 }
@@ -18,29 +18,90 @@
 package server
 
 import (
+	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/gobwas/ws"
-	"github.com/net-byte/water"
-	"github.com/xorgal/xtun-core/pkg/config"
 	"github.com/xorgal/xtund/internal"
 )
 
-func initWebSocket(config config.Config, iface *water.Interface) {
-	go toClient(config, iface)
+// Handshake headers carry the offer of the client in the upgrade request
+// and the negotiated value in the response
+const (
+	// headerMTU is the MTU of the client
+	headerMTU = "X-Xtun-Mtu"
+	// headerCompression lists the codecs the client supports separated by
+	// commas, its presence enables frame flags
+	headerCompression = "X-Xtun-Compression"
+	// headerBatch is "1" if the client supports batches
+	headerBatch = "X-Xtun-Batch"
+	// headerResume is "1" if the client asks for a resumable session or the
+	// ticket of the session to resume. The response carries the ticket for
+	// the next reconnect.
+	headerResume = "X-Xtun-Resume"
+	// headerResumed is "1" if a session was resumed, otherwise the client
+	// starts over
+	headerResumed = "X-Xtun-Resumed"
+	// headerJoin is "1" if the client asks for a session it may join further
+	// connections to, the response carries the token to join with. Joining
+	// connections send the token.
+	headerJoin = "X-Xtun-Join"
+	// headerDevice is the ID the client registered its device with, the
+	// session is bound to the address of the device. Sessions of clients
+	// which do not send it are bound to the source of their first packet.
+	headerDevice = "X-Xtun-Device"
+)
+
+// negotiateMTU returns the lower of the server MTU and the one offered by
+// the client, clients which offer none use the server MTU
+func negotiateMTU(server int, offer string) int {
+	client, err := strconv.Atoi(offer)
+	if err != nil || client >= server {
+		return server
+	}
+	return max(client, internal.MinMTU)
+}
+
+// wsTransport frames messages of a link as WebSocket frames
+type wsTransport struct {
+	conn net.Conn
+}
+
+func (t wsTransport) name() string {
+	return "ws"
+}
 
+func (t wsTransport) reader(control func(op ws.OpCode, payload []byte) error) messageReader {
+	return newFrameReader(t.conn, control)
+}
+
+func (t wsTransport) appendMessage(dst []byte, op ws.OpCode, payload []byte) []byte {
+	return appendFrame(dst, op, payload)
+}
+
+// initWebSocket accepts clients upgrading to WebSocket on /ws
+func initWebSocket(t *tunnelServer) {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		if !checkPermission(w, r, config) {
+		if !checkPermission(w, r, t.config) {
+			return
+		}
+		h, status, err := t.negotiate(r.RemoteAddr, r.Header)
+		if err != nil {
+			http.Error(w, err.Error(), status)
 			return
 		}
-		wsconn, _, _, err := ws.UpgradeHTTP(r, w)
+		upgrader := ws.HTTPUpgrader{Header: h.reply}
+		wsconn, _, _, err := upgrader.Upgrade(r, w)
 		if err != nil {
-			internal.PrintErr("ws.UpgradeHTTP(r, w)", err)
+			internal.Audit(internal.AuditHandshakeFailed, r.RemoteAddr, "err", err)
+			h.logger.Warn("websocket upgrade failed", "err", err)
+			t.abort(h)
 			return
 		}
 
 		// Todo: handshake first
 
-		toServer(config, wsconn, iface)
+		t.serve(h, wsconn, wsTransport{conn: wsconn})
 	})
 }